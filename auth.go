@@ -0,0 +1,266 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package mongo
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// minScramIterations is the minimum iteration count accepted from the
+	// server.
+	minScramIterations = 4096
+
+	// errorCodeMechanismUnavailable is the error code returned by saslStart
+	// when the mechanism is not enabled or the user has no credentials for
+	// the mechanism.
+	errorCodeMechanismUnavailable = 334
+)
+
+// scramMechanism describes a SCRAM SASL mechanism.
+type scramMechanism struct {
+	name    string
+	newHash func() hash.Hash
+
+	// password returns the password used to compute the salted password.
+	password func(user, password string) (string, os.Error)
+}
+
+// scramMechanisms lists the mechanisms tried by Login in order of
+// preference.
+var scramMechanisms = []*scramMechanism{
+	&scramMechanism{"SCRAM-SHA-256", sha256.New, scramSHA256Password},
+	&scramMechanism{"SCRAM-SHA-1", sha1.New, scramSHA1Password},
+}
+
+func scramSHA256Password(user, password string) (string, os.Error) {
+	return saslPrep(password)
+}
+
+// scramSHA1Password returns the digest of the password used by MongoDB for
+// SCRAM-SHA-1 and the legacy authentication mechanism.
+func scramSHA1Password(user, password string) (string, os.Error) {
+	h := md5.New()
+	io.WriteString(h, user+":mongo:"+password)
+	return hex.EncodeToString(h.Sum()), nil
+}
+
+// saslResponse is the response to the saslStart and saslContinue commands.
+type saslResponse struct {
+	Ok             bool   "ok"
+	Errmsg         string "errmsg"
+	Code           int    "code"
+	ConversationId int    "conversationId"
+	Done           bool   "done"
+	Payload        []byte "payload"
+}
+
+// Login authenticates the connection as user with the password. The
+// database is the database where the user is defined.
+//
+// Login uses the SCRAM-SHA-256 mechanism and falls back to SCRAM-SHA-1 if the
+// server reports that SCRAM-SHA-256 is not available for the user or if the
+// password is rejected by SASLprep. Other errors do not fall back. Login
+// verifies the signature sent by the server at the end of the exchange.
+//
+// More information:
+//
+//  http://www.mongodb.org/display/DOCS/Security+and+Authentication
+func (db Database) Login(user, password string) os.Error {
+	var err os.Error
+	for _, m := range scramMechanisms {
+		var fallback bool
+		fallback, err = db.scram(m, user, password)
+		if !fallback {
+			break
+		}
+	}
+	return err
+}
+
+// mechanismUnavailable returns true if the response to saslStart reports that
+// the mechanism is not available. Servers before MongoDB 4.0 do not have an
+// error code for the error and report an unsupported mechanism.
+func mechanismUnavailable(r *saslResponse) bool {
+	return r.Code == errorCodeMechanismUnavailable ||
+		strings.Contains(strings.ToLower(r.Errmsg), "unsupported mechanism")
+}
+
+// scram runs the SCRAM conversation with the server. The returned boolean is
+// true if the next mechanism should be tried because the mechanism is not
+// available or the password cannot be prepared for the mechanism.
+func (db Database) scram(m *scramMechanism, user, password string) (bool, os.Error) {
+	password, err := m.password(user, password)
+	if err != nil {
+		return true, err
+	}
+
+	p := make([]byte, 24)
+	if _, err := io.ReadFull(rand.Reader, p); err != nil {
+		return false, err
+	}
+	clientNonce := base64.StdEncoding.EncodeToString(p)
+	clientFirstBare := "n=" + scramEscape(user) + ",r=" + clientNonce
+
+	// Read the response directly instead of using Run to get the error code
+	// of a failed command.
+	cursor, err := db.Conn.Find(db.Name+".$cmd", D{
+		{"saslStart", 1},
+		{"mechanism", m.name},
+		{"payload", []byte("n,," + clientFirstBare)},
+		{"autoAuthorize", 1},
+		{"options", D{{"skipEmptyExchange", true}}},
+	}, runFindOptions)
+	if err != nil {
+		return false, err
+	}
+	var r saslResponse
+	err = cursor.Next(&r)
+	cursor.Close()
+	if err != nil {
+		return false, err
+	}
+	if !r.Ok {
+		return mechanismUnavailable(&r), CommandResponse{r.Ok, r.Errmsg}.Error()
+	}
+
+	serverFirst := string(r.Payload)
+	attrs := scramAttrs(serverFirst)
+	serverNonce := attrs["r"]
+	if len(serverNonce) <= len(clientNonce) || !strings.HasPrefix(serverNonce, clientNonce) {
+		return false, os.NewError("mongo: invalid nonce from server")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		return false, os.NewError("mongo: invalid salt from server")
+	}
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil || iterations < minScramIterations {
+		return false, os.NewError("mongo: invalid iteration count from server")
+	}
+
+	clientFinal := "c=biws,r=" + serverNonce
+	authMessage := clientFirstBare + "," + serverFirst + "," + clientFinal
+
+	proof, serverSignature := m.proof(password, salt, iterations, authMessage)
+
+	conversationId := r.ConversationId
+	r = saslResponse{}
+	err = db.Run(D{
+		{"saslContinue", 1},
+		{"conversationId", conversationId},
+		{"payload", []byte(clientFinal + ",p=" + base64.StdEncoding.EncodeToString(proof))},
+	}, &r)
+	if err != nil {
+		return false, err
+	}
+
+	attrs = scramAttrs(string(r.Payload))
+	if e, ok := attrs["e"]; ok {
+		return false, os.NewError("mongo: authentication failed: " + e)
+	}
+	signature, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil || subtle.ConstantTimeCompare(signature, serverSignature) != 1 {
+		return false, os.NewError("mongo: invalid server signature")
+	}
+
+	// Older servers expect an empty message to complete the conversation.
+	if !r.Done {
+		r = saslResponse{}
+		err = db.Run(D{
+			{"saslContinue", 1},
+			{"conversationId", conversationId},
+			{"payload", []byte{}},
+		}, &r)
+		if err != nil {
+			return false, err
+		}
+		if !r.Done {
+			return false, os.NewError("mongo: authentication conversation not done after empty message")
+		}
+	}
+	return false, nil
+}
+
+// proof returns the client proof and the expected server signature for the
+// SCRAM authentication message.
+func (m *scramMechanism) proof(password string, salt []byte, iterations int, authMessage string) (proof, serverSignature []byte) {
+	saltedPassword := m.saltPassword(password, salt, iterations)
+	clientKey := m.hmac(saltedPassword, "Client Key")
+	h := m.newHash()
+	h.Write(clientKey)
+	proof = m.hmac(h.Sum(), authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	serverSignature = m.hmac(m.hmac(saltedPassword, "Server Key"), authMessage)
+	return proof, serverSignature
+}
+
+func (m *scramMechanism) hmac(key []byte, s string) []byte {
+	h := hmac.New(m.newHash, key)
+	io.WriteString(h, s)
+	return h.Sum()
+}
+
+// saltPassword computes Hi(password, salt, iterations) as defined in RFC
+// 5802. Hi is PBKDF2 with HMAC as the pseudorandom function and the output
+// length equal to the hash length.
+func (m *scramMechanism) saltPassword(password string, salt []byte, iterations int) []byte {
+	h := hmac.New(m.newHash, []byte(password))
+	h.Write(salt)
+	h.Write([]byte{0, 0, 0, 1})
+	u := h.Sum()
+	result := make([]byte, len(u))
+	copy(result, u)
+	for i := 1; i < iterations; i++ {
+		h.Reset()
+		h.Write(u)
+		u = h.Sum()
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+// scramEscape escapes the characters '=' and ',' in a SCRAM user name.
+func scramEscape(s string) string {
+	s = strings.Replace(s, "=", "=3D", -1)
+	return strings.Replace(s, ",", "=2C", -1)
+}
+
+// scramAttrs parses a SCRAM message into a map from attribute name to value.
+func scramAttrs(s string) map[string]string {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(s, ",", -1) {
+		if i := strings.Index(attr, "="); i > 0 {
+			attrs[attr[:i]] = attr[i+1:]
+		}
+	}
+	return attrs
+}
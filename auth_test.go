@@ -0,0 +1,276 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package mongo
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSCRAM implements the server side of the SCRAM mechanisms for a single
+// user. Other commands and queries are handled by sequenceQuery.
+type fakeSCRAM struct {
+	user, password string
+
+	// Mechanisms enabled on the server.
+	mechanisms []string
+
+	// Send an invalid server signature.
+	badSignature bool
+
+	// Require an empty message to complete the conversation.
+	emptyExchange bool
+
+	// Never complete the conversation.
+	neverDone bool
+
+	// Response to saslStart. If nil, then the conversation is started.
+	startResponse M
+
+	mu            sync.Mutex
+	starts        []string // mechanisms of the saslStart commands
+	authenticated int
+	conversations []*fakeConversation
+}
+
+type fakeConversation struct {
+	m               *scramMechanism
+	clientFirstBare string
+	serverFirst     string
+	done            bool
+}
+
+var fakeSalt = []byte("fake server salt")
+
+func (s *fakeSCRAM) query(namespace string, query M) ([]M, os.Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case query["saslStart"] != nil:
+		mechanism, _ := query["mechanism"].(string)
+		s.starts = append(s.starts, mechanism)
+		if s.startResponse != nil {
+			return []M{s.startResponse}, nil
+		}
+		var m *scramMechanism
+		for _, name := range s.mechanisms {
+			for _, sm := range scramMechanisms {
+				if name == mechanism && sm.name == mechanism {
+					m = sm
+				}
+			}
+		}
+		if m == nil {
+			return []M{{"ok": 0, "code": 334, "errmsg": "mechanism " + mechanism + " is not enabled"}}, nil
+		}
+		payload, _ := query["payload"].([]byte)
+		if !bytes.HasPrefix(payload, []byte("n,,")) {
+			return []M{{"ok": 0, "errmsg": "invalid client first message"}}, nil
+		}
+		clientFirstBare := string(payload[3:])
+		attrs := scramAttrs(clientFirstBare)
+		serverFirst := "r=" + attrs["r"] + "server-nonce,s=" + base64.StdEncoding.EncodeToString(fakeSalt) + ",i=4096"
+		s.conversations = append(s.conversations, &fakeConversation{m: m, clientFirstBare: clientFirstBare, serverFirst: serverFirst})
+		return []M{{"ok": 1, "conversationId": len(s.conversations), "done": false, "payload": []byte(serverFirst)}}, nil
+	case query["saslContinue"] != nil:
+		id, _ := query["conversationId"].(int)
+		if id < 1 || id > len(s.conversations) {
+			return []M{{"ok": 0, "errmsg": "no such conversation"}}, nil
+		}
+		conv := s.conversations[id-1]
+		payload, _ := query["payload"].([]byte)
+		if conv.done {
+			if len(payload) != 0 {
+				return []M{{"ok": 0, "errmsg": "unexpected message"}}, nil
+			}
+			return []M{{"ok": 1, "conversationId": id, "done": !s.neverDone, "payload": []byte{}}}, nil
+		}
+		i := bytes.LastIndex(payload, []byte(",p="))
+		if i < 0 {
+			return []M{{"ok": 0, "errmsg": "invalid client final message"}}, nil
+		}
+		clientFinal := string(payload[:i])
+		proof, _ := base64.StdEncoding.DecodeString(string(payload[i+3:]))
+		password, _ := conv.m.password(s.user, s.password)
+		authMessage := conv.clientFirstBare + "," + conv.serverFirst + "," + clientFinal
+		expectedProof, signature := conv.m.proof(password, fakeSalt, 4096, authMessage)
+		if scramAttrs(conv.clientFirstBare)["n"] != s.user || !bytes.Equal(proof, expectedProof) {
+			return []M{{"ok": 0, "code": 18, "errmsg": "Authentication failed."}}, nil
+		}
+		if s.badSignature {
+			signature[0] ^= 1
+		}
+		conv.done = true
+		s.authenticated += 1
+		return []M{{"ok": 1, "conversationId": id, "done": !s.emptyExchange && !s.neverDone,
+			"payload": []byte("v=" + base64.StdEncoding.EncodeToString(signature))}}, nil
+	}
+	return sequenceQuery(namespace, query)
+}
+
+func (s *fakeSCRAM) state() ([]string, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.starts, s.authenticated
+}
+
+func TestLogin(t *testing.T) {
+	testLogin(t, 0)
+}
+
+func TestMsgLogin(t *testing.T) {
+	testLogin(t, minMsgWireVersion)
+}
+
+func testLogin(t *testing.T, maxWireVersion int) {
+	for _, tt := range []struct {
+		scram    fakeSCRAM
+		password string
+		ok       bool
+		starts   string
+	}{
+		{fakeSCRAM{mechanisms: []string{"SCRAM-SHA-256", "SCRAM-SHA-1"}}, "pencil", true, "SCRAM-SHA-256"},
+		{fakeSCRAM{mechanisms: []string{"SCRAM-SHA-1"}, emptyExchange: true}, "pencil", true, "SCRAM-SHA-256,SCRAM-SHA-1"},
+		{fakeSCRAM{mechanisms: []string{"SCRAM-SHA-256", "SCRAM-SHA-1"}}, "pen", false, "SCRAM-SHA-256"},
+		{fakeSCRAM{mechanisms: []string{"SCRAM-SHA-256"}, badSignature: true}, "pencil", false, "SCRAM-SHA-256"},
+		{fakeSCRAM{}, "pencil", false, "SCRAM-SHA-256,SCRAM-SHA-1"},
+		{fakeSCRAM{mechanisms: []string{"SCRAM-SHA-256"}, neverDone: true}, "pencil", false, "SCRAM-SHA-256"},
+		{fakeSCRAM{startResponse: M{"ok": 0, "code": 8000, "errmsg": "internal error"}}, "pencil", false, "SCRAM-SHA-256"},
+		{fakeSCRAM{startResponse: M{"ok": 0, "code": 2, "errmsg": "BadValue: Unsupported mechanism SCRAM-SHA-256"}}, "pencil", false, "SCRAM-SHA-256,SCRAM-SHA-1"},
+		{fakeSCRAM{mechanisms: []string{"SCRAM-SHA-256", "SCRAM-SHA-1"}, password: "pencil\u0007"}, "pencil\u0007", true, "SCRAM-SHA-1"},
+	} {
+		scram := &tt.scram
+		scram.user = "user"
+		if scram.password == "" {
+			scram.password = "pencil"
+		}
+		s := newFakeServerVersion(t, maxWireVersion, scram.query)
+		c := s.dial(t)
+
+		err := Database{Conn: c, Name: "admin"}.Login("user", tt.password)
+		starts, _ := scram.state()
+		if (err == nil) != tt.ok || strings.Join(starts, ",") != tt.starts {
+			t.Errorf("mechanisms %v, login returned %v after %v", tt.scram.mechanisms, err, starts)
+		}
+
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestDialLogin(t *testing.T) {
+	scram := &fakeSCRAM{user: "user", password: "pencil", mechanisms: []string{"SCRAM-SHA-256"}}
+	s := newFakeServerVersion(t, minMsgWireVersion, scram.query)
+	defer s.Close()
+	addr := s.ln.Addr().String()
+
+	p := NewDialPoolWithOptions(addr, &DialOptions{User: "user", Password: "pencil"}, 1)
+	c1, err := p.Get()
+	if err != nil {
+		t.Fatal("get", err)
+	}
+	c2, err := p.Get()
+	if err != nil {
+		t.Fatal("get", err)
+	}
+	if _, n := scram.state(); n != 2 {
+		t.Errorf("authenticated %d connections, want 2", n)
+	}
+	c1.Close()
+	c2.Close()
+
+	if _, err := DialWithOptions(addr, &DialOptions{User: "user", Password: "pen"}); err == nil {
+		t.Error("dial with wrong password returned nil error")
+	}
+}
+
+func TestSCRAMProof(t *testing.T) {
+	// Test vectors from RFC 5802 and RFC 7677.
+	for _, tt := range []struct {
+		m               *scramMechanism
+		clientFirstBare string
+		serverFirst     string
+		clientFinal     string
+		proof           string
+		signature       string
+	}{
+		{
+			scramMechanisms[1],
+			"n=user,r=fyko+d2lbbFgONRv9qkxdawL",
+			"r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096",
+			"c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j",
+			"v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=",
+			"rmF9pqV8S7suAoZWja4dJRkFsKQ=",
+		},
+		{
+			scramMechanisms[0],
+			"n=user,r=rOprNGfwEbeRWgbNEkqO",
+			"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+			"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0",
+			"dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+			"6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+		},
+	} {
+		attrs := scramAttrs(tt.serverFirst)
+		salt, _ := base64.StdEncoding.DecodeString(attrs["s"])
+		proof, signature := tt.m.proof("pencil", salt, 4096, tt.clientFirstBare+","+tt.serverFirst+","+tt.clientFinal)
+		if p := base64.StdEncoding.EncodeToString(proof); p != tt.proof {
+			t.Errorf("%s proof = %s, want %s", tt.m.name, p, tt.proof)
+		}
+		if s := base64.StdEncoding.EncodeToString(signature); s != tt.signature {
+			t.Errorf("%s signature = %s, want %s", tt.m.name, s, tt.signature)
+		}
+	}
+
+	if p, _ := scramSHA1Password("user", "pencil"); p != "1c33006ec1ffd90f9cadcbcc0e118200" {
+		t.Errorf("SCRAM-SHA-1 password = %s", p)
+	}
+	if s := scramEscape("a=b,c"); s != "a=3Db=2Cc" {
+		t.Errorf("scramEscape = %s", s)
+	}
+}
+
+var saslPrepTests = []struct {
+	s, expected string
+	ok          bool
+}{
+	{"user", "user", true},
+	{"USER", "USER", true},
+	{"I\u00adX", "IX", true},
+	{"a\u00a0b\u3000c", "a b c", true},
+	{"\u00aa", "a", true},
+	{"\u2168", "IX", true},
+	{"\uff50\uff45\uff4e", "pen", true},
+	{"\u0041\u030a", "\u00c5", true},
+	{"\u0627\u0628", "\u0627\u0628", true},
+	{"\u0007", "", false},
+	{"a\ue000", "", false},
+	{"\u06271", "", false},
+	{"\u0627a\u0628", "", false},
+	{"\xff", "", false},
+}
+
+func TestSASLprep(t *testing.T) {
+	for _, tt := range saslPrepTests {
+		s, err := saslPrep(tt.s)
+		if (err == nil) != tt.ok || s != tt.expected {
+			t.Errorf("saslPrep(%q) = %q, %v, want %q", tt.s, s, err, tt.expected)
+		}
+	}
+}
@@ -16,8 +16,10 @@ package mongo
 
 import (
 	"crypto/rand"
-	"encoding/binary"
 	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
 	"reflect"
 	"strconv"
 	"sync"
@@ -32,6 +34,61 @@ var emptyDoc = M{}
 // Unix epoch.
 type DateTime int64
 
+// zeroDateTime is the datetime for January 1, year 1 00:00:00 UTC. The zero
+// time.Time value is stored as this datetime for compatibility with other
+// drivers.
+const zeroDateTime = -62135596800000
+
+// isZeroTime returns true if t is the zero time.Time value.
+func isZeroTime(t *time.Time) bool {
+	return t.Year == 0 && t.Month == 0 && t.Day == 0 &&
+		t.Hour == 0 && t.Minute == 0 && t.Second == 0 &&
+		t.Nanosecond == 0 && t.ZoneOffset == 0
+}
+
+// dateTimeForTime converts t to a datetime. The boolean result is false if t
+// is outside the range of DateTime.
+func dateTimeForTime(t *time.Time) (DateTime, bool) {
+	if isZeroTime(t) {
+		return zeroDateTime, true
+	}
+	sec := t.Seconds()
+	ms := int64(t.Nanosecond / 1e6)
+	switch {
+	case sec > (math.MaxInt64-ms)/1000:
+		return math.MaxInt64, false
+	case sec < math.MinInt64/1000:
+		return math.MinInt64, false
+	}
+	return DateTime(sec*1000 + ms), true
+}
+
+// NewDateTime returns the datetime for t. Sub-millisecond precision is
+// truncated. The zero time.Time value converts to the datetime for January 1,
+// year 1 00:00:00 UTC. Times outside the range of DateTime are clamped to the
+// minimum or maximum DateTime.
+func NewDateTime(t *time.Time) DateTime {
+	dt, _ := dateTimeForTime(t)
+	return dt
+}
+
+// Time returns dt as a UTC time. The datetime for January 1, year 1 00:00:00
+// UTC converts to the zero time.Time value.
+func (dt DateTime) Time() *time.Time {
+	if dt == zeroDateTime {
+		return &time.Time{}
+	}
+	sec := int64(dt) / 1000
+	ms := int64(dt) % 1000
+	if ms < 0 {
+		sec -= 1
+		ms += 1000
+	}
+	t := time.SecondsToUTC(sec)
+	t.Nanosecond = int(ms) * 1e6
+	return t
+}
+
 // Timestamp represents a BSON timesamp.
 type Timestamp int64
 
@@ -55,42 +112,75 @@ type Regexp struct {
 	Options string
 }
 
-// ObjectId represents a BSON object identifier. 
+// Binary represents BSON binary data with a subtype. Use Binary instead of
+// []byte to read and write binary data with a subtype other than the generic
+// subtype 0. Common subtypes are:
+//
+//  0x00  Generic binary data
+//  0x01  Function
+//  0x02  Binary (old). The encoding adds an extra length prefix.
+//  0x03  UUID (old)
+//  0x04  UUID
+//  0x05  MD5
+//  0x80  User defined
+type Binary struct {
+	Subtype byte
+	Data    []byte
+}
+
+// ObjectId represents a BSON object identifier. A valid object id is 12 bytes
+// long. The zero value, an empty string, is not valid but is accepted by
+// the marshaling methods as a missing id.
 type ObjectId string
 
+// ErrInvalidObjectId is returned when text is not the hexadecimal encoding of
+// an object id.
+var ErrInvalidObjectId = os.NewError("mongo: invalid object id")
 
+// String returns the hexadecimal encoding of the object id.
 func (id ObjectId) String() string {
 	return hex.EncodeToString([]byte(string(id)))
 }
 
-func newObjectId(t int64, c uint64) ObjectId {
+// Hex returns the hexadecimal encoding of the object id. Hex is an alias for
+// String.
+func (id ObjectId) Hex() string {
+	return id.String()
+}
+
+// Valid returns true if the object id has the valid length.
+func (id ObjectId) Valid() bool {
+	return len(id) == 12
+}
+
+func newObjectId(t int64, r []byte, c uint32) ObjectId {
 	b := [12]byte{
 		byte(t >> 24),
 		byte(t >> 16),
 		byte(t >> 8),
 		byte(t),
-		byte(c >> 56),
-		byte(c >> 48),
-		byte(c >> 40),
-		byte(c >> 32),
-		byte(c >> 24),
+		r[0],
+		r[1],
+		r[2],
+		r[3],
+		r[4],
 		byte(c >> 16),
 		byte(c >> 8),
 		byte(c)}
 	return ObjectId(b[:])
 }
 
-// NewObjectId returns a new object id. This function uses the following format
-// for object ids:
+// NewObjectId returns a new object id. This function uses the standard
+// format for object ids:
+//
+//  [0:4]  Big endian time since epoch in seconds.
 //
-//  [0:4]  Big endian time since epoch in seconds. This is compatible 
-//         with other drivers.
-// 
-//  [4:12] Incrementing counter initialized with crypto random
-//         number. This ensures that object ids are unique, but
-//         is simpler than the format used by other drivers.
+//  [4:9]  Random value generated once per process.
+//
+//  [9:12] Big endian counter, initialized with a random value.
 func NewObjectId() ObjectId {
-	return newObjectId(time.Seconds(), nextOidCounter())
+	r, c := nextOidCounter()
+	return newObjectId(time.Seconds(), r, c)
 }
 
 // NewObjectIdString returns an object id initialized from the hexadecimal
@@ -106,41 +196,145 @@ func NewObjectIdHex(hexString string) (ObjectId, os.Error) {
 	return ObjectId(p), nil
 }
 
+// IsObjectIdHex returns true if s is the hexadecimal encoding of an object
+// id.
+func IsObjectIdHex(s string) bool {
+	_, err := NewObjectIdHex(s)
+	return err == nil
+}
+
 // MaxObjectIdForTime returns the maximum object id for time t in seconds from
 // the epoch.
 func MaxObjectIdForTime(t int64) ObjectId {
-	return newObjectId(t, 0xffffffffffffffff)
+	return newObjectId(t, []byte{0xff, 0xff, 0xff, 0xff, 0xff}, 0xffffff)
 }
 
 // MinObjectIdForTime returns the minimum object id for time t in seconds from
 // the epoch.
 func MinObjectIdForTime(t int64) ObjectId {
-	return newObjectId(t, 0)
+	return newObjectId(t, []byte{0, 0, 0, 0, 0}, 0)
+}
+
+// CreationTime returns the UTC time that the object id was created with a
+// resolution of one second. CreationTime returns nil if the object id is not
+// valid.
+func (id ObjectId) CreationTime() *time.Time {
+	if !id.Valid() {
+		return nil
+	}
+	return time.SecondsToUTC(int64(id[0])<<24 + int64(id[1])<<16 + int64(id[2])<<8 + int64(id[3]))
 }
 
-// CreationTime extracts the time the object id was created in seconds since the epoch.
-func (id ObjectId) CreationTime() int64 {
-	if len(id) != 12 {
+// Counter returns the counter part of the object id. Counter returns zero
+// if the object id is not valid.
+func (id ObjectId) Counter() int32 {
+	if !id.Valid() {
 		return 0
 	}
-	return int64(id[0])<<24 + int64(id[1])<<16 + int64(id[2])<<8 + int64(id[3])
+	return int32(id[9])<<16 + int32(id[10])<<8 + int32(id[11])
+}
+
+// MarshalJSON returns the object id as a JSON string containing the
+// hexadecimal encoding of the id. An empty object id is encoded as null.
+func (id ObjectId) MarshalJSON() ([]byte, os.Error) {
+	if id == "" {
+		return []byte("null"), nil
+	}
+	if !id.Valid() {
+		return nil, ErrInvalidObjectId
+	}
+	return []byte(`"` + id.String() + `"`), nil
+}
+
+// UnmarshalJSON sets the object id from a JSON string containing the
+// hexadecimal encoding of the id or from the Extended JSON form
+// {"$oid": "<hex>"}. The JSON values null and "" set the object id to the
+// empty object id.
+func (id *ObjectId) UnmarshalJSON(data []byte) os.Error {
+	var bd BSONData
+	if err := bd.UnmarshalExtJSON(data); err != nil {
+		return err
+	}
+	switch bd.Kind {
+	case kindObjectId:
+		*id = ObjectId(bd.Data)
+		return nil
+	case kindNull:
+		*id = ""
+		return nil
+	case kindString:
+		s, _ := bd.StringOK()
+		return id.UnmarshalText([]byte(s))
+	}
+	return ErrInvalidObjectId
+}
+
+// MarshalText returns the hexadecimal encoding of the object id.
+func (id ObjectId) MarshalText() ([]byte, os.Error) {
+	if id != "" && !id.Valid() {
+		return nil, ErrInvalidObjectId
+	}
+	return []byte(id.String()), nil
+}
+
+// UnmarshalText sets the object id from its hexadecimal encoding. Empty text
+// sets the object id to the empty object id.
+func (id *ObjectId) UnmarshalText(text []byte) os.Error {
+	if len(text) == 0 {
+		*id = ""
+		return nil
+	}
+	oid, err := NewObjectIdHex(string(text))
+	if err != nil {
+		return ErrInvalidObjectId
+	}
+	*id = oid
+	return nil
+}
+
+// Scan implements the fmt.Scanner interface. The object id is scanned from
+// its hexadecimal encoding with the verbs %s, %v and %x.
+func (id *ObjectId) Scan(state fmt.ScanState, verb int) os.Error {
+	switch verb {
+	case 's', 'v', 'x':
+	default:
+		return os.NewError("mongo: bad verb %" + string(verb) + " for ObjectId")
+	}
+	token, err := state.Token(true, func(c int) bool {
+		return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+	})
+	if err != nil {
+		return err
+	}
+	oid, err := NewObjectIdHex(string(token))
+	if err != nil {
+		return ErrInvalidObjectId
+	}
+	*id = oid
+	return nil
 }
 
 var (
 	oidLock    sync.Mutex
-	oidCounter uint64
+	oidRandom  []byte
+	oidCounter uint32
 )
 
-func nextOidCounter() uint64 {
+// nextOidCounter returns the per process random value and the next counter
+// value.
+func nextOidCounter() ([]byte, uint32) {
 	oidLock.Lock()
 	defer oidLock.Unlock()
-	if oidCounter == 0 {
-		if err := binary.Read(rand.Reader, binary.BigEndian, &oidCounter); err != nil {
+	if oidRandom == nil {
+		p := make([]byte, 8)
+		if _, err := io.ReadFull(rand.Reader, p); err != nil {
 			panic(err)
 		}
+		oidRandom = p[:5]
+		oidCounter = uint32(p[5])<<16 | uint32(p[6])<<8 | uint32(p[7])
 	}
-	oidCounter += 1
-	return oidCounter
+	oidCounter = (oidCounter + 1) & 0xffffff
+	return oidRandom, oidCounter
 }
 
 // BSONData represents a chunk of uninterpreted BSON data. Use this type to
@@ -153,7 +347,21 @@ type BSONData struct {
 // Deocde decodes bd to v. See the Decode function for more information about
 // BSON decoding. 
 func (bd BSONData) Decode(v interface{}) os.Error {
-	return decodeInternal(bd.Kind, bd.Data, v)
+	return decodeInternal(defaultDecoder, bd.Kind, bd.Data, v)
+}
+
+// Marshaler is the interface implemented by objects that can encode
+// themselves to a BSON value. If MarshalBSON returns BSONData with Kind equal
+// to zero, then the value is omitted from the encoding.
+type Marshaler interface {
+	MarshalBSON() (BSONData, os.Error)
+}
+
+// Unmarshaler is the interface implemented by objects that can decode
+// themselves from a BSON value. UnmarshalBSON must copy bd.Data if it wishes
+// to retain the data after returning.
+type Unmarshaler interface {
+	UnmarshalBSON(bd BSONData) os.Error
 }
 
 // Symbol represents a BSON symbol.
@@ -196,44 +404,65 @@ const (
 	MinValue MinMax = -1
 )
 
+// Undefined represents the deprecated BSON undefined value.
+type Undefined struct{}
+
+// DBPointer represents the deprecated BSON DBPointer value. New applications
+// should use DBRef.
+type DBPointer struct {
+	Namespace string
+	Id        ObjectId
+}
+
 const (
 	kindFloat         = 0x1
 	kindString        = 0x2
 	kindDocument      = 0x3
 	kindArray         = 0x4
 	kindBinary        = 0x5
+	kindUndefined     = 0x6
 	kindObjectId      = 0x7
 	kindBool          = 0x8
 	kindDateTime      = 0x9
 	kindNull          = 0xA
 	kindRegexp        = 0xB
+	kindDBPointer     = 0xC
 	kindCode          = 0xD
 	kindSymbol        = 0xE
 	kindCodeWithScope = 0xF
 	kindInt32         = 0x10
 	kindTimestamp     = 0x11
 	kindInt64         = 0x12
+	kindDecimal128    = 0x13
 	kindMinValue      = 0xff
 	kindMaxValue      = 0x7f
 )
 
+const (
+	binaryGeneric = 0x0
+	binaryOld     = 0x2
+)
+
 var kindNames = map[int]string{
 	kindFloat:         "float",
 	kindString:        "string",
 	kindDocument:      "document",
 	kindArray:         "array",
 	kindBinary:        "binary",
+	kindUndefined:     "undefined",
 	kindObjectId:      "objectId",
 	kindBool:          "bool",
 	kindDateTime:      "dateTime",
 	kindNull:          "null",
 	kindRegexp:        "regexp",
+	kindDBPointer:     "dbPointer",
 	kindCode:          "code",
 	kindSymbol:        "symbol",
 	kindCodeWithScope: "codeWithScope",
 	kindInt32:         "int32",
 	kindTimestamp:     "timestamp",
 	kindInt64:         "int64",
+	kindDecimal128:    "decimal128",
 	kindMinValue:      "minValue",
 	kindMaxValue:      "maxValue",
 }
@@ -250,32 +479,58 @@ type fieldInfo struct {
 	name        string
 	index       []int
 	conditional bool
+	omitEmpty   bool
+	minSize     bool
+	required    bool
 }
 
 type structInfo struct {
-	m      map[string]*fieldInfo
-	l      []*fieldInfo
-	fields D
+	m         map[string]*fieldInfo
+	l         []*fieldInfo
+	fields    D
+	extra     []int // index of inline map or D for unmatched elements
+	err       os.Error
 }
 
-func (si *structInfo) FieldInfo(name []byte) *fieldInfo {
-	return si.m[string(name)]
+// StructTagError is the error returned when a struct field tag is not valid.
+type StructTagError struct {
+	Type  reflect.Type
+	Field string
+	Msg   string
 }
 
-func compileStructInfo(t reflect.Type, depth map[string]int, index []int, si *structInfo) {
+func (e *StructTagError) String() string {
+	return "bson: struct " + e.Type.String() + " field " + e.Field + ": " + e.Msg
+}
+
+func compileStructInfo(t reflect.Type, depth map[string]int, index []int, si *structInfo, visiting map[reflect.Type]bool) os.Error {
+	visiting[t] = true
+	defer func() { visiting[t] = false }()
+
 	for i := 0; i < t.NumField(); i++ {
 		f := t.Field(i)
+		if f.Tag == "-" {
+			continue
+		}
 		switch {
 		case f.PkgPath != "":
 			// Ignore unexported fields.
 		case f.Anonymous:
-			// TODO: Handle pointers. Requires change to decoder and 
-			// protection against infinite recursion.
-			if f.Type.Kind() == reflect.Struct {
-				compileStructInfo(f.Type, depth, append(index, i), si)
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+				if ft.Kind() == reflect.Struct && visiting[ft] {
+					return &StructTagError{t, f.Name, "recursive embedded struct " + ft.String()}
+				}
+			}
+			if ft.Kind() == reflect.Struct {
+				if err := compileStructInfo(ft, depth, append(index, i), si, visiting); err != nil {
+					return err
+				}
 			}
 		default:
 			fi := &fieldInfo{name: f.Name}
+			inline := false
 			p := strings.Split(f.Tag, "/", -1)
 			if len(p) > 0 {
 				if len(p[0]) > 0 {
@@ -285,10 +540,48 @@ func compileStructInfo(t reflect.Type, depth map[string]int, index []int, si *st
 					switch s {
 					case "c":
 						fi.conditional = true
+					case "omitempty":
+						fi.conditional = true
+						fi.omitEmpty = true
+					case "minsize":
+						fi.minSize = true
+					case "required":
+						fi.required = true
+					case "inline":
+						inline = true
 					default:
-						panic(os.NewError("bson: unknown field flag " + s + " for type " + t.Name()))
+						return &StructTagError{t, f.Name, "unknown tag option " + strconv.Quote(s)}
+					}
+				}
+			}
+			if inline {
+				ft := f.Type
+				switch {
+				case ft == typeD || ft.Kind() == reflect.Map:
+					if ft != typeD && ft.Key().Kind() != reflect.String {
+						return &StructTagError{t, f.Name, "inline map must have string keys"}
+					}
+					if si.extra != nil {
+						return &StructTagError{t, f.Name, "multiple inline maps"}
+					}
+					si.extra = make([]int, len(index)+1)
+					copy(si.extra, index)
+					si.extra[len(index)] = i
+				case ft.Kind() == reflect.Ptr && ft.Elem().Kind() == reflect.Struct:
+					if visiting[ft.Elem()] {
+						return &StructTagError{t, f.Name, "recursive inline struct " + ft.Elem().String()}
 					}
+					if err := compileStructInfo(ft.Elem(), depth, append(index, i), si, visiting); err != nil {
+						return err
+					}
+				case ft.Kind() == reflect.Struct:
+					if err := compileStructInfo(ft, depth, append(index, i), si, visiting); err != nil {
+						return err
+					}
+				default:
+					return &StructTagError{t, f.Name, "inline field must be a struct, pointer to struct, map or D"}
 				}
+				continue
 			}
 			d, found := depth[fi.name]
 			if !found {
@@ -316,6 +609,7 @@ func compileStructInfo(t reflect.Type, depth map[string]int, index []int, si *st
 			}
 		}
 	}
+	return nil
 }
 
 var (
@@ -324,24 +618,24 @@ var (
 	defaultFieldInfo = &fieldInfo{}
 )
 
-func structInfoForType(t reflect.Type) *structInfo {
+func structInfoForType(t reflect.Type) (*structInfo, os.Error) {
 
 	structInfoMutex.RLock()
 	si, found := structInfoCache[t]
 	structInfoMutex.RUnlock()
 	if found {
-		return si
+		return si, si.err
 	}
 
 	structInfoMutex.Lock()
 	defer structInfoMutex.Unlock()
 	si, found = structInfoCache[t]
 	if found {
-		return si
+		return si, si.err
 	}
 
 	si = &structInfo{m: make(map[string]*fieldInfo)}
-	compileStructInfo(t, make(map[string]int), nil, si)
+	si.err = compileStructInfo(t, make(map[string]int), nil, si, make(map[reflect.Type]bool))
 
 	hasId := false
 	for _, fi := range si.l {
@@ -357,13 +651,36 @@ func structInfoForType(t reflect.Type) *structInfo {
 	}
 
 	structInfoCache[t] = si
-	return si
+	return si, si.err
+}
+
+// fieldByIndex returns the nested field of v corresponding to index. If a nil
+// pointer to an inline struct is found on the path, then the pointer is set to
+// a new value when alloc is true. Otherwise, fieldByIndex returns false.
+func fieldByIndex(v reflect.Value, index []int, alloc bool) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !alloc {
+					return reflect.Value{}, false
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
 }
 
 // StructFields returns a MongoDB field specification for the given struct
-// type.
+// type. StructFields panics if the struct has an invalid field tag.
 func StructFields(t reflect.Type) interface{} {
-	return structInfoForType(t).fields
+	si, err := structInfoForType(t)
+	if err != nil {
+		panic(err)
+	}
+	return si.fields
 }
 
 type aborted struct{ err os.Error }
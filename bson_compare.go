@@ -0,0 +1,443 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package mongo
+
+import (
+	"big"
+	"bytes"
+	"math"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Compare compares two values using the ordering used by the server and
+// returns -1, 0 or +1. Values of different types are ordered as
+//
+//      MinKey < undefined < null < numbers < string, symbol < document <
+//      array < binary < ObjectId < bool < datetime < timestamp < regexp <
+//      DBPointer < code < code with scope < MaxKey
+//
+// Numbers compare by value across int32, int64, double and decimal128. NaN
+// is less than all other numbers. Strings compare by bytes. Documents and
+// arrays compare element by element, first by the type of the value, then by
+// key and then by value.
+//
+// The arguments can be BSONData, Raw or any value that Encode can encode as
+// an element. A nil interface, nil pointer and a BSONData with Kind zero
+// compare as null. Compare panics if a value cannot be encoded.
+func Compare(a, b interface{}) int {
+	ak, ad := compareValue(a)
+	bk, bd := compareValue(b)
+	c, err := compareBSON(ak, ad, bk, bd)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// compareValue returns the BSON kind and data for a value passed to Compare.
+func compareValue(v interface{}) (int, []byte) {
+	switch v := v.(type) {
+	case nil:
+		return kindNull, nil
+	case BSONData:
+		if v.Kind == 0 {
+			return kindNull, nil
+		}
+		return v.Kind, v.Data
+	case Raw:
+		return kindDocument, v
+	}
+	e := encodeState{enc: defaultEncoder}
+	if err := e.encodeElement("", reflect.ValueOf(v)); err != nil {
+		panic(err)
+	}
+	if len(e.buffer) == 0 {
+		return kindNull, nil
+	}
+	return int(e.buffer[0]), e.buffer[2:]
+}
+
+// encodeElement encodes v as an element with the given name.
+func (e *encodeState) encodeElement(name string, v reflect.Value) (err os.Error) {
+	defer handleAbort(&err)
+	e.encodeValue(name, defaultFieldInfo, v)
+	return nil
+}
+
+// kindOrder returns the position of the kind in the server's ordering of
+// types.
+func kindOrder(kind int) int {
+	switch kind {
+	case kindMinValue:
+		return -1
+	case kindUndefined:
+		return 0
+	case kindNull:
+		return 5
+	case kindFloat, kindInt32, kindInt64, kindDecimal128:
+		return 10
+	case kindString, kindSymbol:
+		return 15
+	case kindDocument:
+		return 20
+	case kindArray:
+		return 25
+	case kindBinary:
+		return 30
+	case kindObjectId:
+		return 35
+	case kindBool:
+		return 40
+	case kindDateTime:
+		return 45
+	case kindTimestamp:
+		return 47
+	case kindRegexp:
+		return 50
+	case kindDBPointer:
+		return 55
+	case kindCode:
+		return 60
+	case kindCodeWithScope:
+		return 65
+	case kindMaxValue:
+		return 127
+	}
+	abort(&DecodeTypeError{kind})
+	panic("unreachable")
+}
+
+func compareBSON(akind int, adata []byte, bkind int, bdata []byte) (c int, err os.Error) {
+	defer handleAbort(&err)
+	a := decodeState{data: adata}
+	b := decodeState{data: bdata}
+	return compareValues(akind, &a, bkind, &b), nil
+}
+
+func sign(c int) int {
+	switch {
+	case c < 0:
+		return -1
+	case c > 0:
+		return 1
+	}
+	return 0
+}
+
+// compareValues compares the values at the current offsets in a and b. If the
+// values are equal, then the offsets are advanced past the values.
+func compareValues(akind int, a *decodeState, bkind int, b *decodeState) int {
+	if c := sign(kindOrder(akind) - kindOrder(bkind)); c != 0 {
+		return c
+	}
+	switch akind {
+	case kindFloat, kindInt32, kindInt64, kindDecimal128:
+		return compareNumbers(scanNumber(akind, a), scanNumber(bkind, b))
+	case kindString, kindSymbol, kindCode:
+		return compareStrings(a.scanString(), b.scanString())
+	case kindDocument, kindArray:
+		return compareDocs(a, b)
+	case kindBinary:
+		ap, as := a.scanBinary()
+		bp, bs := b.scanBinary()
+		switch {
+		case len(ap) != len(bp):
+			return sign(len(ap) - len(bp))
+		case as != bs:
+			return sign(as - bs)
+		}
+		return bytes.Compare(ap, bp)
+	case kindObjectId:
+		return bytes.Compare(a.scanObjectId(), b.scanObjectId())
+	case kindBool:
+		ab, bb := a.scanBool(), b.scanBool()
+		switch {
+		case ab == bb:
+			return 0
+		case bb:
+			return -1
+		}
+		return 1
+	case kindDateTime:
+		return compareInt64(a.scanInt64(), b.scanInt64())
+	case kindTimestamp:
+		au, bu := uint64(a.scanInt64()), uint64(b.scanInt64())
+		switch {
+		case au < bu:
+			return -1
+		case au > bu:
+			return 1
+		}
+		return 0
+	case kindRegexp:
+		ar, br := a.scanRegexp(), b.scanRegexp()
+		if c := compareStrings(ar.Pattern, br.Pattern); c != 0 {
+			return c
+		}
+		return compareStrings(ar.Options, br.Options)
+	case kindDBPointer:
+		ap, bp := a.scanDBPointer(), b.scanDBPointer()
+		if c := compareStrings(ap.Namespace, bp.Namespace); c != 0 {
+			return c
+		}
+		return compareStrings(string(ap.Id), string(bp.Id))
+	case kindCodeWithScope:
+		aoffset, boffset := a.beginDoc(), b.beginDoc()
+		c := compareStrings(a.scanString(), b.scanString())
+		if c == 0 {
+			if c = compareDocs(a, b); c == 0 {
+				a.endDoc(aoffset)
+				b.endDoc(boffset)
+			}
+		}
+		return c
+	}
+	// null, undefined, MinKey and MaxKey
+	return 0
+}
+
+func compareDocs(a, b *decodeState) int {
+	aoffset, boffset := a.beginDoc(), b.beginDoc()
+	c := 0
+	for c == 0 {
+		akind, aname := a.scanKindName()
+		bkind, bname := b.scanKindName()
+		switch {
+		case akind == 0 && bkind == 0:
+			a.endDoc(aoffset)
+			b.endDoc(boffset)
+			return 0
+		case akind == 0:
+			c = -1
+		case bkind == 0:
+			c = 1
+		default:
+			if c = sign(kindOrder(akind) - kindOrder(bkind)); c == 0 {
+				if c = bytes.Compare(aname, bname); c == 0 {
+					c = compareValues(akind, a, bkind, b)
+				}
+			}
+		}
+	}
+	// The offsets are not needed after the first difference.
+	return c
+}
+
+func compareStrings(a, b string) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// number holds a BSON number. Only one of the fields is used, as indicated
+// by kind.
+type number struct {
+	kind int
+	i    int64
+	f    float64
+	d    Decimal128
+}
+
+func scanNumber(kind int, d *decodeState) number {
+	n := number{kind: kind}
+	switch kind {
+	case kindInt32:
+		n.i = int64(d.scanInt32())
+		n.kind = kindInt64
+	case kindInt64:
+		n.i = d.scanInt64()
+	case kindFloat:
+		n.f = d.scanFloat()
+	case kindDecimal128:
+		n.d = d.scanDecimal128()
+	}
+	return n
+}
+
+// special returns a rank for NaN and infinities and false for finite numbers.
+func (n number) special() (int, bool) {
+	switch n.kind {
+	case kindFloat:
+		switch {
+		case math.IsNaN(n.f):
+			return -2, true
+		case math.IsInf(n.f, -1):
+			return -1, true
+		case math.IsInf(n.f, 1):
+			return 1, true
+		}
+	case kindDecimal128:
+		switch {
+		case n.d.IsNaN():
+			return -2, true
+		case n.d.IsInf() != 0:
+			return n.d.IsInf(), true
+		}
+	}
+	return 0, false
+}
+
+func (n number) rat() *big.Rat {
+	switch n.kind {
+	case kindInt64:
+		return big.NewRat(n.i, 1)
+	case kindFloat:
+		mant, exp := math.Frexp(n.f)
+		m := big.NewInt(int64(mant * (1 << 53)))
+		exp -= 53
+		if exp >= 0 {
+			return new(big.Rat).SetInt(m.Lsh(m, uint(exp)))
+		}
+		return new(big.Rat).SetFrac(m, new(big.Int).Lsh(big.NewInt(1), uint(-exp)))
+	}
+	r, err := n.d.Rat()
+	if err != nil {
+		abort(err)
+	}
+	return r
+}
+
+func compareNumbers(a, b number) int {
+	as, aspecial := a.special()
+	bs, bspecial := b.special()
+	if aspecial || bspecial {
+		return sign(as - bs)
+	}
+	switch {
+	case a.kind == kindInt64 && b.kind == kindInt64:
+		return compareInt64(a.i, b.i)
+	case a.kind == kindFloat && b.kind == kindFloat:
+		switch {
+		case a.f < b.f:
+			return -1
+		case a.f > b.f:
+			return 1
+		}
+		return 0
+	case a.kind == kindInt64 && b.kind == kindFloat:
+		return compareIntFloat(a.i, b.f)
+	case a.kind == kindFloat && b.kind == kindInt64:
+		return -compareIntFloat(b.i, a.f)
+	}
+	return a.rat().Cmp(b.rat())
+}
+
+// compareIntFloat compares an integer with a finite float without loss of
+// precision.
+func compareIntFloat(i int64, f float64) int {
+	switch {
+	case f >= 1<<63:
+		return -1
+	case f < -1<<63:
+		return 1
+	}
+	if c := compareInt64(i, int64(f)); c != 0 {
+		return c
+	}
+	frac := f - float64(int64(f))
+	switch {
+	case frac > 0:
+		return -1
+	case frac < 0:
+		return 1
+	}
+	return 0
+}
+
+// Less returns true if document a sorts before document b using the sort
+// specification spec. The specification is a list of (key, direction) pairs
+// like the ones passed to Query.Sort. A direction less than zero sorts in
+// descending order. Keys can use dot notation to reach into embedded
+// documents and arrays. Missing values sort as null.
+//
+// For example, to sort a slice of documents by ascending x and descending y:
+//
+//  sort.Sort(bySpec{docs, D{{"x", 1}, {"y", -1}}})
+//
+// where bySpec implements sort.Interface with Less(i, j) returning
+// mongo.Less(s.spec, s.docs[i], s.docs[j]).
+func Less(spec D, a, b M) bool {
+	for _, kv := range spec {
+		c := Compare(lookupPath(a, kv.Key), lookupPath(b, kv.Key))
+		if c != 0 {
+			if sortDirection(kv.Value) < 0 {
+				c = -c
+			}
+			return c < 0
+		}
+	}
+	return false
+}
+
+func sortDirection(v interface{}) float64 {
+	switch v := v.(type) {
+	case int:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	}
+	return 1
+}
+
+// lookupPath returns the value at the dotted path in v or nil if the path is
+// not found.
+func lookupPath(v interface{}, path string) interface{} {
+	for _, key := range strings.Split(path, ".", -1) {
+		switch m := v.(type) {
+		case map[string]interface{}:
+			v = m[key]
+		case M:
+			v = m[key]
+		case D:
+			v = nil
+			for _, kv := range m {
+				if kv.Key == key {
+					v = kv.Value
+					break
+				}
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(m) {
+				return nil
+			}
+			v = m[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
@@ -0,0 +1,427 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package mongo
+
+import (
+	"big"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	decimalMaxDigits   = 34
+	decimalExpBias     = 6176
+	decimalMinExp      = -6176
+	decimalMaxExp      = 6111
+	decimalNaNBits     = 0x7c00000000000000
+	decimalInfBits     = 0x7800000000000000
+	decimalSignBit     = 0x8000000000000000
+	decimalCoefHighMax = 1<<49 - 1
+)
+
+var (
+	errDecimalSyntax   = os.NewError("bson: cannot parse decimal128 string")
+	errDecimalInexact  = os.NewError("bson: decimal128 value cannot be represented exactly")
+	errDecimalSpecial  = os.NewError("bson: decimal128 value is NaN or infinite")
+	errDecimalNotExact = os.NewError("bson: rational value does not have a finite decimal representation")
+)
+
+// Decimal128 represents a BSON IEEE 754-2008 128-bit decimal floating point
+// value. The value is stored in the binary integer decimal (BID) encoding
+// used on the wire.
+//
+// Decimal128 does not implement arithmetic. Use ParseDecimal128 and String to
+// convert to and from text and the BigInt and Rat methods for exact
+// conversions to the big package types.
+type Decimal128 struct {
+	h, l uint64
+}
+
+// NewDecimal128 returns a decimal with the high and low 64 bits of the BID
+// encoding set to h and l.
+func NewDecimal128(h, l uint64) Decimal128 {
+	return Decimal128{h, l}
+}
+
+// Bits returns the high and low 64 bits of the BID encoding of d.
+func (d Decimal128) Bits() (h, l uint64) {
+	return d.h, d.l
+}
+
+// IsNaN returns true if d is not a number.
+func (d Decimal128) IsNaN() bool {
+	return d.h&decimalNaNBits == decimalNaNBits
+}
+
+// IsInf returns 1 if d is positive infinity, -1 if d is negative infinity and
+// 0 otherwise.
+func (d Decimal128) IsInf() int {
+	if d.h&decimalNaNBits != decimalInfBits {
+		return 0
+	}
+	if d.h&decimalSignBit != 0 {
+		return -1
+	}
+	return 1
+}
+
+// decompose returns the sign, coefficient and exponent of a finite decimal.
+// The coefficient is returned as the high and low 64 bits of a 128 bit
+// integer.
+func (d Decimal128) decompose() (neg bool, h, l uint64, exp int) {
+	neg = d.h&decimalSignBit != 0
+	if (d.h>>61)&3 == 3 {
+		// The coefficient in this form is larger than the maximum allowed
+		// value. The specification says to treat it as zero.
+		exp = int((d.h>>47)&0x3fff) - decimalExpBias
+		return neg, 0, 0, exp
+	}
+	exp = int((d.h>>49)&0x3fff) - decimalExpBias
+	h = d.h & decimalCoefHighMax
+	l = d.l
+	if h > 0x1ed09bead87c0 || (h == 0x1ed09bead87c0 && l > 0x378d8e63ffffffff) {
+		// Non-canonical coefficient greater than 10^34 - 1.
+		h, l = 0, 0
+	}
+	return neg, h, l, exp
+}
+
+// divmod10e9 divides the 128 bit integer h:l by 10^9.
+func divmod10e9(h, l uint64) (qh, ql uint64, r uint32) {
+	const d = 1000000000
+	var rem uint64
+	parts := [4]uint64{h >> 32, h & 0xffffffff, l >> 32, l & 0xffffffff}
+	for i, p := range parts {
+		n := rem<<32 | p
+		parts[i] = n / d
+		rem = n % d
+	}
+	return parts[0]<<32 | parts[1], parts[2]<<32 | parts[3], uint32(rem)
+}
+
+// mul10add multiplies the 128 bit integer h:l by 10 and adds n.
+func mul10add(h, l uint64, n uint64) (uint64, uint64) {
+	// 10x = 8x + 2x
+	h8, l8 := h<<3|l>>61, l<<3
+	h2, l2 := h<<1|l>>63, l<<1
+	rh, rl := h8+h2, l8+l2
+	if rl < l8 {
+		rh += 1
+	}
+	rl += n
+	if rl < n {
+		rh += 1
+	}
+	return rh, rl
+}
+
+// coefficientString returns the decimal representation of the 128 bit
+// integer h:l.
+func coefficientString(h, l uint64) string {
+	if h == 0 {
+		return strconv.Uitoa64(l)
+	}
+	var parts []uint32
+	for h != 0 || l != 0 {
+		var r uint32
+		h, l, r = divmod10e9(h, l)
+		parts = append(parts, r)
+	}
+	s := strconv.Uitoa64(uint64(parts[len(parts)-1]))
+	for i := len(parts) - 2; i >= 0; i-- {
+		p := strconv.Uitoa64(uint64(parts[i]))
+		s += strings.Repeat("0", 9-len(p)) + p
+	}
+	return s
+}
+
+// String returns the canonical string representation of d as described in
+// the BSON decimal128 specification.
+func (d Decimal128) String() string {
+	switch {
+	case d.IsNaN():
+		return "NaN"
+	case d.IsInf() > 0:
+		return "Infinity"
+	case d.IsInf() < 0:
+		return "-Infinity"
+	}
+
+	neg, h, l, exp := d.decompose()
+	digits := coefficientString(h, l)
+	adjusted := exp + len(digits) - 1
+
+	var s string
+	switch {
+	case exp <= 0 && adjusted >= -6:
+		// Plain notation.
+		switch {
+		case exp == 0:
+			s = digits
+		case len(digits) > -exp:
+			i := len(digits) + exp
+			s = digits[:i] + "." + digits[i:]
+		default:
+			s = "0." + strings.Repeat("0", -exp-len(digits)) + digits
+		}
+	default:
+		// Scientific notation.
+		s = digits[:1]
+		if len(digits) > 1 {
+			s += "." + digits[1:]
+		}
+		s += "E"
+		if adjusted >= 0 {
+			s += "+"
+		}
+		s += strconv.Itoa(adjusted)
+	}
+	if neg {
+		s = "-" + s
+	}
+	return s
+}
+
+// newDecimal128 returns the decimal for the given sign, decimal digits and
+// exponent. The digits must contain only the characters '0' through '9'. If
+// the value cannot be represented exactly, then errDecimalInexact is
+// returned.
+func newDecimal128(neg bool, digits string, exp int) (Decimal128, os.Error) {
+	digits = strings.TrimLeft(digits, "0")
+
+	if digits == "" {
+		// Zero can be clamped to any exponent without changing the value.
+		if exp < decimalMinExp {
+			exp = decimalMinExp
+		} else if exp > decimalMaxExp {
+			exp = decimalMaxExp
+		}
+	}
+
+	// Drop trailing zeros that do not fit in the coefficient.
+	for len(digits) > decimalMaxDigits {
+		if digits[len(digits)-1] != '0' {
+			return Decimal128{}, errDecimalInexact
+		}
+		digits = digits[:len(digits)-1]
+		exp += 1
+	}
+
+	// Clamp large exponents by adding zeros to the coefficient.
+	for exp > decimalMaxExp {
+		if len(digits) >= decimalMaxDigits {
+			return Decimal128{}, errDecimalInexact
+		}
+		digits += "0"
+		exp -= 1
+	}
+
+	// Clamp small exponents by removing zeros from the coefficient.
+	for exp < decimalMinExp {
+		if digits == "" || digits[len(digits)-1] != '0' {
+			return Decimal128{}, errDecimalInexact
+		}
+		digits = digits[:len(digits)-1]
+		exp += 1
+	}
+
+	var h, l uint64
+	for i := 0; i < len(digits); i++ {
+		h, l = mul10add(h, l, uint64(digits[i]-'0'))
+	}
+
+	h |= uint64(exp+decimalExpBias) << 49
+	if neg {
+		h |= decimalSignBit
+	}
+	return Decimal128{h, l}, nil
+}
+
+// decimal128FromInt64 returns the decimal with integer value n.
+func decimal128FromInt64(n int64) Decimal128 {
+	neg := n < 0
+	u := uint64(n)
+	if neg {
+		u = uint64(-n)
+	}
+	h := uint64(decimalExpBias) << 49
+	if neg {
+		h |= decimalSignBit
+	}
+	return Decimal128{h, u}
+}
+
+// ParseDecimal128 parses the decimal string s. The accepted syntax is an
+// optional sign followed by digits with an optional decimal point and an
+// optional exponent, or one of the special values "NaN", "Inf" and "Infinity"
+// (case insensitive). An error is returned if the value cannot be represented
+// exactly.
+func ParseDecimal128(s string) (Decimal128, os.Error) {
+	orig := s
+	neg := false
+	if s != "" && (s[0] == '+' || s[0] == '-') {
+		neg = s[0] == '-'
+		s = s[1:]
+	}
+
+	switch strings.ToLower(s) {
+	case "nan":
+		return Decimal128{decimalNaNBits, 0}, nil
+	case "inf", "infinity":
+		if neg {
+			return Decimal128{decimalInfBits | decimalSignBit, 0}, nil
+		}
+		return Decimal128{decimalInfBits, 0}, nil
+	}
+
+	mantissa := s
+	exp := 0
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		mantissa = s[:i]
+		e := s[i+1:]
+		if e != "" && e[0] == '+' {
+			e = e[1:]
+			if e != "" && e[0] == '-' {
+				return Decimal128{}, errDecimalSyntax
+			}
+		}
+		var err os.Error
+		exp, err = strconv.Atoi(e)
+		if err != nil || e == "" {
+			return Decimal128{}, errDecimalSyntax
+		}
+	}
+
+	digits := mantissa
+	if i := strings.Index(mantissa, "."); i >= 0 {
+		digits = mantissa[:i] + mantissa[i+1:]
+		exp -= len(mantissa) - i - 1
+	}
+	if digits == "" {
+		return Decimal128{}, errDecimalSyntax
+	}
+	for i := 0; i < len(digits); i++ {
+		if digits[i] < '0' || digits[i] > '9' {
+			return Decimal128{}, errDecimalSyntax
+		}
+	}
+
+	d, err := newDecimal128(neg, digits, exp)
+	if err != nil {
+		return Decimal128{}, os.NewError(err.String() + ": " + strconv.Quote(orig))
+	}
+	return d, nil
+}
+
+// NewDecimal128BigInt returns the decimal with value coefficient *
+// 10^exponent. An error is returned if the value cannot be represented
+// exactly.
+func NewDecimal128BigInt(coefficient *big.Int, exponent int) (Decimal128, os.Error) {
+	s := coefficient.String()
+	neg := false
+	if s[0] == '-' {
+		neg = true
+		s = s[1:]
+	}
+	return newDecimal128(neg, s, exponent)
+}
+
+// BigInt returns the coefficient and exponent of d. The value of d is
+// coefficient * 10^exponent. An error is returned if d is NaN or infinite.
+func (d Decimal128) BigInt() (coefficient *big.Int, exponent int, err os.Error) {
+	if d.IsNaN() || d.IsInf() != 0 {
+		return nil, 0, errDecimalSpecial
+	}
+	neg, h, l, exp := d.decompose()
+	coefficient = new(big.Int).Lsh(new(big.Int).SetInt64(int64(h)), 64)
+	coefficient.Add(coefficient, new(big.Int).SetBytes([]byte{
+		byte(l >> 56), byte(l >> 48), byte(l >> 40), byte(l >> 32),
+		byte(l >> 24), byte(l >> 16), byte(l >> 8), byte(l)}))
+	if neg {
+		coefficient.Neg(coefficient)
+	}
+	return coefficient, exp, nil
+}
+
+// pow10 returns 10^n as a big.Int.
+func pow10(n int) *big.Int {
+	result := big.NewInt(1)
+	base := big.NewInt(10)
+	for n > 0 {
+		if n&1 != 0 {
+			result.Mul(result, base)
+		}
+		base.Mul(base, base)
+		n >>= 1
+	}
+	return result
+}
+
+// Rat returns the exact value of d as a big.Rat. An error is returned if d is
+// NaN or infinite.
+func (d Decimal128) Rat() (*big.Rat, os.Error) {
+	coefficient, exp, err := d.BigInt()
+	if err != nil {
+		return nil, err
+	}
+	if exp >= 0 {
+		return new(big.Rat).SetInt(coefficient.Mul(coefficient, pow10(exp))), nil
+	}
+	return new(big.Rat).SetFrac(coefficient, pow10(-exp)), nil
+}
+
+// NewDecimal128Rat returns the decimal with the value of r. An error is
+// returned if r does not have a finite decimal representation or if the value
+// cannot be represented exactly.
+func NewDecimal128Rat(r *big.Rat) (Decimal128, os.Error) {
+	num := r.Num()
+	denom := r.Denom()
+
+	// The denominator has a finite decimal expansion only if its prime
+	// factors are 2 and 5. Find the power of 10 that it divides.
+	zero := big.NewInt(0)
+	two := big.NewInt(2)
+	five := big.NewInt(5)
+	rem := new(big.Int)
+	d := new(big.Int).Set(denom)
+	twos, fives := 0, 0
+	for {
+		q, m := new(big.Int).QuoRem(d, two, rem)
+		if m.Cmp(zero) != 0 {
+			break
+		}
+		d = q
+		twos += 1
+	}
+	for {
+		q, m := new(big.Int).QuoRem(d, five, rem)
+		if m.Cmp(zero) != 0 {
+			break
+		}
+		d = q
+		fives += 1
+	}
+	if d.Cmp(big.NewInt(1)) != 0 {
+		return Decimal128{}, errDecimalNotExact
+	}
+
+	n := twos
+	if fives > n {
+		n = fives
+	}
+	scale := new(big.Int).Quo(pow10(n), denom)
+	return NewDecimal128BigInt(new(big.Int).Mul(num, scale), -n)
+}
@@ -19,10 +19,15 @@ import (
 	"math"
 	"os"
 	"reflect"
+	"strings"
+	"sync"
+	"time"
 )
 
 var ErrEOD = os.NewError("bson: unexpected end of data when parsing BSON")
 
+var typeUnmarshaler = reflect.TypeOf(new(Unmarshaler)).Elem()
+
 // DecodeConvertError is returned when decoder cannot convert BSON value to the
 // target type.
 type DecodeConvertError struct {
@@ -44,39 +49,239 @@ func (e *DecodeTypeError) String() string {
 	return "bson: could not decode " + kindName(e.kind)
 }
 
+// DecodeRequiredError is returned when a struct field with the required option
+// is missing from the document.
+type DecodeRequiredError struct {
+	t    reflect.Type
+	name string
+}
+
+func (e *DecodeRequiredError) String() string {
+	return "bson: required field " + e.name + " missing when decoding " + e.t.String()
+}
+
+// DecodeUnknownFieldError is returned by a decoder with the
+// DisallowUnknownFields option when a document element does not match a
+// struct field.
+type DecodeUnknownFieldError struct {
+	t    reflect.Type
+	name string
+}
+
+func (e *DecodeUnknownFieldError) String() string {
+	return "bson: unknown field " + e.name + " when decoding " + e.t.String()
+}
+
+// DecodeFieldError is returned by a decoder created with
+// NewDecoderWithOptions. The error records the dotted path of the value that
+// could not be decoded.
+type DecodeFieldError struct {
+	Path  string
+	Error os.Error
+}
+
+func (e *DecodeFieldError) String() string {
+	if e.Path == "" {
+		return e.Error.String()
+	}
+	return e.Error.String() + " at " + e.Path
+}
+
+// DecodeErrors is returned by a decoder with the CollectAllErrors option.
+// Each error is a *DecodeFieldError.
+type DecodeErrors []os.Error
+
+func (errs DecodeErrors) String() string {
+	s := make([]string, len(errs))
+	for i, err := range errs {
+		s[i] = err.String()
+	}
+	return strings.Join(s, "; ")
+}
+
 // Deocde decodes BSON data to value v.
 //
 // Decode traverses the value v recursively. Decode uese the inverse of the
 // encodings supported by Encode, allocating maps, slices and pointers as
-// needed. The following conversions from BSON types to GO types are supported:
+// needed. If a value implements the Unmarshaler interface, then Decode calls
+// its UnmarshalBSON method with the BSON value. Otherwise, the following
+// conversions from BSON types to GO types are supported:
 //
 //      BSON                -> Go
-//      Integer32           -> signed and unsigned integers, floats, bool
-//      Integer64           -> signed and unsigned integers, floats, bool
-//      Array               -> []interface{}, other slice types
-//      Binary              -> []byte
+//      Integer32           -> signed and unsigned integers, floats, bool, mongo.Decimal128
+//      Integer64           -> signed and unsigned integers, floats, bool, mongo.Decimal128
+//      Array               -> []interface{}, other slice types, mongo.Raw
+//      Binary              -> []byte, mongo.Binary
 //      Boolean             -> bool
-//      Datetime            -> mongo.Datetime, int64
-//      Document            -> map[string]interface{}, struct types
+//      Code                -> mongo.Code, string
+//      CodeWithScope       -> mongo.CodeWithScope
+//      Datetime            -> mongo.Datetime, int64, time.Time
+//      DBPointer           -> mongo.DBPointer
+//      Decimal128          -> mongo.Decimal128
+//      Document            -> map[string]interface{}, struct types, mongo.Raw
 //      Double              -> signed and unsigned integers, floats, bool
 //      MinValue, MaxValue  -> mongo.MinMax
 //      ObjectID            -> mongo.ObjectId
+//      Regexp              -> mongo.Regexp
 //      Symbol              -> mongo.Symbol, string
 //      Timestamp           -> mongo.Timestamp, int64
+//      Undefined           -> mongo.Undefined
 //      string              -> string
 //
+// The deprecated kinds Undefined, DBPointer and Symbol can be converted to
+// null, a DBRef document and string with the ConvertLegacyKinds decode
+// option.
+//
 // If a number overflows the target type or the BSON value cannot be converted
-// to the target type, then the decoding completes the best it can and an error
-// is returned.
+// to the target type, then the decoding completes the best it can and the
+// first error is returned. Use a decoder created with NewDecoderWithOptions to
+// report lossy conversions, unknown fields and all errors with the path of
+// each value.
 //
 // To decode a BSON value into a nil interface value, the first type listed in
-// the right hand column of the table above is used.
+// the right hand column of the table above is used. The exception is binary
+// data with a subtype other than generic (0); that data is decoded to
+// mongo.Binary so that the subtype is preserved.
 func Decode(data []byte, v interface{}) (err os.Error) {
-	return decodeInternal(kindDocument, data, v)
+	return decodeInternal(defaultDecoder, kindDocument, data, v)
+}
+
+// DecodeFunc decodes the BSON value bd to v. The value v is settable.
+type DecodeFunc func(bd BSONData, v reflect.Value) os.Error
+
+// Decoder holds the configuration for decoding BSON to Go values. Use
+// NewDecoder to create a decoder and the RegisterType and RegisterKind methods
+// to add decodings for types that the application does not own. A decoder
+// must not be modified while it is used to decode values.
+//
+// A decoder compiles the decoding of each struct type once and reuses its
+// decode state across calls. A decoder can be used by multiple goroutines
+// concurrently.
+type Decoder struct {
+	typeDecoder map[reflect.Type]decoderFunc
+	kindDecoder map[reflect.Kind]decoderFunc
+	registered  map[reflect.Type]bool
+
+	planMutex      sync.RWMutex
+	structDecoders map[reflect.Type]*structDecoder
+
+	// free is a list of decode states for reuse by Decode.
+	free chan *decodeState
+
+	options *DecodeOptions
+}
+
+// DecodeOptions specifies options for the NewDecoderWithOptions function.
+type DecodeOptions struct {
+	// If Strict is true, then conversions that change a value are errors.
+	// Examples are decoding a double with a fraction to an integer, an
+	// integer to a double that cannot represent the integer exactly, a
+	// negative integer to an unsigned integer and a number other than 0 or 1
+	// to a bool. Array elements that do not fit in a Go array are also
+	// errors.
+	Strict bool
+
+	// If DisallowUnknownFields is true, then document elements that do not
+	// match a struct field are errors. Elements stored in an inline map or D
+	// are not unknown.
+	DisallowUnknownFields bool
+
+	// If ConvertLegacyKinds is true, then the deprecated BSON kinds are
+	// converted before decoding: undefined to null, DBPointer to a DBRef
+	// document and symbol to string. The namespace of a DBPointer is stored in
+	// the $ref element of the DBRef.
+	ConvertLegacyKinds bool
+
+	// If CollectAllErrors is true, then decoding continues after errors and
+	// Decode returns all errors in a DecodeErrors. Otherwise, Decode returns
+	// the first error. Errors in the structure of the BSON data always stop
+	// decoding.
+	CollectAllErrors bool
+}
+
+// defaultDecoder is the decoder used by the Decode function.
+var defaultDecoder *Decoder
+
+// NewDecoder returns a new decoder with the conversions described in the
+// documentation for the Decode function.
+func NewDecoder() *Decoder {
+	dec := newDecoder(make(map[reflect.Type]decoderFunc), make(map[reflect.Kind]decoderFunc))
+	for t, f := range defaultDecoder.typeDecoder {
+		dec.typeDecoder[t] = f
+	}
+	for k, f := range defaultDecoder.kindDecoder {
+		dec.kindDecoder[k] = f
+	}
+	return dec
+}
+
+// NewDecoderWithOptions returns a new decoder with the conversions described
+// in the documentation for the Decode function and the specified options.
+// Decoding errors returned by the decoder are *DecodeFieldError values or a
+// DecodeErrors if the CollectAllErrors option is set.
+func NewDecoderWithOptions(options *DecodeOptions) *Decoder {
+	dec := NewDecoder()
+	if options != nil {
+		o := *options
+		dec.options = &o
+	}
+	return dec
+}
+
+func newDecoder(typeDecoder map[reflect.Type]decoderFunc, kindDecoder map[reflect.Kind]decoderFunc) *Decoder {
+	return &Decoder{
+		typeDecoder:    typeDecoder,
+		kindDecoder:    kindDecoder,
+		registered:     make(map[reflect.Type]bool),
+		structDecoders: make(map[reflect.Type]*structDecoder),
+		free:           make(chan *decodeState, maxFreeBuffers),
+	}
+}
+
+func (f DecodeFunc) decoderFunc() decoderFunc {
+	return func(d *decodeState, kind int, v reflect.Value) {
+		if err := f(d.scanBSONData(kind), v); err != nil {
+			d.saveError(err)
+		}
+	}
+}
+
+// RegisterType sets the decoding for values of type t to f. The type can be a
+// pointer type. The decoding for a type takes precedence over the
+// Unmarshaler interface and the decoding for the kind of the type.
+func (dec *Decoder) RegisterType(t reflect.Type, f DecodeFunc) {
+	// Use the general slice decoding so that the elements are decoded with f.
+	for _, st := range fastSlicesFor(dec.registered, func(et reflect.Type) bool { return et == t }) {
+		dec.typeDecoder[st] = decodeSlice
+	}
+	dec.typeDecoder[t] = f.decoderFunc()
+	dec.registered[t] = true
+	dec.resetPlans()
+}
+
+// RegisterKind sets the decoding for values of kind k to f. The decoding is
+// used for values that do not have a decoding registered by type and do not
+// implement the Unmarshaler interface.
+func (dec *Decoder) RegisterKind(k reflect.Kind, f DecodeFunc) {
+	match := func(et reflect.Type) bool {
+		_, ok := dec.typeDecoder[et]
+		return et.Kind() == k && !ok
+	}
+	for _, st := range fastSlicesFor(dec.registered, match) {
+		dec.typeDecoder[st] = decodeSlice
+	}
+	dec.kindDecoder[k] = f.decoderFunc()
+	dec.resetPlans()
+}
+
+// Decode decodes BSON data to value v using the conversions configured in
+// dec. See the Decode function for more information about BSON decoding.
+func (dec *Decoder) Decode(data []byte, v interface{}) os.Error {
+	return decodeInternal(dec, kindDocument, data, v)
 }
 
 // decodeInternal decodes BSON data with given kind to v.
-func decodeInternal(kind int, data []byte, v interface{}) (err os.Error) {
+func decodeInternal(dec *Decoder, kind int, data []byte, v interface{}) (err os.Error) {
 	defer handleAbort(&err)
 	value, ok := v.(reflect.Value)
 	if !ok {
@@ -96,9 +301,118 @@ func decodeInternal(kind int, data []byte, v interface{}) (err os.Error) {
 		}
 	}
 
-	d := decodeState{data: data}
+	if dec.options != nil && dec.options.ConvertLegacyKinds {
+		kind, data = convertLegacyKinds(kind, data)
+	}
+
+	d := dec.newState(data)
 	d.decodeValue(kind, value)
-	return d.savedError
+	if d.errors != nil {
+		err = d.errors
+	} else {
+		err = d.savedError
+	}
+	dec.freeState(d)
+	return err
+}
+
+// convertLegacyKinds returns the BSON value with the deprecated kinds replaced
+// by their modern equivalents. The data is returned unchanged if the value
+// does not contain deprecated kinds.
+func convertLegacyKinds(kind int, data []byte) (int, []byte) {
+	d := decodeState{data: data}
+	if !d.hasLegacyKinds(kind) {
+		return kind, data
+	}
+	e := encodeState{enc: defaultEncoder}
+	d.offset = 0
+	kind = e.writeConverted(kind, &d)
+	return kind, e.buffer
+}
+
+func (d *decodeState) hasLegacyKinds(kind int) bool {
+	switch kind {
+	case kindUndefined, kindDBPointer, kindSymbol:
+		return true
+	case kindDocument, kindArray:
+		offset := d.beginDoc()
+		for {
+			kind, _ := d.scanKindName()
+			if kind == 0 {
+				break
+			}
+			if d.hasLegacyKinds(kind) {
+				return true
+			}
+		}
+		d.endDoc(offset)
+		return false
+	}
+	d.skipValue(kind)
+	return false
+}
+
+// writeConverted writes the value at the current offset in d with the
+// deprecated kinds replaced and returns the kind of the written value.
+func (e *encodeState) writeConverted(kind int, d *decodeState) int {
+	switch kind {
+	case kindUndefined:
+		return kindNull
+	case kindSymbol:
+		kind = kindString
+	case kindDBPointer:
+		p := d.scanDBPointer()
+		e.writeD(D{{"$ref", p.Namespace}, {"$id", p.Id}})
+		return kindDocument
+	case kindDocument, kindArray:
+		doffset := d.beginDoc()
+		offset := e.beginDoc()
+		for {
+			kind, name := d.scanKindName()
+			if kind == 0 {
+				break
+			}
+			kindOffset := len(e.buffer)
+			e.writeKindName(kind, string(name))
+			e.buffer[kindOffset] = byte(e.writeConverted(kind, d))
+		}
+		e.WriteByte(0)
+		e.endDoc(offset)
+		d.endDoc(doffset)
+		return kind
+	}
+	start := d.offset
+	d.skipValue(kind)
+	e.Write(d.data[start:d.offset])
+	return kind
+}
+
+// newState returns a decode state for data, reusing a free state if
+// available.
+func (dec *Decoder) newState(data []byte) *decodeState {
+	var d *decodeState
+	select {
+	case d = <-dec.free:
+	default:
+		d = new(decodeState)
+	}
+	*d = decodeState{data: data, dec: dec, path: d.path[:0]}
+	if o := dec.options; o != nil {
+		d.paths = true
+		d.strict = o.Strict
+		d.disallowUnknown = o.DisallowUnknownFields
+		d.collect = o.CollectAllErrors
+	}
+	return d
+}
+
+func (dec *Decoder) freeState(d *decodeState) {
+	d.data = nil
+	select {
+	case dec.free <- d:
+	default:
+		// The list is full.
+	}
 }
 
 // decodeState represents the state while decoding a JSON value.
@@ -106,11 +420,28 @@ type decodeState struct {
 	data       []byte
 	offset     int // read offset in data
 	savedError os.Error
+	dec        *Decoder
+
+	// Options from the decoder.
+	paths           bool
+	strict          bool
+	disallowUnknown bool
+	collect         bool
+
+	path   []string     // element names when paths is true
+	errors DecodeErrors // all errors when collect is true
 }
 
 // saveError saves the first err it is called with, for reporting at the end of
 // Decode.
 func (d *decodeState) saveError(err os.Error) {
+	if d.paths {
+		err = &DecodeFieldError{Path: strings.Join(d.path, "."), Error: err}
+		if d.collect {
+			d.errors = append(d.errors, err)
+			return
+		}
+	}
 	if d.savedError == nil {
 		d.savedError = err
 	}
@@ -119,11 +450,33 @@ func (d *decodeState) saveError(err os.Error) {
 // saveErrorAndSkip skips the value and saves a conversion error.
 func (d *decodeState) saveErrorAndSkip(kind int, t reflect.Type) {
 	d.skipValue(kind)
-	if d.savedError == nil {
-		d.savedError = &DecodeConvertError{kind, t}
+	d.saveError(&DecodeConvertError{kind, t})
+}
+
+// pushName adds an element name to the path.
+func (d *decodeState) pushName(name string) {
+	if d.paths {
+		d.path = append(d.path, name)
 	}
 }
 
+func (d *decodeState) popName() {
+	if d.paths {
+		d.path = d.path[:len(d.path)-1]
+	}
+}
+
+// decodeElement decodes the value of the element with the given name to v.
+func (d *decodeState) decodeElement(name []byte, kind int, v reflect.Value) {
+	if d.paths {
+		d.pushName(string(name))
+		d.decodeValue(kind, v)
+		d.popName()
+		return
+	}
+	d.decodeValue(kind, v)
+}
+
 func (d *decodeState) beginDoc() int {
 	offset := d.offset
 	offset += int(wire.Uint32(d.scanSlice(4)))
@@ -137,10 +490,10 @@ func (d *decodeState) endDoc(offset int) {
 }
 
 func (d *decodeState) scanSlice(n int) []byte {
-	offset := d.offset + n
-	if offset > len(d.data) {
+	if n < 0 || n > len(d.data)-d.offset {
 		abort(ErrEOD)
 	}
+	offset := d.offset + n
 	p := d.data[d.offset:offset]
 	d.offset = offset
 	return p
@@ -160,6 +513,16 @@ func (d *decodeState) scanKindName() (int, []byte) {
 	return kind, p
 }
 
+func (d *decodeState) scanCString() string {
+	n := bytes.IndexByte(d.data[d.offset:], 0)
+	if n < 0 {
+		abort(ErrEOD)
+	}
+	s := string(d.data[d.offset : d.offset+n])
+	d.offset = d.offset + n + 1
+	return s
+}
+
 func (d *decodeState) scanFloat() float64 {
 	return math.Float64frombits(wire.Uint64(d.scanSlice(8)))
 }
@@ -167,14 +530,46 @@ func (d *decodeState) scanFloat() float64 {
 func (d *decodeState) scanString() string {
 	n := int(wire.Uint32(d.scanSlice(4)))
 	s := string(d.scanSlice(n - 1))
-	d.offset += 1 // skip null terminator
+	d.scanSlice(1) // skip null terminator
 	return s
 }
 
 func (d *decodeState) scanBinary() ([]byte, int) {
 	n := int(wire.Uint32(d.scanSlice(4)))
 	subtype := int(d.scanSlice(1)[0])
-	return d.scanSlice(n), subtype
+	p := d.scanSlice(n)
+	if subtype == binaryOld {
+		// The old binary subtype wraps the data with a second length.
+		if len(p) < 4 || int(wire.Uint32(p)) != len(p)-4 {
+			abort(os.NewError("bson: bad old binary length"))
+		}
+		p = p[4:]
+	}
+	return p, subtype
+}
+
+func (d *decodeState) scanRegexp() Regexp {
+	pattern := d.scanCString()
+	options := d.scanCString()
+	return Regexp{Pattern: pattern, Options: options}
+}
+
+func (d *decodeState) scanCodeWithScope() CodeWithScope {
+	offset := d.beginDoc()
+	code := d.scanString()
+	var scope map[string]interface{}
+	if m := d.decodeValueInterface(kindDocument).(map[string]interface{}); len(m) > 0 {
+		// An empty scope decodes to nil so that values encoded with a nil
+		// scope survive a round trip.
+		scope = m
+	}
+	d.endDoc(offset)
+	return CodeWithScope{Code: code, Scope: scope}
+}
+
+func (d *decodeState) scanDBPointer() DBPointer {
+	namespace := d.scanString()
+	return DBPointer{Namespace: namespace, Id: ObjectId(d.scanObjectId())}
 }
 
 func (d *decodeState) scanObjectId() []byte {
@@ -197,12 +592,24 @@ func (d *decodeState) scanInt64() int64 {
 	return int64(wire.Uint64(d.scanSlice(8)))
 }
 
+func (d *decodeState) scanDecimal128() Decimal128 {
+	l := uint64(d.scanInt64())
+	h := uint64(d.scanInt64())
+	return Decimal128{h, l}
+}
+
 func (d *decodeState) decodeValue(kind int, v reflect.Value) {
-	v = d.indirect(v)
+	u, v := d.indirect(v)
+	if u != nil {
+		if err := u.UnmarshalBSON(d.scanBSONData(kind)); err != nil {
+			d.saveError(err)
+		}
+		return
+	}
 	t := v.Type()
-	decoder, ok := typeDecoder[t]
+	decoder, ok := d.dec.typeDecoder[t]
 	if !ok {
-		decoder, ok = kindDecoder[t.Kind()]
+		decoder, ok = d.dec.kindDecoder[t.Kind()]
 		if !ok {
 			d.saveErrorAndSkip(kind, v.Type())
 			return
@@ -212,14 +619,24 @@ func (d *decodeState) decodeValue(kind int, v reflect.Value) {
 }
 
 // indirect walks down v allocating pointers as needed, until it gets to a
-// non-pointer.  
-func (d *decodeState) indirect(v reflect.Value) reflect.Value {
+// non-pointer or a type with a registered decoding. If it encounters an
+// Unmarshaler, indirect stops and returns that.
+func (d *decodeState) indirect(v reflect.Value) (Unmarshaler, reflect.Value) {
 	for {
+		if _, ok := d.dec.typeDecoder[v.Type()]; ok {
+			break
+		}
 		//if v.Kind() == reflect.Interface && !v.IsNil() {
 		//		v = v.Elem()
 		//		continue
 		//}
 		if v.Kind() != reflect.Ptr {
+			if v.Kind() != reflect.Interface && v.Type().Implements(typeUnmarshaler) {
+				return v.Interface().(Unmarshaler), reflect.Value{}
+			}
+			if v.CanAddr() && v.Addr().Type().Implements(typeUnmarshaler) {
+				return v.Addr().Interface().(Unmarshaler), reflect.Value{}
+			}
 			break
 		}
 		if v.IsNil() {
@@ -227,7 +644,7 @@ func (d *decodeState) indirect(v reflect.Value) reflect.Value {
 		}
 		v = v.Elem()
 	}
-	return v
+	return nil, v
 }
 
 func decodeFloat(d *decodeState, kind int, v reflect.Value) {
@@ -239,7 +656,12 @@ func decodeFloat(d *decodeState, kind int, v reflect.Value) {
 	case kindFloat:
 		f = d.scanFloat()
 	case kindInt64:
-		f = float64(d.scanInt64())
+		n := d.scanInt64()
+		f = float64(n)
+		if d.strict && (f >= 1<<63 || int64(f) != n) {
+			d.saveError(&DecodeConvertError{kind, v.Type()})
+			return
+		}
 	case kindInt32:
 		f = float64(d.scanInt32())
 	}
@@ -247,6 +669,10 @@ func decodeFloat(d *decodeState, kind int, v reflect.Value) {
 		d.saveError(&DecodeConvertError{kind, v.Type()})
 		return
 	}
+	if d.strict && v.Kind() == reflect.Float32 && float64(float32(f)) != f && !math.IsNaN(f) {
+		d.saveError(&DecodeConvertError{kind, v.Type()})
+		return
+	}
 	v.SetFloat(f)
 }
 
@@ -261,7 +687,12 @@ func decodeInt(d *decodeState, kind int, v reflect.Value) {
 	case kindInt32:
 		n = int64(d.scanInt32())
 	case kindFloat:
-		n = int64(d.scanFloat())
+		f := d.scanFloat()
+		n = int64(f)
+		if d.strict && (f >= 1<<63 || float64(n) != f) {
+			d.saveError(&DecodeConvertError{kind, v.Type()})
+			return
+		}
 	}
 	if v.OverflowInt(n) {
 		d.saveError(&DecodeConvertError{kind, v.Type()})
@@ -272,16 +703,27 @@ func decodeInt(d *decodeState, kind int, v reflect.Value) {
 
 func decodeUint(d *decodeState, kind int, v reflect.Value) {
 	var n uint64
+	lossy := false
 	switch kind {
 	default:
 		d.saveErrorAndSkip(kind, v.Type())
 		return
 	case kindInt64, kindTimestamp, kindDateTime:
-		n = uint64(d.scanInt64())
+		i := d.scanInt64()
+		n = uint64(i)
+		lossy = i < 0 && kind == kindInt64
 	case kindInt32:
-		n = uint64(d.scanInt32())
+		i := d.scanInt32()
+		n = uint64(i)
+		lossy = i < 0
 	case kindFloat:
-		n = uint64(d.scanFloat())
+		f := d.scanFloat()
+		n = uint64(f)
+		lossy = f < 0 || f >= 1<<64 || float64(n) != f
+	}
+	if d.strict && lossy {
+		d.saveError(&DecodeConvertError{kind, v.Type()})
+		return
 	}
 	if v.OverflowUint(n) {
 		d.saveError(&DecodeConvertError{kind, v.Type()})
@@ -310,6 +752,31 @@ func decodeDateTime(d *decodeState, kind int, v reflect.Value) {
 	}
 }
 
+func decodeDecimal128(d *decodeState, kind int, v reflect.Value) {
+	var n int64
+	switch kind {
+	default:
+		d.saveErrorAndSkip(kind, v.Type())
+		return
+	case kindDecimal128:
+		v.Set(reflect.ValueOf(d.scanDecimal128()))
+		return
+	case kindInt64:
+		n = d.scanInt64()
+	case kindInt32:
+		n = int64(d.scanInt32())
+	}
+	v.Set(reflect.ValueOf(decimal128FromInt64(n)))
+}
+
+func decodeTime(d *decodeState, kind int, v reflect.Value) {
+	if kind != kindDateTime {
+		d.saveErrorAndSkip(kind, v.Type())
+		return
+	}
+	v.Set(reflect.ValueOf(*DateTime(d.scanInt64()).Time()))
+}
+
 func decodeString(d *decodeState, kind int, v reflect.Value) {
 	var s string
 	switch kind {
@@ -334,12 +801,60 @@ func decodeObjectId(d *decodeState, kind int, v reflect.Value) {
 	v.SetString(string(p))
 }
 
-func decodeBSONData(d *decodeState, kind int, v reflect.Value) {
+func decodeUndefined(d *decodeState, kind int, v reflect.Value) {
+	if kind != kindUndefined {
+		d.saveErrorAndSkip(kind, v.Type())
+	}
+}
+
+func decodeDBPointer(d *decodeState, kind int, v reflect.Value) {
+	if kind != kindDBPointer {
+		d.saveErrorAndSkip(kind, v.Type())
+		return
+	}
+	v.Set(reflect.ValueOf(d.scanDBPointer()))
+}
+
+func decodeRegexp(d *decodeState, kind int, v reflect.Value) {
+	if kind != kindRegexp {
+		d.saveErrorAndSkip(kind, v.Type())
+		return
+	}
+	v.Set(reflect.ValueOf(d.scanRegexp()))
+}
+
+func decodeCodeWithScope(d *decodeState, kind int, v reflect.Value) {
+	var c CodeWithScope
+	switch kind {
+	default:
+		d.saveErrorAndSkip(kind, v.Type())
+		return
+	case kindCode:
+		c.Code = d.scanString()
+	case kindCodeWithScope:
+		c = d.scanCodeWithScope()
+	}
+	v.Set(reflect.ValueOf(c))
+}
+
+func (d *decodeState) scanBSONData(kind int) BSONData {
 	start := d.offset
 	d.skipValue(kind)
 	bd := BSONData{Kind: kind, Data: make([]byte, d.offset-start)}
 	copy(bd.Data, d.data[start:d.offset])
-	v.Set(reflect.ValueOf(bd))
+	return bd
+}
+
+func decodeBSONData(d *decodeState, kind int, v reflect.Value) {
+	v.Set(reflect.ValueOf(d.scanBSONData(kind)))
+}
+
+func decodeRaw(d *decodeState, kind int, v reflect.Value) {
+	if kind != kindDocument {
+		d.saveErrorAndSkip(kind, v.Type())
+		return
+	}
+	v.Set(reflect.ValueOf(Raw(d.scanBSONData(kind).Data)))
 }
 
 func decodeByteSlice(d *decodeState, kind int, v reflect.Value) {
@@ -359,6 +874,17 @@ func decodeByteSlice(d *decodeState, kind int, v reflect.Value) {
 	reflect.Copy(v, reflect.ValueOf(p))
 }
 
+func decodeBinary(d *decodeState, kind int, v reflect.Value) {
+	if kind != kindBinary {
+		d.saveErrorAndSkip(kind, v.Type())
+		return
+	}
+	p, subtype := d.scanBinary()
+	b := Binary{Subtype: byte(subtype), Data: make([]byte, len(p))}
+	copy(b.Data, p)
+	v.Set(reflect.ValueOf(b))
+}
+
 func decodeBool(d *decodeState, kind int, v reflect.Value) {
 	var b bool
 	switch kind {
@@ -367,12 +893,21 @@ func decodeBool(d *decodeState, kind int, v reflect.Value) {
 		return
 	case kindBool:
 		b = d.scanBool()
-	case kindInt32:
-		b = d.scanInt32() != 0
-	case kindInt64:
-		b = d.scanInt64() != 0
-	case kindFloat:
-		b = d.scanFloat() != 0
+	case kindInt32, kindInt64, kindFloat:
+		var f float64
+		switch kind {
+		case kindInt32:
+			f = float64(d.scanInt32())
+		case kindInt64:
+			f = float64(d.scanInt64())
+		case kindFloat:
+			f = d.scanFloat()
+		}
+		if d.strict && f != 0 && f != 1 {
+			d.saveError(&DecodeConvertError{kind, v.Type()})
+			return
+		}
+		b = f != 0
 	}
 	v.SetBool(b)
 }
@@ -394,6 +929,7 @@ func decodeMinMax(d *decodeState, kind int, v reflect.Value) {
 func decodeMapStringInterface(d *decodeState, kind int, v reflect.Value) {
 	if kind != kindDocument {
 		d.saveErrorAndSkip(kind, v.Type())
+		return
 	}
 	if v.IsNil() {
 		v.Set(reflect.MakeMap(v.Type()))
@@ -441,7 +977,7 @@ func decodeMap(d *decodeState, kind int, v reflect.Value) {
 			continue
 		}
 		subv.Set(reflect.Zero(t.Elem()))
-		d.decodeValue(kind, subv)
+		d.decodeElement(name, kind, subv)
 		v.SetMapIndex(reflect.ValueOf(string(name)), subv)
 	}
 	d.endDoc(offset)
@@ -456,7 +992,7 @@ func decodeSlice(d *decodeState, kind int, v reflect.Value) {
 	offset := d.beginDoc()
 	i := 0
 	for {
-		kind, _ := d.scanKindName()
+		kind, name := d.scanKindName()
 		if kind == 0 {
 			break
 		}
@@ -472,55 +1008,178 @@ func decodeSlice(d *decodeState, kind int, v reflect.Value) {
 		if i >= v.Len() {
 			v.SetLen(i + 1)
 		}
-		d.decodeValue(kind, v.Index(i))
+		d.decodeElement(name, kind, v.Index(i))
 		i += 1
 	}
 	d.endDoc(offset)
 }
 
-func decodeArray(d *decodeState, kind int, v reflect.Value) {
+// The fast slice decoders handle the common element kinds directly and use
+// the general decoding for other kinds. As with decodeSlice, elements of the
+// existing slice are overwritten.
+
+func decodeFloat64Slice(d *decodeState, kind int, v reflect.Value) {
 	if kind != kindArray {
 		d.saveErrorAndSkip(kind, v.Type())
 		return
 	}
+	s := v.Interface().([]float64)
 	offset := d.beginDoc()
-	i := 0
-	for {
-		kind, _ := d.scanKindName()
+	for i := 0; ; i++ {
+		kind, name := d.scanKindName()
+		if kind == 0 {
+			break
+		}
+		if i >= len(s) {
+			s = append(s, 0)
+		}
+		switch kind {
+		case kindFloat:
+			s[i] = d.scanFloat()
+		case kindInt32:
+			s[i] = float64(d.scanInt32())
+		default:
+			d.decodeElement(name, kind, reflect.ValueOf(s).Index(i))
+		}
+	}
+	d.endDoc(offset)
+	v.Set(reflect.ValueOf(s))
+}
+
+func decodeInt32Slice(d *decodeState, kind int, v reflect.Value) {
+	if kind != kindArray {
+		d.saveErrorAndSkip(kind, v.Type())
+		return
+	}
+	s := v.Interface().([]int32)
+	offset := d.beginDoc()
+	for i := 0; ; i++ {
+		kind, name := d.scanKindName()
 		if kind == 0 {
 			break
 		}
-		if i < v.Len() {
-			d.decodeValue(kind, v.Index(i))
+		if i >= len(s) {
+			s = append(s, 0)
+		}
+		if kind == kindInt32 {
+			s[i] = d.scanInt32()
 		} else {
-			d.skipValue(kind)
+			d.decodeElement(name, kind, reflect.ValueOf(s).Index(i))
 		}
-		i += 1
 	}
 	d.endDoc(offset)
+	v.Set(reflect.ValueOf(s))
 }
 
-func decodeStruct(d *decodeState, kind int, v reflect.Value) {
-	t := v.Type()
-	si := structInfoForType(t)
+func decodeInt64Slice(d *decodeState, kind int, v reflect.Value) {
+	if kind != kindArray {
+		d.saveErrorAndSkip(kind, v.Type())
+		return
+	}
+	s := v.Interface().([]int64)
 	offset := d.beginDoc()
-	for {
+	for i := 0; ; i++ {
 		kind, name := d.scanKindName()
 		if kind == 0 {
 			break
 		}
-		if kind == kindNull {
-			continue
+		if i >= len(s) {
+			s = append(s, 0)
 		}
-		if fi := si.FieldInfo(name); fi != nil {
-			d.decodeValue(kind, v.FieldByIndex(fi.index))
+		switch kind {
+		case kindInt64:
+			s[i] = d.scanInt64()
+		case kindInt32:
+			s[i] = int64(d.scanInt32())
+		default:
+			d.decodeElement(name, kind, reflect.ValueOf(s).Index(i))
+		}
+	}
+	d.endDoc(offset)
+	v.Set(reflect.ValueOf(s))
+}
+
+func decodeStringSlice(d *decodeState, kind int, v reflect.Value) {
+	if kind != kindArray {
+		d.saveErrorAndSkip(kind, v.Type())
+		return
+	}
+	s := v.Interface().([]string)
+	offset := d.beginDoc()
+	for i := 0; ; i++ {
+		kind, name := d.scanKindName()
+		if kind == 0 {
+			break
+		}
+		if i >= len(s) {
+			s = append(s, "")
+		}
+		if kind == kindString {
+			s[i] = d.scanString()
+		} else {
+			d.decodeElement(name, kind, reflect.ValueOf(s).Index(i))
+		}
+	}
+	d.endDoc(offset)
+	v.Set(reflect.ValueOf(s))
+}
+
+func decodeObjectIdSlice(d *decodeState, kind int, v reflect.Value) {
+	if kind != kindArray {
+		d.saveErrorAndSkip(kind, v.Type())
+		return
+	}
+	s := v.Interface().([]ObjectId)
+	offset := d.beginDoc()
+	for i := 0; ; i++ {
+		kind, name := d.scanKindName()
+		if kind == 0 {
+			break
+		}
+		if i >= len(s) {
+			s = append(s, "")
+		}
+		if kind == kindObjectId {
+			s[i] = ObjectId(d.scanObjectId())
 		} else {
+			d.decodeElement(name, kind, reflect.ValueOf(s).Index(i))
+		}
+	}
+	d.endDoc(offset)
+	v.Set(reflect.ValueOf(s))
+}
+
+func decodeArray(d *decodeState, kind int, v reflect.Value) {
+	if kind != kindArray {
+		d.saveErrorAndSkip(kind, v.Type())
+		return
+	}
+	offset := d.beginDoc()
+	i := 0
+	for {
+		kind, name := d.scanKindName()
+		if kind == 0 {
+			break
+		}
+		switch {
+		case i < v.Len():
+			d.decodeElement(name, kind, v.Index(i))
+		case d.strict:
+			d.pushName(string(name))
+			d.saveErrorAndSkip(kind, v.Type())
+			d.popName()
+		default:
 			d.skipValue(kind)
 		}
+		i += 1
 	}
 	d.endDoc(offset)
 }
 
+func decodeStruct(d *decodeState, kind int, v reflect.Value) {
+	d.dec.structDecoder(v.Type()).decode(d, v)
+}
+
 func decodeInterface(d *decodeState, kind int, v reflect.Value) {
 	v.Set(reflect.ValueOf(d.decodeValueInterface(kind)))
 }
@@ -556,9 +1215,12 @@ func (d *decodeState) decodeValueInterface(kind int) interface{} {
 		d.endDoc(offset)
 		return a
 	case kindBinary:
-		p, _ := d.scanBinary()
+		p, subtype := d.scanBinary()
 		newp := make([]byte, len(p))
 		copy(newp, p)
+		if subtype != binaryGeneric {
+			return Binary{Subtype: byte(subtype), Data: newp}
+		}
 		return newp
 	case kindObjectId:
 		return ObjectId(string(d.scanSlice(12)))
@@ -568,14 +1230,26 @@ func (d *decodeState) decodeValueInterface(kind int) interface{} {
 		return DateTime(d.scanInt64())
 	case kindNull:
 		return nil
+	case kindUndefined:
+		return Undefined{}
+	case kindRegexp:
+		return d.scanRegexp()
+	case kindDBPointer:
+		return d.scanDBPointer()
+	case kindCode:
+		return Code(d.scanString())
 	case kindSymbol:
 		return Symbol(d.scanString())
+	case kindCodeWithScope:
+		return d.scanCodeWithScope()
 	case kindInt32:
 		return int(d.scanInt32())
 	case kindTimestamp:
 		return Timestamp(d.scanInt64())
 	case kindInt64:
 		return d.scanInt64()
+	case kindDecimal128:
+		return d.scanDecimal128()
 	case kindMinValue:
 		return MinValue
 	case kindMaxValue:
@@ -586,27 +1260,75 @@ func (d *decodeState) decodeValueInterface(kind int) interface{} {
 	return nil
 }
 
+// decodeValueOrdered is like decodeValueInterface, but preserves the order of
+// the elements in nested documents. Documents decode as D and the elements of
+// arrays are decoded with decodeValueOrdered. Code with scope values decode as
+// BSONData because the scope of a CodeWithScope is a map.
+func (d *decodeState) decodeValueOrdered(kind int) interface{} {
+	switch kind {
+	case kindDocument:
+		doc := D{}
+		offset := d.beginDoc()
+		for {
+			kind, name := d.scanKindName()
+			if kind == 0 {
+				break
+			}
+			doc.Append(string(name), d.decodeValueOrdered(kind))
+		}
+		d.endDoc(offset)
+		return doc
+	case kindArray:
+		a := []interface{}{}
+		offset := d.beginDoc()
+		for {
+			kind, _ := d.scanKindName()
+			if kind == 0 {
+				break
+			}
+			a = append(a, d.decodeValueOrdered(kind))
+		}
+		d.endDoc(offset)
+		return a
+	case kindCodeWithScope:
+		offset := d.offset
+		d.skipValue(kind)
+		p := make([]byte, d.offset-offset)
+		copy(p, d.data[offset:d.offset])
+		return BSONData{Kind: kind, Data: p}
+	}
+	return d.decodeValueInterface(kind)
+}
+
+// skipValue advances past the value. Lengths read from the data are checked
+// against the end of the data.
 func (d *decodeState) skipValue(kind int) {
 	switch kind {
-	case kindString, kindSymbol:
-		n := int(d.scanInt32())
-		d.offset += n
-	case kindDocument, kindArray:
-		n := int(d.scanInt32())
-		d.offset += n - 4
+	case kindString, kindSymbol, kindCode:
+		d.scanSlice(int(d.scanInt32()))
+	case kindDocument, kindArray, kindCodeWithScope:
+		d.scanSlice(int(d.scanInt32()) - 4)
+	case kindRegexp:
+		d.scanCString()
+		d.scanCString()
 	case kindBinary:
 		n := int(d.scanInt32())
-		d.offset += n + 1
+		d.scanSlice(1)
+		d.scanSlice(n)
 	case kindObjectId:
-		d.offset += 12
+		d.scanSlice(12)
 	case kindBool:
-		d.offset += 1
+		d.scanSlice(1)
 	case kindDateTime, kindTimestamp, kindInt64, kindFloat:
-		d.offset += 8
+		d.scanSlice(8)
 	case kindInt32:
-		d.offset += 4
-	case kindMinValue, kindMaxValue, kindNull:
-		d.offset += 0
+		d.scanSlice(4)
+	case kindDecimal128:
+		d.scanSlice(16)
+	case kindDBPointer:
+		d.scanSlice(int(d.scanInt32()))
+		d.scanSlice(12)
+	case kindMinValue, kindMaxValue, kindNull, kindUndefined:
 	default:
 		abort(&DecodeTypeError{kind})
 	}
@@ -614,11 +1336,8 @@ func (d *decodeState) skipValue(kind int) {
 
 type decoderFunc func(e *decodeState, kind int, v reflect.Value)
 
-var kindDecoder map[reflect.Kind]decoderFunc
-var typeDecoder map[reflect.Type]decoderFunc
-
 func init() {
-	kindDecoder = map[reflect.Kind]decoderFunc{
+	kindDecoder := map[reflect.Kind]decoderFunc{
 		reflect.Bool:      decodeBool,
 		reflect.Float32:   decodeFloat,
 		reflect.Float64:   decodeFloat,
@@ -639,15 +1358,30 @@ func init() {
 		reflect.Slice:     decodeSlice,
 		reflect.Array:     decodeArray,
 	}
-	typeDecoder = map[reflect.Type]decoderFunc{
+	typeDecoder := map[reflect.Type]decoderFunc{
 		reflect.TypeOf(BSONData{}):                   decodeBSONData,
+		reflect.TypeOf(Binary{}):                     decodeBinary,
+		reflect.TypeOf(Code("")):                     decodeString,
+		reflect.TypeOf(CodeWithScope{}):              decodeCodeWithScope,
 		reflect.TypeOf(DateTime(0)):                  decodeDateTime,
+		reflect.TypeOf(DBPointer{}):                  decodeDBPointer,
+		reflect.TypeOf(Decimal128{}):                 decodeDecimal128,
 		reflect.TypeOf(MinMax(0)):                    decodeMinMax,
 		reflect.TypeOf(ObjectId("")):                 decodeObjectId,
+		reflect.TypeOf(Raw(nil)):                     decodeRaw,
+		reflect.TypeOf(Regexp{}):                     decodeRegexp,
 		reflect.TypeOf(Symbol("")):                   decodeString,
 		reflect.TypeOf(Timestamp(0)):                 decodeTimestamp,
+		reflect.TypeOf(Undefined{}):                  decodeUndefined,
 		reflect.TypeOf([]byte{}):                     decodeByteSlice,
+		reflect.TypeOf(time.Time{}):                  decodeTime,
 		reflect.TypeOf(make(map[string]interface{})): decodeMapStringInterface,
 		reflect.TypeOf(M{}):                          decodeMapStringInterface,
+		reflect.TypeOf([]float64{}):                  decodeFloat64Slice,
+		reflect.TypeOf([]int32{}):                    decodeInt32Slice,
+		reflect.TypeOf([]int64{}):                    decodeInt64Slice,
+		reflect.TypeOf([]string{}):                   decodeStringSlice,
+		reflect.TypeOf([]ObjectId{}):                 decodeObjectIdSlice,
 	}
+	defaultDecoder = newDecoder(typeDecoder, kindDecoder)
 }
@@ -0,0 +1,204 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package mongo
+
+import (
+	"os"
+)
+
+// Equal returns true if a and b are equal BSON values. Numbers are equal if
+// they have the same value, regardless of their type. The elements of
+// documents are compared without regard to order; array elements must be in
+// the same order. Use EqualOrdered to also require the same order of
+// elements in documents.
+//
+// The arguments can be any of the values accepted by Compare. Equal panics
+// if a value cannot be encoded.
+func Equal(a, b interface{}) bool {
+	ak, ad := compareValue(a)
+	bk, bd := compareValue(b)
+	eq, err := equalBSON(BSONData{ak, ad}, BSONData{bk, bd})
+	if err != nil {
+		panic(err)
+	}
+	return eq
+}
+
+// EqualOrdered returns true if a and b are equal BSON values and the
+// elements of all documents in a and b are in the same order.
+func EqualOrdered(a, b interface{}) bool {
+	return Compare(a, b) == 0
+}
+
+func equalBSON(a, b BSONData) (eq bool, err os.Error) {
+	defer handleAbort(&err)
+	return equalValues(a, b), nil
+}
+
+func equalValues(a, b BSONData) bool {
+	switch {
+	case a.Kind == kindDocument && b.Kind == kindDocument:
+		ae := rawElements(a.Data)
+		be := rawElements(b.Data)
+		if len(ae) != len(be) {
+			return false
+		}
+		m := make(map[string]BSONData, len(be))
+		for _, e := range be {
+			m[e.Name] = e.Value
+		}
+		for _, e := range ae {
+			v, ok := m[e.Name]
+			if !ok || !equalValues(e.Value, v) {
+				return false
+			}
+		}
+		return true
+	case a.Kind == kindArray && b.Kind == kindArray:
+		ae := rawElements(a.Data)
+		be := rawElements(b.Data)
+		if len(ae) != len(be) {
+			return false
+		}
+		for i := range ae {
+			if !equalValues(ae[i].Value, be[i].Value) {
+				return false
+			}
+		}
+		return true
+	}
+	return compareValues(a.Kind, &decodeState{data: a.Data}, b.Kind, &decodeState{data: b.Data}) == 0
+}
+
+func rawElements(data []byte) []RawElement {
+	elements, err := Raw(data).Elements()
+	if err != nil {
+		abort(err)
+	}
+	return elements
+}
+
+// ChangeOp is the type of a change found by Diff.
+type ChangeOp int
+
+const (
+	// The element is in the new document only.
+	ChangeAdded ChangeOp = iota
+
+	// The element is in the old document only.
+	ChangeRemoved
+
+	// The value of the element changed.
+	ChangeModified
+
+	// The value of the element changed to a value of a different type.
+	// Numbers of different types are not considered to be different types.
+	ChangeTypeChanged
+)
+
+var changeOpNames = []string{"added", "removed", "modified", "type changed"}
+
+func (op ChangeOp) String() string {
+	if op < 0 || int(op) >= len(changeOpNames) {
+		return "unknown"
+	}
+	return changeOpNames[op]
+}
+
+// Change describes a difference between two documents.
+type Change struct {
+	Op ChangeOp
+
+	// Dotted path of the element.
+	Path string
+
+	// The old and new values. Old has Kind zero for added elements and New
+	// has Kind zero for removed elements.
+	Old, New BSONData
+}
+
+// Changes is a list of changes returned by Diff.
+type Changes []Change
+
+// Update returns an update document that applies the changes using the
+// $set and $unset operators.
+func (changes Changes) Update() D {
+	var set, unset D
+	for _, c := range changes {
+		if c.Op == ChangeRemoved {
+			unset = append(unset, DocItem{c.Path, 1})
+		} else {
+			set = append(set, DocItem{c.Path, c.New})
+		}
+	}
+	var update D
+	if set != nil {
+		update = append(update, DocItem{"$set", set})
+	}
+	if unset != nil {
+		update = append(update, DocItem{"$unset", unset})
+	}
+	return update
+}
+
+// Diff returns the changes from document a to document b. Embedded documents
+// are compared element by element. Arrays and other values are compared as
+// a whole using the semantics of Equal. The arguments can be any of the
+// values accepted by Compare that represent a document.
+//
+// The values in the returned changes can reference the data in a and b if a
+// or b is Raw or BSONData.
+func Diff(a, b interface{}) (changes Changes, err os.Error) {
+	defer handleAbort(&err)
+	ak, ad := compareValue(a)
+	bk, bd := compareValue(b)
+	if ak != kindDocument || bk != kindDocument {
+		return nil, os.NewError("bson: Diff arguments must be documents")
+	}
+	diffDocs(&changes, "", ad, bd)
+	return changes, nil
+}
+
+func diffDocs(changes *Changes, prefix string, a, b []byte) {
+	ae := rawElements(a)
+	be := rawElements(b)
+	bm := make(map[string]BSONData, len(be))
+	for _, e := range be {
+		bm[e.Name] = e.Value
+	}
+	am := make(map[string]bool, len(ae))
+	for _, e := range ae {
+		am[e.Name] = true
+		path := prefix + e.Name
+		v, ok := bm[e.Name]
+		switch {
+		case !ok:
+			*changes = append(*changes, Change{ChangeRemoved, path, e.Value, BSONData{}})
+		case e.Value.Kind == kindDocument && v.Kind == kindDocument:
+			diffDocs(changes, path+".", e.Value.Data, v.Data)
+		case equalValues(e.Value, v):
+			// no change
+		case kindOrder(e.Value.Kind) != kindOrder(v.Kind):
+			*changes = append(*changes, Change{ChangeTypeChanged, path, e.Value, v})
+		default:
+			*changes = append(*changes, Change{ChangeModified, path, e.Value, v})
+		}
+	}
+	for _, e := range be {
+		if !am[e.Name] {
+			*changes = append(*changes, Change{ChangeAdded, prefix + e.Name, BSONData{}, e.Value})
+		}
+	}
+}
@@ -19,16 +19,58 @@ import (
 	"os"
 	"reflect"
 	"strconv"
+	"sync"
+	"time"
 )
 
 var (
-	typeD        = reflect.TypeOf(D{})
-	typeDoc      = reflect.TypeOf(Doc{})
-	typeBSONData = reflect.TypeOf(BSONData{})
-	idKey        = reflect.ValueOf("_id")
-	itoas        = [...]string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9", "10"}
+	typeD         = reflect.TypeOf(D{})
+	typeDoc       = reflect.TypeOf(Doc{})
+	typeBSONData  = reflect.TypeOf(BSONData{})
+	typeRaw       = reflect.TypeOf(Raw(nil))
+	typeMarshaler = reflect.TypeOf(new(Marshaler)).Elem()
+	idKey         = reflect.ValueOf("_id")
+	arrayKeys     = makeArrayKeys(1 << 14)
 )
 
+// fastSliceTypes are the slice types encoded and decoded without reflection
+// on the elements.
+var fastSliceTypes = []reflect.Type{
+	reflect.TypeOf([]float64{}),
+	reflect.TypeOf([]int32{}),
+	reflect.TypeOf([]int64{}),
+	reflect.TypeOf([]string{}),
+	reflect.TypeOf([]ObjectId{}),
+}
+
+func makeArrayKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	return keys
+}
+
+// arrayKey returns the document key for array index i.
+func arrayKey(i int) string {
+	if i < len(arrayKeys) {
+		return arrayKeys[i]
+	}
+	return strconv.Itoa(i)
+}
+
+// fastSlicesFor returns the fast slice types with an element type matching
+// match. Slice types registered by the application are not returned.
+func fastSlicesFor(registered map[reflect.Type]bool, match func(et reflect.Type) bool) []reflect.Type {
+	var result []reflect.Type
+	for _, st := range fastSliceTypes {
+		if !registered[st] && match(st.Elem()) {
+			result = append(result, st)
+		}
+	}
+	return result
+}
+
 // EncodeTypeError is the error indicating that Encode could not encode an input type.
 type EncodeTypeError struct {
 	Type reflect.Type
@@ -38,23 +80,181 @@ func (e *EncodeTypeError) String() string {
 	return "bson: unsupported type: " + e.Type.String()
 }
 
+// MarshalerError is the error returned when a Marshaler returns an error.
+type MarshalerError struct {
+	Type  reflect.Type
+	Error os.Error
+}
+
+func (e *MarshalerError) String() string {
+	return "bson: error calling MarshalBSON for type " + e.Type.String() + ": " + e.Error.String()
+}
+
 type encodeState struct {
 	buffer
+	enc *Encoder
+}
+
+// EncodeFunc returns the BSON encoding of v. If the returned BSONData has Kind
+// equal to zero, then the value is omitted from the encoding.
+type EncodeFunc func(v reflect.Value) (BSONData, os.Error)
+
+// Encoder holds the configuration for encoding Go values to BSON. Use
+// NewEncoder to create an encoder and the RegisterType and RegisterKind
+// methods to add encodings for types that the application does not own. An
+// encoder must not be modified while it is used to encode values.
+//
+// An encoder compiles the encoding of each struct type once and holds
+// buffers passed to Release for reuse. Use one encoder for many calls to get
+// the benefit of this caching. An encoder can be used by multiple goroutines
+// concurrently.
+type Encoder struct {
+	typeEncoder map[reflect.Type]encoderFunc
+	kindEncoder map[reflect.Kind]encoderFunc
+	registered  map[reflect.Type]bool
+
+	planMutex      sync.RWMutex
+	structEncoders map[reflect.Type]structEncoderFunc
+
+	// free is a list of buffers released by the application.
+	free chan []byte
+}
+
+// defaultEncoder is the encoder used by the Encode function.
+var defaultEncoder *Encoder
+
+// NewEncoder returns a new encoder with the encodings described in the
+// documentation for the Encode function.
+func NewEncoder() *Encoder {
+	enc := newEncoder(make(map[reflect.Type]encoderFunc), make(map[reflect.Kind]encoderFunc))
+	for t, f := range defaultEncoder.typeEncoder {
+		enc.typeEncoder[t] = f
+	}
+	for k, f := range defaultEncoder.kindEncoder {
+		enc.kindEncoder[k] = f
+	}
+	return enc
+}
+
+func newEncoder(typeEncoder map[reflect.Type]encoderFunc, kindEncoder map[reflect.Kind]encoderFunc) *Encoder {
+	return &Encoder{
+		typeEncoder:    typeEncoder,
+		kindEncoder:    kindEncoder,
+		registered:     make(map[reflect.Type]bool),
+		structEncoders: make(map[reflect.Type]structEncoderFunc),
+		free:           make(chan []byte, maxFreeBuffers),
+	}
+}
+
+func (f EncodeFunc) encoderFunc() encoderFunc {
+	return func(e *encodeState, name string, fi *fieldInfo, v reflect.Value) {
+		bd, err := f(v)
+		if err != nil {
+			abort(err)
+		}
+		if bd.Kind == 0 {
+			return
+		}
+		e.writeKindName(bd.Kind, name)
+		e.Write(bd.Data)
+	}
+}
+
+// RegisterType sets the encoding for values of type t to f. The encoding for
+// a type takes precedence over the Marshaler interface and the encoding for
+// the kind of the type.
+func (enc *Encoder) RegisterType(t reflect.Type, f EncodeFunc) {
+	// Use the general slice encoding so that the elements are encoded with f.
+	for _, st := range fastSlicesFor(enc.registered, func(et reflect.Type) bool { return et == t }) {
+		enc.typeEncoder[st] = encodeSlice
+	}
+	enc.typeEncoder[t] = f.encoderFunc()
+	enc.registered[t] = true
+	enc.resetPlans()
+}
+
+// RegisterKind sets the encoding for values of kind k to f. The encoding is
+// used for values that do not have an encoding registered by type and do not
+// implement the Marshaler interface.
+func (enc *Encoder) RegisterKind(k reflect.Kind, f EncodeFunc) {
+	match := func(et reflect.Type) bool {
+		_, ok := enc.typeEncoder[et]
+		return et.Kind() == k && !ok
+	}
+	for _, st := range fastSlicesFor(enc.registered, match) {
+		enc.typeEncoder[st] = encodeSlice
+	}
+	enc.kindEncoder[k] = f.encoderFunc()
+	enc.resetPlans()
+}
+
+// Release adds buf to the encoder's list of free buffers. Encode uses a free
+// buffer when called with a nil buffer. The application must not use buf
+// after calling Release.
+func (enc *Encoder) Release(buf []byte) {
+	if cap(buf) > maxRetainedBuffer {
+		return
+	}
+	select {
+	case enc.free <- buf[:0]:
+	default:
+		// The list is full.
+	}
+}
+
+// freeBuffer returns a buffer from the list of free buffers or nil if the list
+// is empty.
+func (enc *Encoder) freeBuffer() []byte {
+	select {
+	case buf := <-enc.free:
+		return buf
+	default:
+	}
+	return nil
 }
 
 // Encode appends the BSON encoding of doc to buf and returns the new slice.
+// Use an Encoder to reuse buffers across calls.
 //
 // Encode traverses the value doc recursively using the following
 // type-dependent encodings:
 //
+// If a value implements the Marshaler interface, Encode calls its MarshalBSON
+// method and writes the returned BSON value. Pointer receivers are used when
+// the value is addressable, for example a field of a struct passed to Encode
+// by pointer.
+//
 // Struct values encode as BSON documents. The struct field tag specifies the
 // encoded name of the field and encoding options. The options follow the name
 // and are proceeded by a '/'. If the name is not specified in the tag, then
 // the field name defaults to the structure field name. Unexported fields and
-// fields equal to nil are not encoded. The following option is supported:
+// fields equal to nil are not encoded. A field with the tag "-" is not
+// encoded. The following options are supported:
 //
-//  /c  If the field is the zero value, then the field is not 
-//      written to the encoding. 
+//  /c          If the field is the zero value, then the field is not 
+//              written to the encoding. 
+//  /omitempty  If the field is the zero value or an empty slice, map or
+//              string, then the field is not written to the encoding.
+//  /minsize    Encode int64 and uint64 values as Integer32 if the value
+//              fits in an int32.
+//  /required   Decode returns an error if the field is missing.
+//  /inline     Encode the fields of a struct or pointer to struct field
+//              as if they were fields of the outer struct. A nil pointer
+//              is not encoded. If the field is a map or a mongo.D, then
+//              the entries are encoded as fields of the outer struct
+//              and Decode stores elements not matching a struct field,
+//              including nulls, in the map or D. Documents nested in
+//              the elements of a D are stored as D so that their order
+//              is preserved. A struct can have at most one inline map
+//              or D.
+//
+// The fields of anonymous struct and pointer to struct fields are encoded as
+// if they were fields of the outer struct. A nil anonymous pointer is not
+// encoded. Decode allocates an anonymous pointer only when the document
+// contains one of its fields.
+//
+// Struct types with invalid field tags or with embedded or inline pointers to
+// a struct containing the pointer return a *StructTagError.
 //
 // Array and slice values encode as BSON arrays.
 //
@@ -77,21 +277,36 @@ type encodeState struct {
 //      int64, uint64       -> Integer64
 //      string              -> String
 //      []byte              -> Binary data
+//      mongo.Binary        -> Binary data with subtype
 //      mongo.Code          -> Javascript code
 //      mongo.CodeWithScope -> Javascript code with scope
 //      mongo.DateTime      -> UTC Datetime
+//      time.Time           -> UTC Datetime truncated to milliseconds. The zero
+//                             time encodes as January 1, year 1 UTC. An error
+//                             is returned for times outside the datetime range.
+//      mongo.Decimal128    -> Decimal128
 //      mongo.D             -> Document. Use when element order is important.
+//      mongo.DBPointer     -> DBPointer (deprecated)
 //      mongo.MinMax        -> Minimum / Maximum value
 //      mongo.ObjectId      -> ObjectId
+//      mongo.Raw           -> Document
 //      mongo.Regexp        -> Regular expression
 //      mongo.Symbol        -> Symbol
 //      mongo.Timestamp     -> Timestamp
+//      mongo.Undefined     -> Undefined (deprecated)
 //
 // Other types including channels, complex and function values cannot be encoded.
 //
 // BSON cannot represent cyclic data structure and Encode does not handle them.
 // Passing cyclic structures to Encode will result in an infinite recursion.
 func Encode(buf []byte, doc interface{}) (result []byte, err os.Error) {
+	return defaultEncoder.Encode(buf, doc)
+}
+
+// Encode appends the BSON encoding of doc to buf using the encodings
+// configured in enc and returns the new slice. See the Encode function for
+// more information about BSON encoding.
+func (enc *Encoder) Encode(buf []byte, doc interface{}) (result []byte, err os.Error) {
 	defer handleAbort(&err)
 
 	v := reflect.ValueOf(doc)
@@ -99,7 +314,19 @@ func Encode(buf []byte, doc interface{}) (result []byte, err os.Error) {
 		v = v.Elem()
 	}
 
-	e := encodeState{buffer: buf}
+	if buf == nil {
+		buf = enc.freeBuffer()
+	}
+
+	e := encodeState{buffer: buf, enc: enc}
+	if mv, ok := marshaler(v); ok {
+		bd := marshalValue(mv)
+		if bd.Kind != kindDocument {
+			return nil, &EncodeTypeError{v.Type()}
+		}
+		e.Write(bd.Data)
+		return e.buffer, nil
+	}
 	switch v.Type() {
 	case typeD:
 		e.writeD(v.Interface().(D))
@@ -111,6 +338,8 @@ func Encode(buf []byte, doc interface{}) (result []byte, err os.Error) {
 			return nil, &EncodeTypeError{v.Type()}
 		}
 		e.Write(rd.Data)
+	case typeRaw:
+		e.Write(v.Interface().(Raw))
 	default:
 		switch v.Kind() {
 		case reflect.Struct:
@@ -141,13 +370,55 @@ func (e *encodeState) writeKindName(kind int, name string) {
 }
 
 func (e *encodeState) writeStruct(v reflect.Value) {
-	offset := e.beginDoc()
-	si := structInfoForType(v.Type())
-	for _, fi := range si.l {
-		e.encodeValue(fi.name, fi, v.FieldByIndex(fi.index))
+	e.enc.structEncoder(v.Type())(e, v)
+}
+
+// writeExtras writes the elements of the inline map or D of struct v.
+func (e *encodeState) writeExtras(si *structInfo, v reflect.Value) {
+	ev, ok := fieldByIndex(v, si.extra, false)
+	if !ok || ev.IsNil() {
+		return
 	}
-	e.WriteByte(0)
-	e.endDoc(offset)
+	if ev.Type() == typeD {
+		for _, item := range ev.Interface().(D) {
+			e.writeExtra(si, v, item.Key, reflect.ValueOf(item.Value))
+		}
+	} else {
+		for _, k := range ev.MapKeys() {
+			e.writeExtra(si, v, k.String(), ev.MapIndex(k))
+		}
+	}
+}
+
+// writeExtra writes an element from the inline map or D of struct v. Nil
+// values are written as null so that documents round trip without loss.
+func (e *encodeState) writeExtra(si *structInfo, v reflect.Value, name string, value reflect.Value) {
+	if si.m[name] != nil {
+		abort(os.NewError("bson: inline key " + strconv.Quote(name) + " conflicts with struct field in " + v.Type().String()))
+	}
+	if !value.IsValid() || ((value.Kind() == reflect.Interface || value.Kind() == reflect.Ptr) && value.IsNil()) {
+		e.writeKindName(kindNull, name)
+		return
+	}
+	e.encodeValue(name, defaultFieldInfo, value)
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
 }
 
 func (e *encodeState) writeMap(v reflect.Value, topLevel bool) {
@@ -199,12 +470,18 @@ func (e *encodeState) encodeValue(name string, fi *fieldInfo, v reflect.Value) {
 		return
 	}
 	t := v.Type()
-	encoder, found := typeEncoder[t]
+	encoder, found := e.enc.typeEncoder[t]
+	if found {
+		encoder(e, name, fi, v)
+		return
+	}
+	if mv, ok := marshaler(v); ok {
+		encodeMarshaler(e, name, fi, mv)
+		return
+	}
+	encoder, found = e.enc.kindEncoder[t.Kind()]
 	if !found {
-		encoder, found = kindEncoder[t.Kind()]
-		if !found {
-			abort(&EncodeTypeError{t})
-		}
+		abort(&EncodeTypeError{t})
 	}
 	encoder(e, name, fi, v)
 }
@@ -276,6 +553,11 @@ func encodeInt64(e *encodeState, kind int, name string, fi *fieldInfo, v reflect
 	if i == 0 && fi.conditional {
 		return
 	}
+	if kind == kindInt64 && fi.minSize && i >= math.MinInt32 && i <= math.MaxInt32 {
+		e.writeKindName(kindInt32, name)
+		e.WriteUint32(uint32(i))
+		return
+	}
 	e.writeKindName(kind, name)
 	e.WriteUint64(uint64(i))
 }
@@ -288,6 +570,11 @@ func encodeUint64(e *encodeState, name string, fi *fieldInfo, v reflect.Value) {
 	if int64(u) < 0 {
 		abort(os.NewError("bson: uint64 value does not fit in int64"))
 	}
+	if fi.minSize && u <= math.MaxInt32 {
+		e.writeKindName(kindInt32, name)
+		e.WriteUint32(uint32(u))
+		return
+	}
 	e.writeKindName(kindInt64, name)
 	e.WriteUint64(u)
 }
@@ -333,6 +620,17 @@ func encodeObjectId(e *encodeState, name string, fi *fieldInfo, v reflect.Value)
 	copy(e.Next(12), oid)
 }
 
+func encodeDBPointer(e *encodeState, name string, fi *fieldInfo, v reflect.Value) {
+	p := v.Interface().(DBPointer)
+	if len(p.Id) != 12 {
+		abort(os.NewError("bson: object id length != 12"))
+	}
+	e.writeKindName(kindDBPointer, name)
+	e.WriteUint32(uint32(len(p.Namespace) + 1))
+	e.WriteCString(p.Namespace)
+	copy(e.Next(12), p.Id)
+}
+
 func encodeBSONData(e *encodeState, name string, fi *fieldInfo, v reflect.Value) {
 	bd := v.Interface().(BSONData)
 	if bd.Kind == 0 {
@@ -342,6 +640,49 @@ func encodeBSONData(e *encodeState, name string, fi *fieldInfo, v reflect.Value)
 	e.Write(bd.Data)
 }
 
+func encodeRaw(e *encodeState, name string, fi *fieldInfo, v reflect.Value) {
+	r := v.Interface().(Raw)
+	if r == nil {
+		return
+	}
+	e.writeKindName(kindDocument, name)
+	e.Write(r)
+}
+
+// marshaler returns v or the address of v if the value implements Marshaler.
+func marshaler(v reflect.Value) (reflect.Value, bool) {
+	t := v.Type()
+	if t.Kind() != reflect.Interface && t.Implements(typeMarshaler) {
+		return v, true
+	}
+	if t.Kind() != reflect.Ptr && v.CanAddr() {
+		if pv := v.Addr(); pv.Type().Implements(typeMarshaler) {
+			return pv, true
+		}
+	}
+	return v, false
+}
+
+func marshalValue(v reflect.Value) BSONData {
+	bd, err := v.Interface().(Marshaler).MarshalBSON()
+	if err != nil {
+		abort(&MarshalerError{v.Type(), err})
+	}
+	return bd
+}
+
+func encodeMarshaler(e *encodeState, name string, fi *fieldInfo, v reflect.Value) {
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		return
+	}
+	bd := marshalValue(v)
+	if bd.Kind == 0 {
+		return
+	}
+	e.writeKindName(bd.Kind, name)
+	e.Write(bd.Data)
+}
+
 func encodeCodeWithScope(e *encodeState, name string, fi *fieldInfo, v reflect.Value) {
 	c := v.Interface().(CodeWithScope)
 	if c.Code == "" && c.Scope == nil && fi.conditional {
@@ -417,6 +758,46 @@ func encodeByteSlice(e *encodeState, name string, fi *fieldInfo, v reflect.Value
 	e.Write(b)
 }
 
+func encodeBinary(e *encodeState, name string, fi *fieldInfo, v reflect.Value) {
+	b := v.Interface().(Binary)
+	if b.Data == nil && fi.conditional {
+		return
+	}
+	e.writeKindName(kindBinary, name)
+	if b.Subtype == binaryOld {
+		e.WriteUint32(uint32(len(b.Data) + 4))
+		e.WriteByte(b.Subtype)
+		e.WriteUint32(uint32(len(b.Data)))
+	} else {
+		e.WriteUint32(uint32(len(b.Data)))
+		e.WriteByte(b.Subtype)
+	}
+	e.Write(b.Data)
+}
+
+func encodeTime(e *encodeState, name string, fi *fieldInfo, v reflect.Value) {
+	t := v.Interface().(time.Time)
+	if isZeroTime(&t) && fi.conditional {
+		return
+	}
+	dt, ok := dateTimeForTime(&t)
+	if !ok {
+		abort(os.NewError("bson: time " + t.String() + " is outside the range of datetime"))
+	}
+	e.writeKindName(kindDateTime, name)
+	e.WriteUint64(uint64(dt))
+}
+
+func encodeDecimal128(e *encodeState, name string, fi *fieldInfo, v reflect.Value) {
+	d := v.Interface().(Decimal128)
+	if d.h == 0 && d.l == 0 && fi.conditional {
+		return
+	}
+	e.writeKindName(kindDecimal128, name)
+	e.WriteUint64(d.l)
+	e.WriteUint64(d.h)
+}
+
 func encodeSlice(e *encodeState, name string, fi *fieldInfo, v reflect.Value) {
 	if v.IsNil() {
 		return
@@ -427,15 +808,91 @@ func encodeSlice(e *encodeState, name string, fi *fieldInfo, v reflect.Value) {
 func encodeArray(e *encodeState, name string, fi *fieldInfo, v reflect.Value) {
 	e.writeKindName(kindArray, name)
 	offset := e.beginDoc()
-	n := v.Len()
-	if n < len(itoas) {
-		for i, k := range itoas[:n] {
-			e.encodeValue(k, defaultFieldInfo, v.Index(i))
+	for i, n := 0, v.Len(); i < n; i++ {
+		e.encodeValue(arrayKey(i), defaultFieldInfo, v.Index(i))
+	}
+	e.WriteByte(0)
+	e.endDoc(offset)
+}
+
+func encodeFloat64Slice(e *encodeState, name string, fi *fieldInfo, v reflect.Value) {
+	s := v.Interface().([]float64)
+	if s == nil {
+		return
+	}
+	e.writeKindName(kindArray, name)
+	offset := e.beginDoc()
+	for i, f := range s {
+		e.writeKindName(kindFloat, arrayKey(i))
+		e.WriteUint64(math.Float64bits(f))
+	}
+	e.WriteByte(0)
+	e.endDoc(offset)
+}
+
+func encodeInt32Slice(e *encodeState, name string, fi *fieldInfo, v reflect.Value) {
+	s := v.Interface().([]int32)
+	if s == nil {
+		return
+	}
+	e.writeKindName(kindArray, name)
+	offset := e.beginDoc()
+	for i, n := range s {
+		e.writeKindName(kindInt32, arrayKey(i))
+		e.WriteUint32(uint32(n))
+	}
+	e.WriteByte(0)
+	e.endDoc(offset)
+}
+
+func encodeInt64Slice(e *encodeState, name string, fi *fieldInfo, v reflect.Value) {
+	s := v.Interface().([]int64)
+	if s == nil {
+		return
+	}
+	e.writeKindName(kindArray, name)
+	offset := e.beginDoc()
+	for i, n := range s {
+		e.writeKindName(kindInt64, arrayKey(i))
+		e.WriteUint64(uint64(n))
+	}
+	e.WriteByte(0)
+	e.endDoc(offset)
+}
+
+func encodeStringSlice(e *encodeState, name string, fi *fieldInfo, v reflect.Value) {
+	s := v.Interface().([]string)
+	if s == nil {
+		return
+	}
+	e.writeKindName(kindArray, name)
+	offset := e.beginDoc()
+	for i, str := range s {
+		e.writeKindName(kindString, arrayKey(i))
+		e.WriteUint32(uint32(len(str) + 1))
+		e.WriteCString(str)
+	}
+	e.WriteByte(0)
+	e.endDoc(offset)
+}
+
+func encodeObjectIdSlice(e *encodeState, name string, fi *fieldInfo, v reflect.Value) {
+	s := v.Interface().([]ObjectId)
+	if s == nil {
+		return
+	}
+	e.writeKindName(kindArray, name)
+	offset := e.beginDoc()
+	for i, oid := range s {
+		// Empty object ids are omitted as in encodeObjectId.
+		if oid == "" {
+			continue
 		}
-	} else {
-		for i := 0; i < n; i++ {
-			e.encodeValue(strconv.Itoa(i), defaultFieldInfo, v.Index(i))
+		if len(oid) != 12 {
+			abort(os.NewError("bson: object id length != 12"))
 		}
+		e.writeKindName(kindObjectId, arrayKey(i))
+		copy(e.Next(12), oid)
 	}
 	e.WriteByte(0)
 	e.endDoc(offset)
@@ -451,11 +908,8 @@ func encodeInterfaceOrPtr(e *encodeState, name string, fi *fieldInfo, v reflect.
 
 type encoderFunc func(e *encodeState, name string, fi *fieldInfo, v reflect.Value)
 
-var kindEncoder map[reflect.Kind]encoderFunc
-var typeEncoder map[reflect.Type]encoderFunc
-
 func init() {
-	kindEncoder = map[reflect.Kind]encoderFunc{
+	kindEncoder := map[reflect.Kind]encoderFunc{
 		reflect.Array:   encodeArray,
 		reflect.Bool:    encodeBool,
 		reflect.Float32: encodeFloat,
@@ -481,10 +935,11 @@ func init() {
 		},
 		reflect.Struct: encodeStruct,
 	}
-	typeEncoder = map[reflect.Type]encoderFunc{
+	typeEncoder := map[reflect.Type]encoderFunc{
 		typeDoc:      encodeDoc,
 		typeD:        encodeD,
 		typeBSONData: encodeBSONData,
+		typeRaw:      encodeRaw,
 		reflect.TypeOf(Code("")): func(e *encodeState, name string, fi *fieldInfo, value reflect.Value) {
 			encodeString(e, kindCode, name, fi, value)
 		},
@@ -492,6 +947,8 @@ func init() {
 		reflect.TypeOf(DateTime(0)): func(e *encodeState, name string, fi *fieldInfo, value reflect.Value) {
 			encodeInt64(e, kindDateTime, name, fi, value)
 		},
+		reflect.TypeOf(DBPointer{}):  encodeDBPointer,
+		reflect.TypeOf(Decimal128{}): encodeDecimal128,
 		reflect.TypeOf(MinMax(0)):    encodeMinMax,
 		reflect.TypeOf(ObjectId("")): encodeObjectId,
 		reflect.TypeOf(Regexp{}):     encodeRegexp,
@@ -501,6 +958,17 @@ func init() {
 		reflect.TypeOf(Timestamp(0)): func(e *encodeState, name string, fi *fieldInfo, value reflect.Value) {
 			encodeInt64(e, kindTimestamp, name, fi, value)
 		},
-		reflect.TypeOf([]byte{}): encodeByteSlice,
-	}
+		reflect.TypeOf(Undefined{}): func(e *encodeState, name string, fi *fieldInfo, value reflect.Value) {
+			e.writeKindName(kindUndefined, name)
+		},
+		reflect.TypeOf(Binary{}):     encodeBinary,
+		reflect.TypeOf([]byte{}):     encodeByteSlice,
+		reflect.TypeOf(time.Time{}):  encodeTime,
+		reflect.TypeOf([]float64{}):  encodeFloat64Slice,
+		reflect.TypeOf([]int32{}):    encodeInt32Slice,
+		reflect.TypeOf([]int64{}):    encodeInt64Slice,
+		reflect.TypeOf([]string{}):   encodeStringSlice,
+		reflect.TypeOf([]ObjectId{}): encodeObjectIdSlice,
+	}
+	defaultEncoder = newEncoder(typeEncoder, kindEncoder)
 }
@@ -0,0 +1,910 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package mongo
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"utf8"
+)
+
+// MarshalExtJSON returns the MongoDB Extended JSON v2 representation of the
+// BSON document in data.
+//
+// In canonical mode, every BSON type is represented with a type wrapper such
+// as {"$numberInt": "1"} so that the conversion back to BSON is lossless. In
+// relaxed mode, numbers are written as JSON numbers and datetimes between
+// the years 1970 and 9999 are written as ISO-8601 strings.
+func MarshalExtJSON(data []byte, canonical bool) ([]byte, os.Error) {
+	return BSONData{Kind: kindDocument, Data: data}.MarshalExtJSON(canonical)
+}
+
+// UnmarshalExtJSON returns the BSON encoding of the Extended JSON document in
+// data. Both canonical and relaxed mode input is accepted, as are the legacy
+// {"$binary": ..., "$type": ...}, {"$regex": ..., "$options": ...} and
+// {"$date": <number>} forms.
+func UnmarshalExtJSON(data []byte) ([]byte, os.Error) {
+	var bd BSONData
+	if err := bd.UnmarshalExtJSON(data); err != nil {
+		return nil, err
+	}
+	if bd.Kind != kindDocument {
+		return nil, os.NewError("bson: extended JSON value is " + kindName(bd.Kind) + ", not a document")
+	}
+	return bd.Data, nil
+}
+
+// MarshalExtJSON returns the Extended JSON representation of the value. See
+// the MarshalExtJSON function for a description of the modes.
+func (bd BSONData) MarshalExtJSON(canonical bool) (result []byte, err os.Error) {
+	defer handleAbort(&err)
+	x := extJSONEncoder{d: decodeState{data: bd.Data}, canonical: canonical}
+	x.writeValue(bd.Kind)
+	if x.d.offset != len(bd.Data) {
+		return nil, os.NewError("bson: extra data after " + kindName(bd.Kind))
+	}
+	return x.buf.Bytes(), nil
+}
+
+// UnmarshalExtJSON sets bd to the BSON value of the Extended JSON in data.
+func (bd *BSONData) UnmarshalExtJSON(data []byte) (err os.Error) {
+	defer handleAbort(&err)
+	p := extJSONParser{data: data}
+	v := p.parseValue()
+	p.skipSpace()
+	if p.offset != len(p.data) {
+		p.syntaxError("unexpected data after value")
+	}
+	var e encodeState
+	bd.Kind = e.writeExtJSON(v)
+	bd.Data = e.buffer
+	return nil
+}
+
+type extJSONEncoder struct {
+	buf       bytes.Buffer
+	d         decodeState
+	canonical bool
+}
+
+// maxRelaxedDateTime is 9999-12-31T23:59:59.999Z, the last datetime written
+// as an ISO-8601 string in relaxed mode.
+const maxRelaxedDateTime = 253402300799999
+
+func (x *extJSONEncoder) writeValue(kind int) {
+	d := &x.d
+	switch kind {
+	case kindFloat:
+		x.writeFloat(d.scanFloat())
+	case kindString:
+		x.writeString(d.scanString())
+	case kindDocument, kindArray:
+		x.writeDoc(kind)
+	case kindBinary:
+		p, subtype := d.scanBinary()
+		x.buf.WriteString(`{"$binary":{"base64":"`)
+		x.buf.WriteString(base64.StdEncoding.EncodeToString(p))
+		x.buf.WriteString(`","subType":"`)
+		x.buf.WriteString(hex.EncodeToString([]byte{byte(subtype)}))
+		x.buf.WriteString(`"}}`)
+	case kindObjectId:
+		x.buf.WriteString(`{"$oid":"`)
+		x.buf.WriteString(hex.EncodeToString(d.scanObjectId()))
+		x.buf.WriteString(`"}`)
+	case kindBool:
+		if d.scanBool() {
+			x.buf.WriteString("true")
+		} else {
+			x.buf.WriteString("false")
+		}
+	case kindDateTime:
+		ms := d.scanInt64()
+		x.buf.WriteString(`{"$date":`)
+		if !x.canonical && ms >= 0 && ms <= maxRelaxedDateTime {
+			x.writeString(formatExtJSONDate(ms))
+		} else {
+			x.writeWrapped("$numberLong", strconv.Itoa64(ms))
+		}
+		x.buf.WriteByte('}')
+	case kindNull:
+		x.buf.WriteString("null")
+	case kindUndefined:
+		x.buf.WriteString(`{"$undefined":true}`)
+	case kindDBPointer:
+		p := d.scanDBPointer()
+		x.buf.WriteString(`{"$dbPointer":{"$ref":`)
+		x.writeString(p.Namespace)
+		x.buf.WriteString(`,"$id":{"$oid":"`)
+		x.buf.WriteString(hex.EncodeToString([]byte(p.Id)))
+		x.buf.WriteString(`"}}}`)
+	case kindRegexp:
+		r := d.scanRegexp()
+		x.buf.WriteString(`{"$regularExpression":{"pattern":`)
+		x.writeString(r.Pattern)
+		x.buf.WriteString(`,"options":`)
+		x.writeString(sortOptions(r.Options))
+		x.buf.WriteString("}}")
+	case kindCode:
+		x.writeWrapped("$code", d.scanString())
+	case kindSymbol:
+		x.writeWrapped("$symbol", d.scanString())
+	case kindCodeWithScope:
+		offset := d.beginDoc()
+		x.buf.WriteString(`{"$code":`)
+		x.writeString(d.scanString())
+		x.buf.WriteString(`,"$scope":`)
+		x.writeDoc(kindDocument)
+		x.buf.WriteByte('}')
+		d.endDoc(offset)
+	case kindInt32:
+		s := strconv.Itoa64(int64(d.scanInt32()))
+		if x.canonical {
+			x.writeWrapped("$numberInt", s)
+		} else {
+			x.buf.WriteString(s)
+		}
+	case kindTimestamp:
+		u := uint64(d.scanInt64())
+		x.buf.WriteString(`{"$timestamp":{"t":`)
+		x.buf.WriteString(strconv.Uitoa64(u >> 32))
+		x.buf.WriteString(`,"i":`)
+		x.buf.WriteString(strconv.Uitoa64(u & 0xffffffff))
+		x.buf.WriteString("}}")
+	case kindInt64:
+		s := strconv.Itoa64(d.scanInt64())
+		if x.canonical {
+			x.writeWrapped("$numberLong", s)
+		} else {
+			x.buf.WriteString(s)
+		}
+	case kindDecimal128:
+		x.writeWrapped("$numberDecimal", d.scanDecimal128().String())
+	case kindMinValue:
+		x.buf.WriteString(`{"$minKey":1}`)
+	case kindMaxValue:
+		x.buf.WriteString(`{"$maxKey":1}`)
+	default:
+		abort(&DecodeTypeError{kind})
+	}
+}
+
+func (x *extJSONEncoder) writeDoc(kind int) {
+	d := &x.d
+	left, right := byte('{'), byte('}')
+	if kind == kindArray {
+		left, right = '[', ']'
+	}
+	offset := d.beginDoc()
+	x.buf.WriteByte(left)
+	for i := 0; ; i++ {
+		kind, name := d.scanKindName()
+		if kind == 0 {
+			break
+		}
+		if i > 0 {
+			x.buf.WriteByte(',')
+		}
+		if left == '{' {
+			x.writeString(string(name))
+			x.buf.WriteByte(':')
+		}
+		x.writeValue(kind)
+	}
+	x.buf.WriteByte(right)
+	d.endDoc(offset)
+}
+
+func (x *extJSONEncoder) writeFloat(f float64) {
+	var s string
+	switch {
+	case math.IsNaN(f):
+		s = "NaN"
+	case math.IsInf(f, 1):
+		s = "Infinity"
+	case math.IsInf(f, -1):
+		s = "-Infinity"
+	default:
+		s = strconv.Ftoa64(f, 'G', -1)
+		if strings.IndexAny(s, ".E") < 0 {
+			s += ".0"
+		}
+		if !x.canonical {
+			x.buf.WriteString(s)
+			return
+		}
+	}
+	x.writeWrapped("$numberDouble", s)
+}
+
+// writeWrapped writes {"key":"s"}.
+func (x *extJSONEncoder) writeWrapped(key, s string) {
+	x.buf.WriteString(`{"`)
+	x.buf.WriteString(key)
+	x.buf.WriteString(`":`)
+	x.writeString(s)
+	x.buf.WriteByte('}')
+}
+
+func (x *extJSONEncoder) writeString(s string) {
+	const hexDigits = "0123456789abcdef"
+	x.buf.WriteByte('"')
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 0x20 && c != '"' && c != '\\' {
+			continue
+		}
+		x.buf.WriteString(s[start:i])
+		switch c {
+		case '"', '\\':
+			x.buf.WriteByte('\\')
+			x.buf.WriteByte(c)
+		case '\n':
+			x.buf.WriteString(`\n`)
+		case '\r':
+			x.buf.WriteString(`\r`)
+		case '\t':
+			x.buf.WriteString(`\t`)
+		default:
+			x.buf.WriteString(`\u00`)
+			x.buf.WriteByte(hexDigits[c>>4])
+			x.buf.WriteByte(hexDigits[c&0xf])
+		}
+		start = i + 1
+	}
+	x.buf.WriteString(s[start:])
+	x.buf.WriteByte('"')
+}
+
+// formatExtJSONDate formats milliseconds since the epoch as an ISO-8601
+// string. Zero milliseconds are omitted.
+func formatExtJSONDate(ms int64) string {
+	t := time.SecondsToUTC(ms / 1000)
+	s := pad(strconv.Itoa64(t.Year), 4) + "-" + pad(strconv.Itoa(t.Month), 2) + "-" + pad(strconv.Itoa(t.Day), 2) +
+		"T" + pad(strconv.Itoa(t.Hour), 2) + ":" + pad(strconv.Itoa(t.Minute), 2) + ":" + pad(strconv.Itoa(t.Second), 2)
+	if ms%1000 != 0 {
+		s += "." + pad(strconv.Itoa64(ms%1000), 3)
+	}
+	return s + "Z"
+}
+
+func pad(s string, n int) string {
+	for len(s) < n {
+		s = "0" + s
+	}
+	return s
+}
+
+// sortOptions returns the regular expression options in alphabetical order.
+func sortOptions(options string) string {
+	p := []byte(options)
+	for i := 1; i < len(p); i++ {
+		for j := i; j > 0 && p[j] < p[j-1]; j-- {
+			p[j], p[j-1] = p[j-1], p[j]
+		}
+	}
+	return string(p)
+}
+
+// extJSONValue is a parsed JSON value. Objects are kept in document order.
+type extJSONValue struct {
+	kind   int // one of the json* constants
+	s      string
+	keys   []string
+	values []*extJSONValue
+}
+
+const (
+	jsonNull = iota
+	jsonBool
+	jsonNumber
+	jsonString
+	jsonArray
+	jsonObject
+)
+
+// member returns the value for key in an object or nil if the key is not
+// present.
+func (v *extJSONValue) member(key string) *extJSONValue {
+	for i, k := range v.keys {
+		if k == key {
+			return v.values[i]
+		}
+	}
+	return nil
+}
+
+type extJSONParser struct {
+	data   []byte
+	offset int
+}
+
+func (p *extJSONParser) syntaxError(msg string) {
+	abort(os.NewError("bson: extended JSON syntax error at offset " + strconv.Itoa(p.offset) + ": " + msg))
+}
+
+func (p *extJSONParser) skipSpace() {
+	for p.offset < len(p.data) {
+		switch p.data[p.offset] {
+		case ' ', '\t', '\r', '\n':
+			p.offset++
+		default:
+			return
+		}
+	}
+}
+
+func (p *extJSONParser) next() byte {
+	p.skipSpace()
+	if p.offset >= len(p.data) {
+		p.syntaxError("unexpected end of input")
+	}
+	c := p.data[p.offset]
+	p.offset++
+	return c
+}
+
+func (p *extJSONParser) expect(c byte) {
+	if p.next() != c {
+		p.offset--
+		p.syntaxError("expected " + strconv.Quote(string(c)))
+	}
+}
+
+func (p *extJSONParser) literal(s string) {
+	if !bytes.HasPrefix(p.data[p.offset:], []byte(s)) {
+		p.syntaxError("invalid literal")
+	}
+	p.offset += len(s)
+}
+
+func (p *extJSONParser) parseValue() *extJSONValue {
+	c := p.next()
+	switch {
+	case c == '{':
+		v := &extJSONValue{kind: jsonObject}
+		if p.next() == '}' {
+			return v
+		}
+		p.offset--
+		for {
+			p.expect('"')
+			v.keys = append(v.keys, p.parseString())
+			p.expect(':')
+			v.values = append(v.values, p.parseValue())
+			if p.next() == '}' {
+				return v
+			}
+			p.offset--
+			p.expect(',')
+		}
+	case c == '[':
+		v := &extJSONValue{kind: jsonArray}
+		if p.next() == ']' {
+			return v
+		}
+		p.offset--
+		for {
+			v.values = append(v.values, p.parseValue())
+			if p.next() == ']' {
+				return v
+			}
+			p.offset--
+			p.expect(',')
+		}
+	case c == '"':
+		return &extJSONValue{kind: jsonString, s: p.parseString()}
+	case c == 't':
+		p.literal("rue")
+		return &extJSONValue{kind: jsonBool, s: "true"}
+	case c == 'f':
+		p.literal("alse")
+		return &extJSONValue{kind: jsonBool}
+	case c == 'n':
+		p.literal("ull")
+		return &extJSONValue{kind: jsonNull}
+	case c == '-' || ('0' <= c && c <= '9'):
+		p.offset--
+		return &extJSONValue{kind: jsonNumber, s: p.parseNumber()}
+	}
+	p.offset--
+	p.syntaxError("unexpected character " + strconv.Quote(string(c)))
+	panic("unreachable")
+}
+
+func (p *extJSONParser) parseNumber() string {
+	start := p.offset
+	digits := func() {
+		n := p.offset
+		for p.offset < len(p.data) && '0' <= p.data[p.offset] && p.data[p.offset] <= '9' {
+			p.offset++
+		}
+		if n == p.offset {
+			p.syntaxError("invalid number")
+		}
+	}
+	if p.data[p.offset] == '-' {
+		p.offset++
+	}
+	digits()
+	if p.offset < len(p.data) && p.data[p.offset] == '.' {
+		p.offset++
+		digits()
+	}
+	if p.offset < len(p.data) && (p.data[p.offset] == 'e' || p.data[p.offset] == 'E') {
+		p.offset++
+		if p.offset < len(p.data) && (p.data[p.offset] == '+' || p.data[p.offset] == '-') {
+			p.offset++
+		}
+		digits()
+	}
+	return string(p.data[start:p.offset])
+}
+
+// parseString parses the remainder of a string after the opening quote.
+func (p *extJSONParser) parseString() string {
+	var buf []byte
+	for {
+		if p.offset >= len(p.data) {
+			p.syntaxError("unterminated string")
+		}
+		c := p.data[p.offset]
+		p.offset++
+		switch {
+		case c == '"':
+			return string(buf)
+		case c < 0x20:
+			p.offset--
+			p.syntaxError("control character in string")
+		case c != '\\':
+			buf = append(buf, c)
+			continue
+		}
+		if p.offset >= len(p.data) {
+			p.syntaxError("unterminated string")
+		}
+		c = p.data[p.offset]
+		p.offset++
+		switch c {
+		case '"', '\\', '/':
+			buf = append(buf, c)
+		case 'b':
+			buf = append(buf, '\b')
+		case 'f':
+			buf = append(buf, '\f')
+		case 'n':
+			buf = append(buf, '\n')
+		case 'r':
+			buf = append(buf, '\r')
+		case 't':
+			buf = append(buf, '\t')
+		case 'u':
+			r := p.parseHex4()
+			if 0xd800 <= r && r < 0xdc00 && bytes.HasPrefix(p.data[p.offset:], []byte(`\u`)) {
+				p.offset += 2
+				if r2 := p.parseHex4(); 0xdc00 <= r2 && r2 < 0xe000 {
+					r = (r-0xd800)<<10 + (r2 - 0xdc00) + 0x10000
+				} else {
+					p.offset -= 6
+					r = utf8.RuneError
+				}
+			}
+			var rb [utf8.UTFMax]byte
+			buf = append(buf, rb[:utf8.EncodeRune(rb[:], r)]...)
+		default:
+			p.offset--
+			p.syntaxError("invalid escape")
+		}
+	}
+	panic("unreachable")
+}
+
+func (p *extJSONParser) parseHex4() int {
+	if p.offset+4 > len(p.data) {
+		p.syntaxError("invalid unicode escape")
+	}
+	r, err := strconv.Btoui64(string(p.data[p.offset:p.offset+4]), 16)
+	if err != nil {
+		p.syntaxError("invalid unicode escape")
+	}
+	p.offset += 4
+	return int(r)
+}
+
+// extJSONTypeKeys lists the keys that identify type wrapper objects and the
+// keys allowed with them.
+var extJSONTypeKeys = map[string][]string{
+	"$oid":               {"$oid"},
+	"$symbol":            {"$symbol"},
+	"$numberInt":         {"$numberInt"},
+	"$numberLong":        {"$numberLong"},
+	"$numberDouble":      {"$numberDouble"},
+	"$numberDecimal":     {"$numberDecimal"},
+	"$binary":            {"$binary", "$type"},
+	"$code":              {"$code", "$scope"},
+	"$timestamp":         {"$timestamp"},
+	"$regularExpression": {"$regularExpression"},
+	"$regex":             {"$regex", "$options"},
+	"$date":              {"$date"},
+	"$minKey":            {"$minKey"},
+	"$maxKey":            {"$maxKey"},
+	"$undefined":         {"$undefined"},
+	"$dbPointer":         {"$dbPointer"},
+}
+
+// extJSONType returns the type key of a type wrapper object or "" if the
+// object is a plain document.
+func extJSONType(v *extJSONValue) string {
+	var key string
+	for _, k := range v.keys {
+		if _, ok := extJSONTypeKeys[k]; ok {
+			key = k
+			break
+		}
+	}
+	switch key {
+	case "":
+		return ""
+	case "$regex":
+		// {"$regex": {"$regularExpression": ...}} is a query operator.
+		if v.member(key).kind != jsonString {
+			return ""
+		}
+	}
+	allowed := extJSONTypeKeys[key]
+	for _, k := range v.keys {
+		ok := false
+		for _, a := range allowed {
+			ok = ok || k == a
+		}
+		if !ok {
+			abort(os.NewError("bson: invalid key " + strconv.Quote(k) + " in extended JSON " + key))
+		}
+	}
+	return key
+}
+
+func extJSONError(key string) {
+	abort(os.NewError("bson: invalid extended JSON " + key))
+}
+
+// stringMember returns the string value of key in object v.
+func (v *extJSONValue) stringMember(key, typeKey string) string {
+	m := v.member(key)
+	if m == nil || m.kind != jsonString {
+		extJSONError(typeKey)
+	}
+	return m.s
+}
+
+// uint32Member returns the value of key in object v as an unsigned 32 bit
+// integer.
+func (v *extJSONValue) uint32Member(key, typeKey string) uint64 {
+	m := v.member(key)
+	if m == nil || m.kind != jsonNumber {
+		extJSONError(typeKey)
+	}
+	n, err := strconv.Atoui64(m.s)
+	if err != nil || n > math.MaxUint32 {
+		extJSONError(typeKey)
+	}
+	return n
+}
+
+// writeExtJSON writes the BSON encoding of v and returns the kind.
+func (e *encodeState) writeExtJSON(v *extJSONValue) int {
+	switch v.kind {
+	case jsonNull:
+		return kindNull
+	case jsonBool:
+		if v.s != "" {
+			e.WriteByte(1)
+		} else {
+			e.WriteByte(0)
+		}
+		return kindBool
+	case jsonString:
+		e.writeExtJSONString(v.s)
+		return kindString
+	case jsonNumber:
+		if strings.IndexAny(v.s, ".eE") < 0 {
+			n, err := strconv.Atoi64(v.s)
+			if err == nil {
+				if n >= math.MinInt32 && n <= math.MaxInt32 {
+					e.WriteUint32(uint32(n))
+					return kindInt32
+				}
+				e.WriteUint64(uint64(n))
+				return kindInt64
+			}
+		}
+		f, err := strconv.Atof64(v.s)
+		if err != nil {
+			abort(os.NewError("bson: invalid number " + v.s))
+		}
+		e.WriteUint64(math.Float64bits(f))
+		return kindFloat
+	case jsonArray:
+		offset := e.beginDoc()
+		for i, item := range v.values {
+			e.writeExtJSONElement(strconv.Itoa(i), item)
+		}
+		e.WriteByte(0)
+		e.endDoc(offset)
+		return kindArray
+	}
+
+	key := extJSONType(v)
+	if key == "" {
+		e.writeExtJSONDoc(v)
+		return kindDocument
+	}
+	x := v.member(key)
+	switch key {
+	case "$oid":
+		b, err := hex.DecodeString(v.stringMember(key, key))
+		if err != nil || len(b) != 12 {
+			extJSONError(key)
+		}
+		e.Write(b)
+		return kindObjectId
+	case "$symbol":
+		e.writeExtJSONString(v.stringMember(key, key))
+		return kindSymbol
+	case "$numberInt":
+		n, err := strconv.Atoi64(v.stringMember(key, key))
+		if err != nil || n < math.MinInt32 || n > math.MaxInt32 {
+			extJSONError(key)
+		}
+		e.WriteUint32(uint32(n))
+		return kindInt32
+	case "$numberLong":
+		n, err := strconv.Atoi64(v.stringMember(key, key))
+		if err != nil {
+			extJSONError(key)
+		}
+		e.WriteUint64(uint64(n))
+		return kindInt64
+	case "$numberDouble":
+		var f float64
+		switch s := v.stringMember(key, key); s {
+		case "Infinity":
+			f = math.Inf(1)
+		case "-Infinity":
+			f = math.Inf(-1)
+		case "NaN":
+			f = math.NaN()
+		default:
+			var err os.Error
+			f, err = strconv.Atof64(s)
+			if err != nil {
+				extJSONError(key)
+			}
+		}
+		e.WriteUint64(math.Float64bits(f))
+		return kindFloat
+	case "$numberDecimal":
+		d, err := ParseDecimal128(v.stringMember(key, key))
+		if err != nil {
+			abort(err)
+		}
+		e.WriteUint64(d.l)
+		e.WriteUint64(d.h)
+		return kindDecimal128
+	case "$binary":
+		var data, subtype string
+		if x.kind == jsonString {
+			// Legacy form: {"$binary": <base64>, "$type": <hex>}
+			data = x.s
+			subtype = v.stringMember("$type", key)
+		} else if x.kind == jsonObject && len(x.keys) == 2 {
+			data = x.stringMember("base64", key)
+			subtype = x.stringMember("subType", key)
+		} else {
+			extJSONError(key)
+		}
+		b, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			extJSONError(key)
+		}
+		st, err := strconv.Btoui64(subtype, 16)
+		if err != nil || len(subtype) > 2 {
+			extJSONError(key)
+		}
+		if byte(st) == binaryOld {
+			e.WriteUint32(uint32(len(b) + 4))
+			e.WriteByte(byte(st))
+			e.WriteUint32(uint32(len(b)))
+		} else {
+			e.WriteUint32(uint32(len(b)))
+			e.WriteByte(byte(st))
+		}
+		e.Write(b)
+		return kindBinary
+	case "$code":
+		code := v.stringMember(key, key)
+		scope := v.member("$scope")
+		if scope == nil {
+			e.writeExtJSONString(code)
+			return kindCode
+		}
+		if scope.kind != jsonObject || extJSONType(scope) != "" {
+			extJSONError("$scope")
+		}
+		offset := e.beginDoc()
+		e.writeExtJSONString(code)
+		e.writeExtJSONDoc(scope)
+		e.endDoc(offset)
+		return kindCodeWithScope
+	case "$timestamp":
+		if x.kind != jsonObject || len(x.keys) != 2 {
+			extJSONError(key)
+		}
+		t := x.uint32Member("t", key)
+		i := x.uint32Member("i", key)
+		e.WriteUint64(t<<32 | i)
+		return kindTimestamp
+	case "$regularExpression", "$regex":
+		var pattern, options string
+		if key == "$regex" {
+			pattern = x.s
+			if o := v.member("$options"); o != nil {
+				options = v.stringMember("$options", key)
+			}
+		} else {
+			if x.kind != jsonObject || len(x.keys) != 2 {
+				extJSONError(key)
+			}
+			pattern = x.stringMember("pattern", key)
+			options = x.stringMember("options", key)
+		}
+		e.WriteCString(pattern)
+		e.WriteCString(sortOptions(options))
+		return kindRegexp
+	case "$date":
+		var ms int64
+		var err os.Error
+		switch x.kind {
+		case jsonString:
+			ms, err = parseExtJSONDate(x.s)
+		case jsonObject:
+			if len(x.keys) != 1 {
+				extJSONError(key)
+			}
+			ms, err = strconv.Atoi64(x.stringMember("$numberLong", key))
+		case jsonNumber:
+			ms, err = strconv.Atoi64(x.s)
+		default:
+			extJSONError(key)
+		}
+		if err != nil {
+			extJSONError(key)
+		}
+		e.WriteUint64(uint64(ms))
+		return kindDateTime
+	case "$undefined":
+		if x.kind != jsonBool || x.s == "" {
+			extJSONError(key)
+		}
+		return kindUndefined
+	case "$dbPointer":
+		if x.kind != jsonObject || len(x.keys) != 2 {
+			extJSONError(key)
+		}
+		id := x.member("$id")
+		if id == nil || id.kind != jsonObject || extJSONType(id) != "$oid" {
+			extJSONError(key)
+		}
+		e.writeExtJSONString(x.stringMember("$ref", key))
+		if e.writeExtJSON(id) != kindObjectId {
+			extJSONError(key)
+		}
+		return kindDBPointer
+	case "$minKey", "$maxKey":
+		if x.kind != jsonNumber || x.s != "1" {
+			extJSONError(key)
+		}
+		if key == "$minKey" {
+			return kindMinValue
+		}
+		return kindMaxValue
+	}
+	panic("unreachable")
+}
+
+func (e *encodeState) writeExtJSONDoc(v *extJSONValue) {
+	offset := e.beginDoc()
+	for i, k := range v.keys {
+		e.writeExtJSONElement(k, v.values[i])
+	}
+	e.WriteByte(0)
+	e.endDoc(offset)
+}
+
+func (e *encodeState) writeExtJSONElement(name string, v *extJSONValue) {
+	if strings.Index(name, "\x00") >= 0 {
+		abort(os.NewError("bson: key " + strconv.Quote(name) + " contains null byte"))
+	}
+	offset := len(e.buffer)
+	e.writeKindName(0, name)
+	e.buffer[offset] = byte(e.writeExtJSON(v))
+}
+
+func (e *encodeState) writeExtJSONString(s string) {
+	e.WriteUint32(uint32(len(s) + 1))
+	e.Write([]byte(s))
+	e.WriteByte(0)
+}
+
+// parseExtJSONDate parses an ISO-8601 datetime with an optional fraction of a
+// second and a time zone of Z, +hh:mm, +hhmm or -hh:mm, -hhmm.
+func parseExtJSONDate(s string) (int64, os.Error) {
+	errBad := os.NewError("bson: invalid ISO-8601 date " + strconv.Quote(s))
+	num := func(i, n int) int {
+		if i+n > len(s) {
+			return -1
+		}
+		v := 0
+		for ; n > 0; i, n = i+1, n-1 {
+			if s[i] < '0' || s[i] > '9' {
+				return -1
+			}
+			v = v*10 + int(s[i]-'0')
+		}
+		return v
+	}
+	if len(s) < 20 || s[4] != '-' || s[7] != '-' || s[10] != 'T' || s[13] != ':' || s[16] != ':' {
+		return 0, errBad
+	}
+	t := &time.Time{Year: int64(num(0, 4)), Month: num(5, 2), Day: num(8, 2), Hour: num(11, 2), Minute: num(14, 2), Second: num(17, 2)}
+	if t.Year < 0 || t.Month < 1 || t.Month > 12 || t.Day < 1 || t.Day > 31 ||
+		t.Hour < 0 || t.Hour > 23 || t.Minute < 0 || t.Minute > 59 || t.Second < 0 || t.Second > 60 {
+		return 0, errBad
+	}
+	i := 19
+	var ms int64
+	if s[i] == '.' {
+		i++
+		scale := int64(100)
+		for ; i < len(s) && '0' <= s[i] && s[i] <= '9'; i++ {
+			ms += int64(s[i]-'0') * scale
+			scale /= 10
+		}
+	}
+	var zh, zm int
+	switch {
+	case i == len(s)-1 && s[i] == 'Z':
+	case i+6 == len(s) && (s[i] == '+' || s[i] == '-') && s[i+3] == ':':
+		zh, zm = num(i+1, 2), num(i+4, 2)
+	case i+5 == len(s) && (s[i] == '+' || s[i] == '-'):
+		zh, zm = num(i+1, 2), num(i+3, 2)
+	default:
+		return 0, errBad
+	}
+	if zh < 0 || zm < 0 {
+		return 0, errBad
+	}
+	t.ZoneOffset = (zh*60 + zm) * 60
+	if s[i] == '-' {
+		t.ZoneOffset = -t.ZoneOffset
+	}
+	return t.Seconds()*1000 + ms, nil
+}
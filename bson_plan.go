@@ -0,0 +1,294 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package mongo
+
+import (
+	"reflect"
+)
+
+// The encoder and decoder compile the structInfo for a struct type to a plan
+// the first time the type is used. The plan resolves the encoding or decoding
+// for each field from the static type of the field so that the lookups in
+// encodeValue and decodeValue are not repeated for every value. Fields where
+// the encoding depends on the dynamic value use encodeValue or decodeValue.
+
+// structEncoderFunc encodes struct v as a BSON document.
+type structEncoderFunc func(e *encodeState, v reflect.Value)
+
+// fieldType returns the type of the nested field of t corresponding to index.
+func fieldType(t reflect.Type, index []int) reflect.Type {
+	for i, x := range index {
+		if i > 0 && t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		t = t.Field(x).Type
+	}
+	return t
+}
+
+func (enc *Encoder) resetPlans() {
+	enc.planMutex.Lock()
+	enc.structEncoders = make(map[reflect.Type]structEncoderFunc)
+	enc.planMutex.Unlock()
+}
+
+// structEncoder returns the encoding for struct type t.
+func (enc *Encoder) structEncoder(t reflect.Type) structEncoderFunc {
+	enc.planMutex.RLock()
+	f := enc.structEncoders[t]
+	enc.planMutex.RUnlock()
+	if f != nil {
+		return f
+	}
+	f = enc.compileStructEncoder(t)
+	enc.planMutex.Lock()
+	enc.structEncoders[t] = f
+	enc.planMutex.Unlock()
+	return f
+}
+
+func (enc *Encoder) compileStructEncoder(t reflect.Type) structEncoderFunc {
+	si, err := structInfoForType(t)
+	if err != nil {
+		return func(e *encodeState, v reflect.Value) { abort(err) }
+	}
+	fields := make([]structEncoderFunc, len(si.l))
+	for i, fi := range si.l {
+		fi := fi
+		encode := enc.encoderForType(fieldType(t, fi.index))
+		if len(fi.index) == 1 && !fi.omitEmpty {
+			x := fi.index[0]
+			fields[i] = func(e *encodeState, v reflect.Value) {
+				encode(e, fi.name, fi, v.Field(x))
+			}
+		} else {
+			fields[i] = func(e *encodeState, v reflect.Value) {
+				fv, ok := fieldByIndex(v, fi.index, false)
+				if !ok || (fi.omitEmpty && isEmptyValue(fv)) {
+					return
+				}
+				encode(e, fi.name, fi, fv)
+			}
+		}
+	}
+	return func(e *encodeState, v reflect.Value) {
+		offset := e.beginDoc()
+		for _, f := range fields {
+			f(e, v)
+		}
+		if si.extra != nil {
+			e.writeExtras(si, v)
+		}
+		e.WriteByte(0)
+		e.endDoc(offset)
+	}
+}
+
+// encoderForType returns the encoding for values with static type t.
+func (enc *Encoder) encoderForType(t reflect.Type) encoderFunc {
+	if f, found := enc.typeEncoder[t]; found {
+		return f
+	}
+	if t.Implements(typeMarshaler) || reflect.PtrTo(t).Implements(typeMarshaler) {
+		// Whether the Marshaler is used depends on the value.
+		return encodeDynamic
+	}
+	if f, found := enc.kindEncoder[t.Kind()]; found {
+		return f
+	}
+	return func(e *encodeState, name string, fi *fieldInfo, v reflect.Value) {
+		abort(&EncodeTypeError{t})
+	}
+}
+
+func encodeDynamic(e *encodeState, name string, fi *fieldInfo, v reflect.Value) {
+	e.encodeValue(name, fi, v)
+}
+
+// structDecoder decodes BSON documents to a struct type.
+type structDecoder struct {
+	t         reflect.Type
+	si        *structInfo
+	fields    []*fieldDecoder
+	m         map[string]*fieldDecoder
+	nRequired int
+}
+
+type fieldDecoder struct {
+	fi *fieldInfo
+
+	// Position of the field in structDecoder.fields.
+	position int
+
+	// Position of the field in the required fields or -1 if the field is not
+	// required.
+	required int
+
+	// decode decodes the value to the field of struct v.
+	decode decoderFunc
+}
+
+func (dec *Decoder) resetPlans() {
+	dec.planMutex.Lock()
+	dec.structDecoders = make(map[reflect.Type]*structDecoder)
+	dec.planMutex.Unlock()
+}
+
+// structDecoder returns the decoding for struct type t.
+func (dec *Decoder) structDecoder(t reflect.Type) *structDecoder {
+	dec.planMutex.RLock()
+	sd := dec.structDecoders[t]
+	dec.planMutex.RUnlock()
+	if sd != nil {
+		return sd
+	}
+	sd = dec.compileStructDecoder(t)
+	dec.planMutex.Lock()
+	dec.structDecoders[t] = sd
+	dec.planMutex.Unlock()
+	return sd
+}
+
+func (dec *Decoder) compileStructDecoder(t reflect.Type) *structDecoder {
+	si, err := structInfoForType(t)
+	sd := &structDecoder{t: t, si: si}
+	if err != nil {
+		return sd
+	}
+	sd.fields = make([]*fieldDecoder, len(si.l))
+	sd.m = make(map[string]*fieldDecoder, len(si.l))
+	for i, fi := range si.l {
+		fd := &fieldDecoder{fi: fi, position: i, required: -1}
+		if fi.required {
+			fd.required = sd.nRequired
+			sd.nRequired++
+		}
+		decode := dec.decoderForType(fieldType(t, fi.index))
+		if len(fi.index) == 1 {
+			x := fi.index[0]
+			fd.decode = func(d *decodeState, kind int, v reflect.Value) {
+				decode(d, kind, v.Field(x))
+			}
+		} else {
+			index := fi.index
+			fd.decode = func(d *decodeState, kind int, v reflect.Value) {
+				fv, _ := fieldByIndex(v, index, true)
+				decode(d, kind, fv)
+			}
+		}
+		sd.fields[i] = fd
+		sd.m[fi.name] = fd
+	}
+	return sd
+}
+
+// decoderForType returns the decoding for values with static type t.
+func (dec *Decoder) decoderForType(t reflect.Type) decoderFunc {
+	if f, found := dec.typeDecoder[t]; found {
+		return f
+	}
+	if t.Kind() == reflect.Ptr || t.Implements(typeUnmarshaler) || reflect.PtrTo(t).Implements(typeUnmarshaler) {
+		// Pointers are allocated as needed and the Unmarshaler is found by
+		// decodeValue.
+		return decodeDynamic
+	}
+	if f, found := dec.kindDecoder[t.Kind()]; found {
+		return f
+	}
+	return func(d *decodeState, kind int, v reflect.Value) {
+		d.saveErrorAndSkip(kind, t)
+	}
+}
+
+func decodeDynamic(d *decodeState, kind int, v reflect.Value) {
+	d.decodeValue(kind, v)
+}
+
+func (sd *structDecoder) decode(d *decodeState, v reflect.Value) {
+	if sd.si.err != nil {
+		abort(sd.si.err)
+	}
+	var seen []bool
+	if sd.nRequired > 0 {
+		seen = make([]bool, sd.nRequired)
+	}
+	var extra reflect.Value
+	var extraD D
+	next := 0
+	offset := d.beginDoc()
+	for {
+		kind, name := d.scanKindName()
+		if kind == 0 {
+			break
+		}
+		// Documents usually have the fields in the order of the struct.
+		// Check the next field before looking up the name in the map.
+		var fd *fieldDecoder
+		if next < len(sd.fields) && bytesEqualString(name, sd.fields[next].fi.name) {
+			fd = sd.fields[next]
+		} else {
+			fd = sd.m[string(name)]
+		}
+		switch {
+		case fd != nil:
+			next = fd.position + 1
+			if fd.required >= 0 {
+				seen[fd.required] = true
+			}
+			if kind == kindNull {
+				continue
+			}
+			d.pushName(fd.fi.name)
+			fd.decode(d, kind, v)
+			d.popName()
+		case sd.si.extra != nil:
+			// Collect unmatched elements, including nulls, in the
+			// inline map or D.
+			if !extra.IsValid() {
+				extra, _ = fieldByIndex(v, sd.si.extra, true)
+				if extra.Kind() == reflect.Map && extra.IsNil() {
+					extra.Set(reflect.MakeMap(extra.Type()))
+				}
+			}
+			if extra.Kind() == reflect.Map {
+				subv := reflect.New(extra.Type().Elem()).Elem()
+				if kind != kindNull {
+					d.decodeElement(name, kind, subv)
+				}
+				extra.SetMapIndex(reflect.ValueOf(string(name)), subv)
+			} else {
+				extraD.Append(string(name), d.decodeValueOrdered(kind))
+			}
+		case d.disallowUnknown:
+			d.pushName(string(name))
+			d.skipValue(kind)
+			d.saveError(&DecodeUnknownFieldError{sd.t, string(name)})
+			d.popName()
+		default:
+			d.skipValue(kind)
+		}
+	}
+	d.endDoc(offset)
+	if extraD != nil {
+		extra.Set(reflect.ValueOf(extraD))
+	}
+	for _, fd := range sd.fields {
+		if fd.required >= 0 && !seen[fd.required] {
+			d.pushName(fd.fi.name)
+			d.saveError(&DecodeRequiredError{sd.t, fd.fi.name})
+			d.popName()
+		}
+	}
+}
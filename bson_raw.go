@@ -0,0 +1,237 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package mongo
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Raw is the encoded form of a BSON document. The methods on Raw inspect the
+// document in place without decoding it to Go values.
+//
+// Decoding a document to a Raw copies the encoded bytes. Encoding a Raw writes
+// the bytes as an embedded document. A nil Raw is omitted from the encoding.
+// Use BSONData to hold an encoded array.
+type Raw []byte
+
+// RawElement is an element of a Raw document. The value references the bytes
+// of the document.
+type RawElement struct {
+	Name  string
+	Value BSONData
+}
+
+// Lookup returns the value at the dotted path in the document. Array elements
+// are selected with their index as in "a.b.0.c". Lookup returns BSONData with
+// Kind equal to zero if the path is not found or the document is malformed.
+// The data in the returned value references the bytes of r.
+func (r Raw) Lookup(path string) BSONData {
+	bd := BSONData{Kind: kindDocument, Data: r}
+	for len(path) > 0 {
+		var name string
+		if i := strings.Index(path, "."); i >= 0 {
+			name, path = path[:i], path[i+1:]
+		} else {
+			name, path = path, ""
+		}
+		if bd.Kind != kindDocument && bd.Kind != kindArray {
+			return BSONData{}
+		}
+		var err os.Error
+		bd, err = rawLookup(bd.Data, name)
+		if err != nil {
+			return BSONData{}
+		}
+	}
+	return bd
+}
+
+// rawLookup returns the value of the element with the given name.
+func rawLookup(data []byte, name string) (bd BSONData, err os.Error) {
+	defer handleAbort(&err)
+	d := decodeState{data: data}
+	offset := d.beginDoc()
+	for {
+		kind, p := d.scanKindName()
+		if kind == 0 {
+			break
+		}
+		start := d.offset
+		d.skipValue(kind)
+		if bytesEqualString(p, name) {
+			return BSONData{Kind: kind, Data: d.data[start:d.offset]}, nil
+		}
+	}
+	d.endDoc(offset)
+	return BSONData{}, nil
+}
+
+func bytesEqualString(p []byte, s string) bool {
+	if len(p) != len(s) {
+		return false
+	}
+	for i, b := range p {
+		if b != s[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Elements returns the elements of the document in order. The values
+// reference the bytes of r.
+func (r Raw) Elements() (elements []RawElement, err os.Error) {
+	defer handleAbort(&err)
+	d := decodeState{data: r}
+	offset := d.beginDoc()
+	for {
+		kind, name := d.scanKindName()
+		if kind == 0 {
+			break
+		}
+		start := d.offset
+		d.skipValue(kind)
+		elements = append(elements, RawElement{string(name), BSONData{Kind: kind, Data: d.data[start:d.offset]}})
+	}
+	d.endDoc(offset)
+	return elements, nil
+}
+
+// String returns a representation of the document for debugging.
+func (r Raw) String() string {
+	var buf bytes.Buffer
+	r.format(&buf, kindDocument)
+	return buf.String()
+}
+
+func (r Raw) format(buf *bytes.Buffer, kind int) {
+	elements, err := r.Elements()
+	if err != nil {
+		fmt.Fprintf(buf, "<%v>", err)
+		return
+	}
+	if kind == kindArray {
+		buf.WriteByte('[')
+	} else {
+		buf.WriteByte('{')
+	}
+	for i, e := range elements {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		if kind != kindArray {
+			buf.WriteString(e.Name)
+			buf.WriteString(": ")
+		}
+		switch e.Value.Kind {
+		case kindDocument, kindArray:
+			Raw(e.Value.Data).format(buf, e.Value.Kind)
+		default:
+			var v interface{}
+			if err := e.Value.Decode(&v); err != nil {
+				fmt.Fprintf(buf, "<%v>", err)
+			} else {
+				fmt.Fprintf(buf, "%#v", v)
+			}
+		}
+	}
+	if kind == kindArray {
+		buf.WriteByte(']')
+	} else {
+		buf.WriteByte('}')
+	}
+}
+
+// scan calls f with a decodeState positioned at the start of the value if the
+// value has the given kind. Scan returns false if the kind does not match or
+// the value is malformed.
+func (bd BSONData) scan(kind int, f func(d *decodeState)) bool {
+	if bd.Kind != kind {
+		return false
+	}
+	d := decodeState{data: bd.Data}
+	if err := d.try(f); err != nil {
+		return false
+	}
+	return d.offset == len(d.data)
+}
+
+func (d *decodeState) try(f func(d *decodeState)) (err os.Error) {
+	defer handleAbort(&err)
+	f(d)
+	return nil
+}
+
+// StringOK returns the value and true if the value is a BSON string.
+func (bd BSONData) StringOK() (s string, ok bool) {
+	ok = bd.scan(kindString, func(d *decodeState) { s = d.scanString() })
+	return
+}
+
+// Int32OK returns the value and true if the value is a BSON 32 bit integer.
+func (bd BSONData) Int32OK() (i int32, ok bool) {
+	ok = bd.scan(kindInt32, func(d *decodeState) { i = d.scanInt32() })
+	return
+}
+
+// Int64OK returns the value and true if the value is a BSON 64 bit integer.
+func (bd BSONData) Int64OK() (i int64, ok bool) {
+	ok = bd.scan(kindInt64, func(d *decodeState) { i = d.scanInt64() })
+	return
+}
+
+// FloatOK returns the value and true if the value is a BSON float.
+func (bd BSONData) FloatOK() (f float64, ok bool) {
+	ok = bd.scan(kindFloat, func(d *decodeState) { f = d.scanFloat() })
+	return
+}
+
+// BoolOK returns the value and true if the value is a BSON boolean.
+func (bd BSONData) BoolOK() (b bool, ok bool) {
+	ok = bd.scan(kindBool, func(d *decodeState) { b = d.scanBool() })
+	return
+}
+
+// ObjectIdOK returns the value and true if the value is a BSON object id.
+func (bd BSONData) ObjectIdOK() (oid ObjectId, ok bool) {
+	ok = bd.scan(kindObjectId, func(d *decodeState) { oid = ObjectId(d.scanObjectId()) })
+	return
+}
+
+// DocumentOK returns the value and true if the value is a BSON document. The
+// returned document references bd.Data.
+func (bd BSONData) DocumentOK() (Raw, bool) {
+	if bd.Kind != kindDocument || !validRawLength(bd.Data) {
+		return nil, false
+	}
+	return Raw(bd.Data), true
+}
+
+// ArrayOK returns the value and true if the value is a BSON array. The
+// returned array references bd.Data and can be inspected with the methods on
+// Raw.
+func (bd BSONData) ArrayOK() (Raw, bool) {
+	if bd.Kind != kindArray || !validRawLength(bd.Data) {
+		return nil, false
+	}
+	return Raw(bd.Data), true
+}
+
+func validRawLength(p []byte) bool {
+	return len(p) >= 5 && int(wire.Uint32(p)) == len(p) && p[len(p)-1] == 0
+}
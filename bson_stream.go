@@ -0,0 +1,163 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package mongo
+
+import (
+	"io"
+	"os"
+	"strconv"
+)
+
+// DefaultMaxDocumentSize is the default maximum size of a document read by a
+// Reader.
+const DefaultMaxDocumentSize = 16 * 1024 * 1024
+
+// TruncatedError is returned by Reader when the stream ends in the middle of a
+// document.
+type TruncatedError struct {
+	// Offset of the start of the document in the stream.
+	Offset int64
+
+	// Number of bytes read and expected. Want is zero if the stream ended
+	// before the length of the document was read.
+	Got, Want int
+}
+
+func (e *TruncatedError) String() string {
+	s := "bson: truncated document at offset " + strconv.Itoa64(e.Offset) + ", read " + strconv.Itoa(e.Got)
+	if e.Want > 0 {
+		s += " of " + strconv.Itoa(e.Want)
+	}
+	return s + " bytes"
+}
+
+// DocumentSizeError is returned by Reader when the length of a document is
+// less than the minimum document size or greater than the maximum document
+// size.
+type DocumentSizeError struct {
+	// Offset of the start of the document in the stream.
+	Offset int64
+
+	// Size of the document and the maximum allowed size.
+	Size, Max int
+}
+
+func (e *DocumentSizeError) String() string {
+	return "bson: document at offset " + strconv.Itoa64(e.Offset) + " has invalid size " + strconv.Itoa(e.Size) +
+		" (max " + strconv.Itoa(e.Max) + ")"
+}
+
+// Reader reads successive BSON documents from a stream such as a file created
+// by mongodump.
+type Reader struct {
+	// Documents larger than MaxDocumentSize are rejected with a
+	// DocumentSizeError. NewReader sets MaxDocumentSize to
+	// DefaultMaxDocumentSize.
+	MaxDocumentSize int
+
+	r      io.Reader
+	buf    []byte
+	offset int64
+	err    os.Error
+}
+
+// NewReader returns a reader that reads documents from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r, MaxDocumentSize: DefaultMaxDocumentSize}
+}
+
+// Read reads the next document from the stream. Read returns EOF when there
+// are no more documents. The document data is valid until the next call to
+// Read. Once Read returns an error, all subsequent calls return the same
+// error.
+func (r *Reader) Read() (BSONData, os.Error) {
+	if r.err != nil {
+		return BSONData{}, r.err
+	}
+
+	if cap(r.buf) < 4 {
+		r.buf = make([]byte, 512)
+	}
+
+	n, err := io.ReadFull(r.r, r.buf[:4])
+	switch {
+	case n == 0 && err == os.EOF:
+		r.err = EOF
+		return BSONData{}, r.err
+	case err == io.ErrUnexpectedEOF:
+		r.err = &TruncatedError{Offset: r.offset, Got: n}
+		return BSONData{}, r.err
+	case err != nil:
+		r.err = err
+		return BSONData{}, r.err
+	}
+
+	size := int(int32(wire.Uint32(r.buf[:4])))
+	if size < 5 || size > r.MaxDocumentSize {
+		r.err = &DocumentSizeError{Offset: r.offset, Size: size, Max: r.MaxDocumentSize}
+		return BSONData{}, r.err
+	}
+
+	if cap(r.buf) < size {
+		buf := make([]byte, size)
+		copy(buf, r.buf[:4])
+		r.buf = buf
+	}
+	p := r.buf[:size]
+
+	n, err = io.ReadFull(r.r, p[4:])
+	switch {
+	case err == os.EOF || err == io.ErrUnexpectedEOF:
+		r.err = &TruncatedError{Offset: r.offset, Got: 4 + n, Want: size}
+		return BSONData{}, r.err
+	case err != nil:
+		r.err = err
+		return BSONData{}, r.err
+	}
+
+	if p[size-1] != 0 {
+		r.err = os.NewError("bson: document at offset " + strconv.Itoa64(r.offset) + " is not terminated")
+		return BSONData{}, r.err
+	}
+
+	r.offset += int64(size)
+	return BSONData{Kind: kindDocument, Data: p}, nil
+}
+
+// Writer writes successive BSON documents to a stream.
+type Writer struct {
+	w   io.Writer
+	buf []byte
+}
+
+// NewWriter returns a writer that writes documents to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Write encodes doc using Encode and writes the encoding to the underlying
+// writer with a single call to its Write method.
+func (w *Writer) Write(doc interface{}) os.Error {
+	buf, err := Encode(w.buf[:0], doc)
+	if err != nil {
+		return err
+	}
+	w.buf = buf
+	n, err := w.w.Write(buf)
+	if err == nil && n != len(buf) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
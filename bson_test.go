@@ -15,11 +15,18 @@
 package mongo
 
 import (
+	"big"
 	"bytes"
+	"encoding/hex"
+	"fmt"
 	"testing"
 	"reflect"
 	"time"
 	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 func testMap(value interface{}) map[string]interface{} {
@@ -48,6 +55,14 @@ type stBinary struct {
 	Test []byte "test/c"
 }
 
+type stBinarySubtype struct {
+	Test Binary "test/c"
+}
+
+type stDecimal128 struct {
+	Test Decimal128 "test/c"
+}
+
 type stObjectId struct {
 	Test ObjectId "test/c"
 }
@@ -108,10 +123,38 @@ type stInt64 struct {
 	Test int64 "test/c"
 }
 
+type stInt64MinSize struct {
+	Test int64 "test/minsize"
+}
+
+type stUint64MinSize struct {
+	Test uint64 "test/minsize"
+}
+
+type stSkip struct {
+	Skip int "-"
+	Test int "test"
+}
+
+type stOmitEmpty struct {
+	Slice  []int          "slice/omitempty"
+	Map    map[string]int "map/omitempty"
+	Ptr    *int           "ptr/omitempty"
+	String string         "string/omitempty"
+}
+
 type stDateTime struct {
 	Test DateTime "test/c"
 }
 
+type stTime struct {
+	Test time.Time "test/c"
+}
+
+type stTimePtr struct {
+	Test *time.Time "test/c"
+}
+
 type stTimestamp struct {
 	Test Timestamp "test/c"
 }
@@ -120,6 +163,10 @@ type stMinMax struct {
 	Test MinMax "test/c"
 }
 
+type stCode struct {
+	Test Code "test/c"
+}
+
 type stCodeWithScope struct {
 	Test CodeWithScope "test/c"
 }
@@ -161,6 +208,8 @@ var bsonTests = []struct {
 	{stAny{}, empty, empty, "\x05\x00\x00\x00\x00"},
 	{stDoc{}, empty, empty, "\x05\x00\x00\x00\x00"},
 	{stBinary{}, empty, empty, "\x05\x00\x00\x00\x00"},
+	{stBinarySubtype{}, empty, empty, "\x05\x00\x00\x00\x00"},
+	{stDecimal128{}, empty, empty, "\x05\x00\x00\x00\x00"},
 	{stObjectId{}, empty, empty, "\x05\x00\x00\x00\x00"},
 	{stBool{}, empty, empty, "\x05\x00\x00\x00\x00"},
 	{stSymbol{}, empty, empty, "\x05\x00\x00\x00\x00"},
@@ -176,10 +225,13 @@ var bsonTests = []struct {
 	{stUint64{}, empty, empty, "\x05\x00\x00\x00\x00"},
 	{stUint{}, empty, empty, "\x05\x00\x00\x00\x00"},
 	{stMinMax{}, empty, empty, "\x05\x00\x00\x00\x00"},
+	{stCode{}, empty, empty, "\x05\x00\x00\x00\x00"},
 	{stCodeWithScope{}, empty, empty, "\x05\x00\x00\x00\x00"},
 	{stRegexp{}, empty, empty, "\x05\x00\x00\x00\x00"},
 	{stTimestamp{}, empty, empty, "\x05\x00\x00\x00\x00"},
 	{stDateTime{}, empty, empty, "\x05\x00\x00\x00\x00"},
+	{stTime{}, empty, empty, "\x05\x00\x00\x00\x00"},
+	{stTimePtr{}, empty, empty, "\x05\x00\x00\x00\x00"},
 
 	{
 		stEmpty{},
@@ -223,6 +275,36 @@ var bsonTests = []struct {
 		testMap([]byte("test")),
 		"\x14\x00\x00\x00\x05\x74\x65\x73\x74\x00\x04\x00\x00\x00\x00\x74\x65\x73\x74\x00",
 	},
+	{
+		stBinarySubtype{Binary{Subtype: 4, Data: []byte("test")}},
+		testMap(Binary{Subtype: 4, Data: []byte("test")}),
+		testMap(Binary{Subtype: 4, Data: []byte("test")}),
+		"\x14\x00\x00\x00\x05test\x00\x04\x00\x00\x00\x04test\x00",
+	},
+	{
+		stBinarySubtype{Binary{Subtype: 0x80, Data: []byte("test")}},
+		testMap(Binary{Subtype: 0x80, Data: []byte("test")}),
+		testMap(Binary{Subtype: 0x80, Data: []byte("test")}),
+		"\x14\x00\x00\x00\x05test\x00\x04\x00\x00\x00\x80test\x00",
+	},
+	{
+		stBinarySubtype{Binary{Subtype: 2, Data: []byte("test")}},
+		testMap(Binary{Subtype: 2, Data: []byte("test")}),
+		testMap(Binary{Subtype: 2, Data: []byte("test")}),
+		"\x18\x00\x00\x00\x05test\x00\x08\x00\x00\x00\x02\x04\x00\x00\x00test\x00",
+	},
+	{
+		stBinarySubtype{Binary{Subtype: 0, Data: []byte("test")}},
+		testMap(Binary{Subtype: 0, Data: []byte("test")}),
+		testMap([]byte("test")),
+		"\x14\x00\x00\x00\x05test\x00\x04\x00\x00\x00\x00test\x00",
+	},
+	{
+		stDecimal128{NewDecimal128(0x3040000000000000, 1)},
+		testMap(NewDecimal128(0x3040000000000000, 1)),
+		testMap(NewDecimal128(0x3040000000000000, 1)),
+		"\x1b\x00\x00\x00\x13test\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x40\x30\x00",
+	},
 	{
 		stObjectId{ObjectId("\x4C\x9B\x8F\xB4\xA3\x82\xAA\xFE\x17\xC8\x6E\x63")},
 		testMap(ObjectId("\x4C\x9B\x8F\xB4\xA3\x82\xAA\xFE\x17\xC8\x6E\x63")),
@@ -277,6 +359,36 @@ var bsonTests = []struct {
 		testMap(int64(256)),
 		"\x13\x00\x00\x00\x12test\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00",
 	},
+	{
+		stInt64MinSize{256},
+		testMap(256),
+		testMap(256),
+		"\x0f\x00\x00\x00\x10test\x00\x00\x01\x00\x00\x00",
+	},
+	{
+		stInt64MinSize{1 << 32},
+		testMap(int64(1 << 32)),
+		testMap(int64(1 << 32)),
+		"\x13\x00\x00\x00\x12test\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00",
+	},
+	{
+		stUint64MinSize{256},
+		testMap(256),
+		testMap(256),
+		"\x0f\x00\x00\x00\x10test\x00\x00\x01\x00\x00\x00",
+	},
+	{
+		stSkip{0, 256},
+		testMap(256),
+		testMap(256),
+		"\x0f\x00\x00\x00\x10test\x00\x00\x01\x00\x00\x00",
+	},
+	{
+		stOmitEmpty{Slice: []int{}, Map: map[string]int{}},
+		empty,
+		empty,
+		"\x05\x00\x00\x00\x00",
+	},
 	{
 		stInt{10},
 		testMap(10),
@@ -341,17 +453,31 @@ var bsonTests = []struct {
 	{
 		stRegexp{Regexp{"a*b", "i"}},
 		testMap(Regexp{"a*b", "i"}),
-		nil,
+		testMap(Regexp{"a*b", "i"}),
 		"\x11\x00\x00\x00\vtest\x00a*b\x00i\x00\x00",
 	},
 
 	{
 		stCodeWithScope{CodeWithScope{"test", nil}},
 		testMap(CodeWithScope{"test", nil}),
-		nil,
+		testMap(CodeWithScope{"test", nil}),
 		"\x1d\x00\x00\x00\x0ftest\x00\x12\x00\x00\x00\x05\x00\x00\x00test\x00\x05\x00\x00\x00\x00\x00",
 	},
 
+	{
+		stCodeWithScope{CodeWithScope{"x", map[string]interface{}{"x": 1}}},
+		testMap(CodeWithScope{"x", map[string]interface{}{"x": 1}}),
+		testMap(CodeWithScope{"x", map[string]interface{}{"x": 1}}),
+		"\x21\x00\x00\x00\x0ftest\x00\x16\x00\x00\x00\x02\x00\x00\x00x\x00\x0c\x00\x00\x00\x10x\x00\x01\x00\x00\x00\x00\x00",
+	},
+
+	{
+		stCode{Code("return 1;")},
+		testMap(Code("return 1;")),
+		testMap(Code("return 1;")),
+		"\x19\x00\x00\x00\x0dtest\x00\x0a\x00\x00\x00return 1;\x00\x00",
+	},
+
 	{
 		stTimestamp{1168216211000},
 		testMap(Timestamp(1168216211000)),
@@ -365,6 +491,18 @@ var bsonTests = []struct {
 		testMap(DateTime(1168216211000)),
 		"\x13\x00\x00\x00\ttest\x008\xbe\x1c\xff\x0f\x01\x00\x00\x00",
 	},
+	{
+		stTime{*DateTime(1168216211000).Time()},
+		testMap(DateTime(1168216211000)),
+		testMap(DateTime(1168216211000)),
+		"\x13\x00\x00\x00\ttest\x008\xbe\x1c\xff\x0f\x01\x00\x00\x00",
+	},
+	{
+		stTimePtr{DateTime(1168216211000).Time()},
+		testMap(DateTime(1168216211000)),
+		testMap(DateTime(1168216211000)),
+		"\x13\x00\x00\x00\ttest\x008\xbe\x1c\xff\x0f\x01\x00\x00\x00",
+	},
 
 	{
 		stStringSlice{[]string{}},
@@ -462,6 +600,15 @@ var decodeConversionTests = []struct {
 
 	{Symbol("hello"), stSymbol{"hello"}},
 	{Symbol("hello"), stString{"hello"}},
+
+	{Code("hello"), stString{"hello"}},
+
+	{Binary{Subtype: 4, Data: []byte("test")}, stBinary{[]byte("test")}},
+	{Binary{Subtype: 2, Data: []byte("test")}, stBinary{[]byte("test")}},
+	{[]byte("test"), stBinarySubtype{Binary{Subtype: 0, Data: []byte("test")}}},
+	{Code("hello"), stCodeWithScope{CodeWithScope{"hello", nil}}},
+	{int32(10), stDecimal128{NewDecimal128(0x3040000000000000, 10)}},
+	{int64(-10), stDecimal128{NewDecimal128(0xb040000000000000, 10)}},
 }
 
 func TestEncodeMap(t *testing.T) {
@@ -556,6 +703,27 @@ func TestDecodeConversions(t *testing.T) {
 	}
 }
 
+func TestDecodeSkip(t *testing.T) {
+	for _, bt := range bsonTests {
+		var v struct {
+			Other int "other"
+		}
+		data := []byte(bt.data)
+		if len(data) <= 5 {
+			continue
+		}
+		// Append an element after the skipped value to check the offset.
+		data = append(data[:len(data)-1], []byte("\x10other\x00\x07\x00\x00\x00\x00")...)
+		wire.PutUint32(data, uint32(len(data)))
+		err := Decode(data, &v)
+		if err != nil {
+			t.Errorf("Decode(%q) returned error %v", data, err)
+		} else if v.Other != 7 {
+			t.Errorf("Decode(%q) other = %d, want 7", data, v.Other)
+		}
+	}
+}
+
 func TestEncodeOrderedMap(t *testing.T) {
 	m := D{{"test", "hello world"}}
 	expected := []byte("\x1b\x00\x00\x00\x02test\x00\f\x00\x00\x00hello world\x00\x00")
@@ -580,6 +748,159 @@ func TestEncodeOrderedMapOld(t *testing.T) {
 	}
 }
 
+// decimal128Tests are from the canonical BSON corpus in the BSON decimal128
+// specification. The data is the document {"d": value}.
+var decimal128Tests = []struct {
+	s    string
+	data string
+}{
+	{"NaN", "180000001364000000000000000000000000000000007C00"},
+	{"Infinity", "180000001364000000000000000000000000000000007800"},
+	{"-Infinity", "18000000136400000000000000000000000000000000F800"},
+	{"0", "180000001364000000000000000000000000000000403000"},
+	{"-0", "18000000136400000000000000000000000000000040B000"},
+	{"1", "180000001364000100000000000000000000000000403000"},
+	{"-1", "18000000136400010000000000000000000000000040B000"},
+	{"0.1", "1800000013640001000000000000000000000000003E3000"},
+	{"0.001234", "18000000136400D204000000000000000000000000343000"},
+	{"1.234E-7", "18000000136400D2040000000000000000000000002C3000"},
+	{"-1.00E-8", "1800000013640064000000000000000000000000002CB000"},
+	{"1E+3", "180000001364000100000000000000000000000000463000"},
+	{"0E-7", "180000001364000000000000000000000000000000323000"},
+	{"0.000000", "180000001364000000000000000000000000000000343000"},
+	{"12345678901234567", "18000000136400874B6B5D54DC2B00000000000000403000"},
+	{"1234567890123456789012345678901234", "18000000136400F2AF967ED05C82DE3297FF6FDE3C403000"},
+	{"9.999999999999999999999999999999999E+6144", "18000000136400FFFFFFFF638E8D37C087ADBE09EDFF5F00"},
+	{"1E-6176", "180000001364000100000000000000000000000000000000"},
+	{"1.0E+6112", "180000001364000A00000000000000000000000000FE5F00"},
+	{"1.000000000000000000000000000000000E+39", "18000000136400000000000A5BC138938D44C64D314C3000"},
+	{"0E+6111", "180000001364000000000000000000000000000000FE5F00"},
+	{"0E-6176", "180000001364000000000000000000000000000000000000"},
+}
+
+func TestDecimal128(t *testing.T) {
+	for _, dt := range decimal128Tests {
+		data, err := hex.DecodeString(dt.data)
+		if err != nil {
+			t.Fatalf("bad test data %q", dt.data)
+		}
+
+		d, err := ParseDecimal128(dt.s)
+		if err != nil {
+			t.Errorf("ParseDecimal128(%q) returned error %v", dt.s, err)
+			continue
+		}
+		if s := d.String(); s != dt.s {
+			t.Errorf("ParseDecimal128(%q).String() = %q", dt.s, s)
+		}
+
+		actual, err := Encode(nil, D{{"d", d}})
+		if err != nil {
+			t.Errorf("Encode(%q) returned error %v", dt.s, err)
+		} else if !bytes.Equal(actual, data) {
+			t.Errorf("Encode(%q)\n  expected %q\n  actual   %q", dt.s, data, actual)
+		}
+
+		var v struct {
+			D Decimal128 "d"
+		}
+		err = Decode(data, &v)
+		if err != nil {
+			t.Errorf("Decode(%q) returned error %v", dt.data, err)
+		} else if s := v.D.String(); s != dt.s {
+			t.Errorf("Decode(%q) = %q, want %q", dt.data, s, dt.s)
+		}
+	}
+}
+
+var parseDecimal128Tests = []struct {
+	s        string
+	expected string
+}{
+	{"+1", "1"},
+	{"1E3", "1E+3"},
+	{"1e-0", "1"},
+	{".5", "0.5"},
+	{"5.", "5"},
+	{"-0.0", "-0.0"},
+	{"inf", "Infinity"},
+	{"-INFINITY", "-Infinity"},
+	{"-NaN", "NaN"},
+	{"1E+6112", "1.0E+6112"},
+	{"10E-6177", "1E-6176"},
+	{"0E-6177", "0E-6176"},
+	{"0E+9999", "0E+6111"},
+	{"1000000000000000000000000000000000000000", "1.000000000000000000000000000000000E+39"},
+
+	// Errors
+	{"", ""},
+	{".", ""},
+	{"-", ""},
+	{"+", ""},
+	{"-.", ""},
+	{"1e", ""},
+	{"E1", ""},
+	{"1.2.3", ""},
+	{"1e+", ""},
+	{"1e+-1", ""},
+	{"1x", ""},
+	{"12345678901234567890123456789012345", ""},
+	{"1E+6145", ""},
+	{"1E-6177", ""},
+}
+
+func TestParseDecimal128(t *testing.T) {
+	for _, pt := range parseDecimal128Tests {
+		d, err := ParseDecimal128(pt.s)
+		if pt.expected == "" {
+			if err == nil {
+				t.Errorf("ParseDecimal128(%q) = %q, want error", pt.s, d)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseDecimal128(%q) returned error %v", pt.s, err)
+		} else if s := d.String(); s != pt.expected {
+			t.Errorf("ParseDecimal128(%q) = %q, want %q", pt.s, s, pt.expected)
+		}
+	}
+}
+
+func TestDecimal128Big(t *testing.T) {
+	d, _ := ParseDecimal128("-12.345")
+	coefficient, exponent, err := d.BigInt()
+	if err != nil {
+		t.Fatalf("BigInt() returned error %v", err)
+	}
+	if coefficient.Cmp(big.NewInt(-12345)) != 0 || exponent != -3 {
+		t.Errorf("BigInt() = %s, %d, want -12345, -3", coefficient, exponent)
+	}
+	r, err := d.Rat()
+	if err != nil {
+		t.Fatalf("Rat() returned error %v", err)
+	}
+	if r.Cmp(big.NewRat(-2469, 200)) != 0 {
+		t.Errorf("Rat() = %s, want -2469/200", r)
+	}
+
+	d, err = NewDecimal128BigInt(big.NewInt(1234), 5)
+	if err != nil || d.String() != "1.234E+8" {
+		t.Errorf("NewDecimal128BigInt(1234, 5) = %q, %v, want 1.234E+8", d, err)
+	}
+	d, err = NewDecimal128Rat(big.NewRat(-3, 8))
+	if err != nil || d.String() != "-0.375" {
+		t.Errorf("NewDecimal128Rat(-3/8) = %q, %v, want -0.375", d, err)
+	}
+	if _, err = NewDecimal128Rat(big.NewRat(1, 3)); err == nil {
+		t.Errorf("NewDecimal128Rat(1/3) did not return error")
+	}
+
+	d, _ = ParseDecimal128("NaN")
+	if _, _, err = d.BigInt(); err == nil {
+		t.Errorf("NaN.BigInt() did not return error")
+	}
+}
+
 func TestObjectId(t *testing.T) {
 	t1 := time.Seconds()
 	min := MinObjectIdForTime(t1)
@@ -591,8 +912,8 @@ func TestObjectId(t *testing.T) {
 	if id > max {
 		t.Errorf("%q > %q", id, max)
 	}
-	if min.CreationTime() != t1 {
-		t.Errorf("min.CreationTime() = %d, want %d", min.CreationTime(), t1)
+	if ct := min.CreationTime(); ct == nil || ct.Seconds() != t1 {
+		t.Errorf("min.CreationTime() = %v, want %d", ct, t1)
 	}
 	id2, err := NewObjectIdHex(id.String())
 	if err != nil {
@@ -602,8 +923,81 @@ func TestObjectId(t *testing.T) {
 		t.Errorf("%q != %q", id2, id)
 	}
 	t2 := ObjectId("").CreationTime()
-	if t2 != 0 {
-		t.Error("creation time for invalid id = %d, want 0", t1)
+	if t2 != nil {
+		t.Errorf("creation time for invalid id = %v, want nil", t2)
+	}
+
+	id2 = NewObjectId()
+	if id2.Counter() != (id.Counter()+1)&0xffffff || id2[4:9] != id[4:9] {
+		t.Errorf("NewObjectId() = %s after %s, want same random value and next counter", id2, id)
+	}
+	if !id.Valid() || ObjectId("abc").Valid() || ObjectId("").Valid() {
+		t.Errorf("Valid() returned wrong result")
+	}
+	if id.Hex() != id.String() || len(id.Hex()) != 24 {
+		t.Errorf("Hex() = %s, want %s", id.Hex(), id.String())
+	}
+	for _, s := range []string{"", "4d88e15b60f486e428412dc", "4d88e15b60f486e428412dc9x", "4d88e15b60f486e428412dc9aa"} {
+		if IsObjectIdHex(s) {
+			t.Errorf("IsObjectIdHex(%q) = true, want false", s)
+		}
+	}
+	if !IsObjectIdHex("4d88e15b60f486e428412dc9") {
+		t.Errorf("IsObjectIdHex() = false, want true")
+	}
+}
+
+func TestObjectIdMarshal(t *testing.T) {
+	id, _ := NewObjectIdHex("4d88e15b60f486e428412dc9")
+	p, err := id.MarshalJSON()
+	if err != nil || string(p) != `"4d88e15b60f486e428412dc9"` {
+		t.Errorf("MarshalJSON() = %s, %v", p, err)
+	}
+	if p, err := ObjectId("").MarshalJSON(); err != nil || string(p) != "null" {
+		t.Errorf("MarshalJSON() of empty id = %s, %v, want null", p, err)
+	}
+	if _, err := ObjectId("abc").MarshalJSON(); err == nil {
+		t.Errorf("MarshalJSON() of invalid id did not return an error")
+	}
+	for _, s := range []string{`"4d88e15b60f486e428412dc9"`, ` {"$oid": "4d88e15b60f486e428412dc9"}`, `null`, `""`} {
+		var actual ObjectId = "x"
+		err := actual.UnmarshalJSON([]byte(s))
+		expected := id
+		if s == "null" || s == `""` {
+			expected = ""
+		}
+		if err != nil || actual != expected {
+			t.Errorf("UnmarshalJSON(%s) = %q, %v, want %q", s, actual, err, expected)
+		}
+	}
+	for _, s := range []string{`"4d88"`, `1`, `"4d88e15b60f486e428412dcz"`, `{"$oid": "4d88"}`} {
+		var actual ObjectId
+		if err := actual.UnmarshalJSON([]byte(s)); err == nil {
+			t.Errorf("UnmarshalJSON(%s) did not return an error", s)
+		}
+	}
+
+	p, err = id.MarshalText()
+	if err != nil || string(p) != "4d88e15b60f486e428412dc9" {
+		t.Errorf("MarshalText() = %s, %v", p, err)
+	}
+	var actual ObjectId
+	if err := actual.UnmarshalText(p); err != nil || actual != id {
+		t.Errorf("UnmarshalText(%s) = %q, %v, want %q", p, actual, err, id)
+	}
+	if err := actual.UnmarshalText([]byte("xyz")); err != ErrInvalidObjectId {
+		t.Errorf("UnmarshalText(xyz) returned %v, want ErrInvalidObjectId", err)
+	}
+
+	var n int
+	if _, err := fmt.Sscan("4d88e15b60f486e428412dc9 7", &actual, &n); err != nil || actual != id || n != 7 {
+		t.Errorf("Sscan() = %q, %d, %v, want %q, 7", actual, n, err, id)
+	}
+	if _, err := fmt.Sscanf("id=4D88E15B60F486E428412DC9", "id=%x", &actual); err != nil || actual != id {
+		t.Errorf("Sscanf() = %q, %v, want %q", actual, err, id)
+	}
+	if _, err := fmt.Sscan("4d88", &actual); err == nil {
+		t.Errorf("Sscan(4d88) did not return an error")
 	}
 }
 
@@ -667,3 +1061,1498 @@ func TestStructFields(t *testing.T) {
 		}
 	}
 }
+
+// testCents implements Marshaler with a value receiver and Unmarshaler with a
+// pointer receiver. The value is encoded as a BSON string.
+type testCents int64
+
+func (c testCents) MarshalBSON() (BSONData, os.Error) {
+	if c < 0 {
+		return BSONData{}, os.NewError("negative")
+	}
+	s := strconv.Itoa64(int64(c)/100) + "." + strconv.Itoa64(100+int64(c)%100)[1:]
+	n := len(s) + 1
+	return BSONData{kindString, []byte(string([]byte{byte(n), byte(n >> 8), byte(n >> 16), byte(n >> 24)}) + s + "\x00")}, nil
+}
+
+func (c *testCents) UnmarshalBSON(bd BSONData) os.Error {
+	var s string
+	if err := bd.Decode(&s); err != nil {
+		return err
+	}
+	parts := strings.Split(s, ".", 2)
+	n, err := strconv.Atoi64(parts[0] + parts[1])
+	if err != nil {
+		return err
+	}
+	*c = testCents(n)
+	return nil
+}
+
+// testColor implements both interfaces with pointer receivers. The value is
+// encoded as a BSON int32.
+type testColor struct {
+	name string
+}
+
+var testColorNames = []string{"red", "green", "blue"}
+
+func (c *testColor) MarshalBSON() (BSONData, os.Error) {
+	for i, name := range testColorNames {
+		if name == c.name {
+			return BSONData{kindInt32, []byte{byte(i), 0, 0, 0}}, nil
+		}
+	}
+	return BSONData{}, nil
+}
+
+func (c *testColor) UnmarshalBSON(bd BSONData) os.Error {
+	var i int
+	if err := bd.Decode(&i); err != nil {
+		return err
+	}
+	c.name = testColorNames[i]
+	return nil
+}
+
+type stMarshaler struct {
+	Price  testCents
+	Prices []testCents
+	Color  testColor
+	Colors []*testColor
+	Nested struct {
+		Price testCents
+	}
+}
+
+func TestMarshaler(t *testing.T) {
+	v := stMarshaler{
+		Price:  1234,
+		Prices: []testCents{1, 200},
+		Color:  testColor{"green"},
+		Colors: []*testColor{&testColor{"blue"}, nil},
+	}
+	v.Nested.Price = 5
+
+	expected, err := Encode(nil, D{
+		{"Price", "12.34"},
+		{"Prices", []interface{}{"0.01", "2.00"}},
+		{"Color", 1},
+		{"Colors", []interface{}{2}},
+		{"Nested", M{"Price": "0.05"}},
+	})
+	if err != nil {
+		t.Fatalf("Encode(expected) returned error %v", err)
+	}
+
+	actual, err := Encode(nil, &v)
+	if err != nil {
+		t.Fatalf("Encode(&v) returned error %v", err)
+	}
+	if !bytes.Equal(actual, expected) {
+		t.Errorf("Encode(&v)\n  expected %q\n  actual   %q", expected, actual)
+	}
+
+	var v2 stMarshaler
+	err = Decode(actual, &v2)
+	if err != nil {
+		t.Fatalf("Decode() returned error %v", err)
+	}
+	v.Colors = v.Colors[:1]
+	if !reflect.DeepEqual(v, v2) {
+		t.Errorf("Decode()\n  expected %+v\n  actual   %+v", v, v2)
+	}
+
+	data, _ := Encode(nil, M{"Price": "1.50"})
+	var m map[string]testCents
+	err = Decode(data, &m)
+	if err != nil {
+		t.Errorf("Decode(map) returned error %v", err)
+	} else if m["Price"] != 150 {
+		t.Errorf("Decode(map) Price = %d, want 150", m["Price"])
+	}
+
+	_, err = Encode(nil, M{"Price": testCents(-1)})
+	if _, ok := err.(*MarshalerError); !ok {
+		t.Errorf("Encode(negative) returned error %v, want MarshalerError", err)
+	}
+}
+
+type stRegistry struct {
+	N *big.Int
+	C complex128
+	P testCents
+}
+
+func TestEncoderDecoderRegistry(t *testing.T) {
+	enc := NewEncoder()
+	enc.RegisterType(reflect.TypeOf(&big.Int{}), func(v reflect.Value) (BSONData, os.Error) {
+		if v.IsNil() {
+			return BSONData{}, nil
+		}
+		data, err := Encode(nil, M{"": v.Interface().(*big.Int).String()})
+		if err != nil {
+			return BSONData{}, err
+		}
+		// Strip the document length, element kind, empty name and
+		// document terminator.
+		return BSONData{kindString, data[6 : len(data)-1]}, nil
+	})
+	enc.RegisterKind(reflect.Complex128, func(v reflect.Value) (BSONData, os.Error) {
+		c := v.Complex()
+		data, err := Encode(nil, M{"r": real(c), "i": imag(c)})
+		return BSONData{kindDocument, data}, err
+	})
+	enc.RegisterType(reflect.TypeOf(testCents(0)), func(v reflect.Value) (BSONData, os.Error) {
+		return BSONData{kindInt64, []byte{byte(v.Int()), 0, 0, 0, 0, 0, 0, 0}}, nil
+	})
+
+	dec := NewDecoder()
+	dec.RegisterType(reflect.TypeOf(&big.Int{}), func(bd BSONData, v reflect.Value) os.Error {
+		var s string
+		if err := bd.Decode(&s); err != nil {
+			return err
+		}
+		n, ok := new(big.Int).SetString(s, 10)
+		if !ok {
+			return os.NewError("bad int")
+		}
+		v.Set(reflect.ValueOf(n))
+		return nil
+	})
+	dec.RegisterKind(reflect.Complex128, func(bd BSONData, v reflect.Value) os.Error {
+		var c struct {
+			R float64 "r"
+			I float64 "i"
+		}
+		if err := bd.Decode(&c); err != nil {
+			return err
+		}
+		v.SetComplex(complex(c.R, c.I))
+		return nil
+	})
+	dec.RegisterType(reflect.TypeOf(testCents(0)), func(bd BSONData, v reflect.Value) os.Error {
+		var n int64
+		err := bd.Decode(&n)
+		v.SetInt(n)
+		return err
+	})
+
+	n, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	v := stRegistry{N: n, C: complex(1, 2), P: 150}
+
+	if _, err := Encode(nil, &v); err == nil {
+		t.Errorf("Encode with default encoder did not return error for complex128")
+	}
+
+	data, err := enc.Encode(nil, &v)
+	if err != nil {
+		t.Fatalf("enc.Encode() returned error %v", err)
+	}
+	expected, _ := Encode(nil, D{
+		{"N", "123456789012345678901234567890"},
+		{"C", D{{"r", 1.0}, {"i", 2.0}}},
+		{"P", int64(150)},
+	})
+	var m1, m2 M
+	Decode(data, &m1)
+	Decode(expected, &m2)
+	if !reflect.DeepEqual(m1, m2) {
+		t.Errorf("enc.Encode() = %v, want %v", m1, m2)
+	}
+
+	var v2 stRegistry
+	err = dec.Decode(data, &v2)
+	if err != nil {
+		t.Fatalf("dec.Decode() returned error %v", err)
+	}
+	if v2.N == nil || v2.N.Cmp(v.N) != 0 || v2.C != v.C || v2.P != v.P {
+		t.Errorf("dec.Decode() = %+v, want %+v", v2, v)
+	}
+}
+
+var dateTimeTests = []struct {
+	t  *time.Time
+	dt DateTime
+}{
+	{&time.Time{Year: 2007, Month: 1, Day: 8, Hour: 0, Minute: 30, Second: 11, Zone: "UTC"}, 1168216211000},
+	{&time.Time{Year: 1970, Month: 1, Day: 1, Zone: "UTC"}, 0},
+	{&time.Time{Year: 1969, Month: 12, Day: 31, Hour: 23, Minute: 59, Second: 59, Nanosecond: 999000000, Zone: "UTC"}, -1},
+	{&time.Time{}, -62135596800000},
+}
+
+func TestDateTimeTime(t *testing.T) {
+	for _, dt := range dateTimeTests {
+		if v := NewDateTime(dt.t); v != dt.dt {
+			t.Errorf("NewDateTime(%v) = %d, want %d", dt.t, v, dt.dt)
+		}
+		if v := dt.dt.Time(); v.Seconds() != dt.t.Seconds() || v.Nanosecond != dt.t.Nanosecond || isZeroTime(v) != isZeroTime(dt.t) {
+			t.Errorf("DateTime(%d).Time() = %v, want %v", dt.dt, v, dt.t)
+		}
+	}
+
+	// Sub-millisecond precision is truncated.
+	tm := &time.Time{Year: 1970, Month: 1, Day: 1, Nanosecond: 1999999, Zone: "UTC"}
+	if v := NewDateTime(tm); v != 1 {
+		t.Errorf("NewDateTime(%v) = %d, want 1", tm, v)
+	}
+
+	// Times outside the range of DateTime are an error when encoding.
+	tm = &time.Time{Year: 300000000, Month: 1, Day: 1, Zone: "UTC"}
+	if _, err := Encode(nil, stTimePtr{tm}); err == nil {
+		t.Errorf("Encode(%v) did not return an error", tm)
+	}
+	if v := NewDateTime(tm); v != math.MaxInt64 {
+		t.Errorf("NewDateTime(%v) = %d, want %d", tm, v, int64(math.MaxInt64))
+	}
+
+	// The zero time round trips when not conditional.
+	var v struct {
+		T time.Time
+	}
+	data, err := Encode(nil, v)
+	if err != nil {
+		t.Fatalf("Encode(zero time) returned error %v", err)
+	}
+	v.T.Year = 1
+	if err := Decode(data, &v); err != nil {
+		t.Fatalf("Decode(zero time) returned error %v", err)
+	} else if !isZeroTime(&v.T) {
+		t.Errorf("Decode(zero time) = %v, want zero time", v.T)
+	}
+}
+
+type stInline struct {
+	A int "a"
+}
+
+type stInlineOuter struct {
+	Inline stInline   "/inline"
+	Ptr    *stInline2 "/inline"
+	Extra  M          "/inline"
+	C      int        "c/required"
+}
+
+type stInline2 struct {
+	B int "b"
+}
+
+type stRecursiveInline struct {
+	A    int                "a"
+	Next *stRecursiveInline "/inline"
+}
+
+func TestStructTags(t *testing.T) {
+	v := stInlineOuter{Inline: stInline{1}, Ptr: &stInline2{2}, Extra: M{"x": 3}, C: 4}
+	data, err := Encode(nil, &v)
+	if err != nil {
+		t.Fatalf("Encode(%+v) returned error %v", v, err)
+	}
+	expected, _ := Encode(nil, D{{"a", 1}, {"b", 2}, {"c", 4}, {"x", 3}})
+	if !bytes.Equal(data, expected) {
+		t.Errorf("Encode(%+v)\n  expected %q\n  actual   %q", v, expected, data)
+	}
+
+	var v2 stInlineOuter
+	if err := Decode(data, &v2); err != nil {
+		t.Errorf("Decode() returned error %v", err)
+	} else if !reflect.DeepEqual(v, v2) {
+		t.Errorf("Decode() = %+v, want %+v", v2, v)
+	}
+
+	// Nil inline pointers are not encoded and are allocated on decode only
+	// when a field is present.
+	data, _ = Encode(nil, stInlineOuter{C: 4})
+	expected, _ = Encode(nil, D{{"a", 0}, {"c", 4}})
+	if !bytes.Equal(data, expected) {
+		t.Errorf("Encode(nil pointer)\n  expected %q\n  actual   %q", expected, data)
+	}
+	v2 = stInlineOuter{}
+	if err := Decode(data, &v2); err != nil {
+		t.Errorf("Decode() returned error %v", err)
+	} else if v2.Ptr != nil || v2.Extra != nil {
+		t.Errorf("Decode() = %+v, want nil Ptr and Extra", v2)
+	}
+
+	// Inline map key conflicts with a struct field.
+	if _, err := Encode(nil, stInlineOuter{Extra: M{"a": 1}}); err == nil {
+		t.Errorf("Encode(conflicting inline map) did not return an error")
+	}
+
+	// Required field missing.
+	data, _ = Encode(nil, M{"a": 1})
+	err = Decode(data, &v2)
+	if _, ok := err.(*DecodeRequiredError); !ok {
+		t.Errorf("Decode(missing required) returned %v, want DecodeRequiredError", err)
+	}
+
+	// Invalid tags.
+	for _, bad := range []interface{}{
+		struct {
+			A int "a/bogus"
+		}{},
+		struct {
+			A int "/inline"
+		}{},
+		struct {
+			A map[string]int "/inline"
+			B M              "/inline"
+		}{},
+		stRecursiveInline{},
+	} {
+		_, err := Encode(nil, bad)
+		if _, ok := err.(*StructTagError); !ok {
+			t.Errorf("Encode(%T) returned %v, want StructTagError", bad, err)
+		}
+		err = Decode([]byte("\x05\x00\x00\x00\x00"), reflect.New(reflect.TypeOf(bad)).Interface())
+		if _, ok := err.(*StructTagError); !ok {
+			t.Errorf("Decode(%T) returned %v, want StructTagError", bad, err)
+		}
+	}
+}
+
+// Audit is exported so that the embedded pointer is settable.
+type Audit struct {
+	Created DateTime "created"
+	Author  string   "author"
+}
+
+type stEmbeddedPtr struct {
+	*Audit
+	Name string "name"
+}
+
+type stRecursiveEmbed struct {
+	*stRecursiveEmbed
+	Name string "name"
+}
+
+func TestEmbeddedPointer(t *testing.T) {
+	v := stEmbeddedPtr{&Audit{1000, "gary"}, "test"}
+	data, err := Encode(nil, v)
+	if err != nil {
+		t.Fatalf("Encode(%+v) returned error %v", v, err)
+	}
+	expected, _ := Encode(nil, D{{"created", DateTime(1000)}, {"author", "gary"}, {"name", "test"}})
+	if !bytes.Equal(data, expected) {
+		t.Errorf("Encode(%+v)\n  expected %q\n  actual   %q", v, expected, data)
+	}
+
+	var v2 stEmbeddedPtr
+	if err := Decode(data, &v2); err != nil {
+		t.Errorf("Decode() returned error %v", err)
+	} else if !reflect.DeepEqual(v, v2) {
+		t.Errorf("Decode() = %+v, want %+v", v2, v)
+	}
+
+	// Nil embedded pointers are skipped on encode and not allocated on
+	// decode unless a field is present.
+	data, err = Encode(nil, stEmbeddedPtr{Name: "test"})
+	expected, _ = Encode(nil, M{"name": "test"})
+	if err != nil || !bytes.Equal(data, expected) {
+		t.Errorf("Encode(nil embedded) = %q, %v, want %q", data, err, expected)
+	}
+	v2 = stEmbeddedPtr{}
+	if err := Decode(data, &v2); err != nil || v2.Audit != nil {
+		t.Errorf("Decode() = %+v, %v, want nil embedded pointer", v2, err)
+	}
+	data, _ = Encode(nil, M{"author": "gary"})
+	if err := Decode(data, &v2); err != nil || v2.Audit == nil || v2.Author != "gary" {
+		t.Errorf("Decode() = %+v, %v, want author", v2, err)
+	}
+
+	// Recursive embedded pointers are rejected.
+	_, err = Encode(nil, stRecursiveEmbed{&stRecursiveEmbed{nil, "inner"}, "outer"})
+	if _, ok := err.(*StructTagError); !ok {
+		t.Errorf("Encode(recursive) returned %v, want StructTagError", err)
+	}
+	var v3 stRecursiveEmbed
+	err = Decode(expected, &v3)
+	if _, ok := err.(*StructTagError); !ok {
+		t.Errorf("Decode(recursive) returned %v, want StructTagError", err)
+	}
+}
+
+type stExtraD struct {
+	A     int "a"
+	Extra D   "/inline"
+}
+
+type stExtraMap struct {
+	A     int                    "a"
+	Extra map[string]interface{} "/inline"
+}
+
+func TestInlineExtra(t *testing.T) {
+	doc := D{{"y", 1}, {"x", D{{"q", 1}, {"p", 2}}}}
+	list := []interface{}{D{{"s", 1}, {"r", 2}}, 3}
+	cws := CodeWithScope{"f()", map[string]interface{}{"k": 1}}
+	data, _ := Encode(nil, D{{"z", "new"}, {"a", 1}, {"doc", doc}, {"list", list}, {"cws", cws}})
+
+	// Add a null element. Encode does not write nil values.
+	data = append(data[:len(data)-1], "\x0an\x00\x00"...)
+	wire.PutUint32(data, uint32(len(data)))
+
+	var vd stExtraD
+	if err := Decode(data, &vd); err != nil {
+		t.Fatalf("Decode(D) returned error %v", err)
+	}
+	if vd.A != 1 || len(vd.Extra) != 5 || !reflect.DeepEqual(vd.Extra[1], DocItem{"doc", doc}) ||
+		!reflect.DeepEqual(vd.Extra[2], DocItem{"list", list}) {
+		t.Errorf("Decode(D) = %+v, want extra z, doc, list, cws and n in order", vd)
+	}
+	actual, err := Encode(nil, &vd)
+	expected, _ := Encode(nil, D{{"a", 1}, {"z", "new"}, {"doc", doc}, {"list", list}, {"cws", cws}})
+	expected = append(expected[:len(expected)-1], "\x0an\x00\x00"...)
+	wire.PutUint32(expected, uint32(len(expected)))
+	if err != nil || !bytes.Equal(actual, expected) {
+		t.Errorf("Encode(D)\n  expected %q\n  actual   %q %v", expected, actual, err)
+	}
+
+	var vm stExtraMap
+	if err := Decode(data, &vm); err != nil {
+		t.Fatalf("Decode(map) returned error %v", err)
+	}
+	v, ok := vm.Extra["n"]
+	if vm.A != 1 || len(vm.Extra) != 5 || !ok || v != nil {
+		t.Errorf("Decode(map) = %+v, want 5 extra fields including null n", vm)
+	}
+	actual, err = Encode(nil, &vm)
+	var m M
+	if err != nil {
+		t.Errorf("Encode(map) returned error %v", err)
+	} else if err = Decode(actual, &m); err != nil || len(m) != 5 {
+		// Decode to a map skips nulls.
+		t.Errorf("Encode(map) = %v, %v, want a, z, doc, list and cws", m, err)
+	} else if !bytes.Contains(actual, []byte("\x0an\x00")) {
+		t.Errorf("Encode(map) = %q, want null n", actual)
+	}
+}
+
+func TestReaderWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	docs := []M{{"a": 1}, {"b": "hello"}, {"c": map[string]interface{}{"d": true}}}
+	for _, doc := range docs {
+		if err := w.Write(doc); err != nil {
+			t.Fatalf("Write(%v) returned error %v", doc, err)
+		}
+	}
+	data := buf.Bytes()
+
+	r := NewReader(bytes.NewBuffer(data))
+	for _, doc := range docs {
+		bd, err := r.Read()
+		if err != nil {
+			t.Fatalf("Read() returned error %v", err)
+		}
+		var m M
+		if err := bd.Decode(&m); err != nil {
+			t.Errorf("Decode() returned error %v", err)
+		} else if !reflect.DeepEqual(m, doc) {
+			t.Errorf("Read() = %v, want %v", m, doc)
+		}
+	}
+	if _, err := r.Read(); err != EOF {
+		t.Errorf("Read() at end returned %v, want EOF", err)
+	}
+
+	// Truncated in the document body.
+	r = NewReader(bytes.NewBuffer(data[:len(data)-1]))
+	var err os.Error
+	for err == nil {
+		_, err = r.Read()
+	}
+	if e, ok := err.(*TruncatedError); !ok {
+		t.Errorf("Read() returned %v, want TruncatedError", err)
+	} else if e.Got != e.Want-1 {
+		t.Errorf("TruncatedError = %+v, want Got = Want - 1", e)
+	}
+
+	// Truncated in the length prefix.
+	r = NewReader(bytes.NewBuffer(append(data, 0x10, 0x00)))
+	for err = nil; err == nil; {
+		_, err = r.Read()
+	}
+	if e, ok := err.(*TruncatedError); !ok || e.Got != 2 || e.Offset != int64(len(data)) {
+		t.Errorf("Read() returned %v, want TruncatedError at %d", err, len(data))
+	}
+
+	// Document larger than the maximum size.
+	r = NewReader(bytes.NewBuffer(data))
+	r.MaxDocumentSize = 10
+	if _, err = r.Read(); err == nil {
+		t.Errorf("Read() did not return an error for large document")
+	} else if _, ok := err.(*DocumentSizeError); !ok {
+		t.Errorf("Read() returned %v, want DocumentSizeError", err)
+	}
+}
+
+type stRaw struct {
+	A Raw      "a"
+	B BSONData "b"
+}
+
+func TestRaw(t *testing.T) {
+	data, _ := Encode(nil, D{
+		{"s", "hello"},
+		{"i", 1},
+		{"l", int64(2)},
+		{"a", D{{"b", []interface{}{"x", D{{"c", true}}}}}},
+	})
+	raw := Raw(data)
+
+	if s, ok := raw.Lookup("s").StringOK(); !ok || s != "hello" {
+		t.Errorf("StringOK() = %q, %v, want hello", s, ok)
+	}
+	if _, ok := raw.Lookup("s").Int64OK(); ok {
+		t.Errorf("Int64OK() of string returned ok")
+	}
+	if i, ok := raw.Lookup("i").Int32OK(); !ok || i != 1 {
+		t.Errorf("Int32OK() = %d, %v, want 1", i, ok)
+	}
+	if l, ok := raw.Lookup("l").Int64OK(); !ok || l != 2 {
+		t.Errorf("Int64OK() = %d, %v, want 2", l, ok)
+	}
+	if b, ok := raw.Lookup("a.b.1.c").BoolOK(); !ok || !b {
+		t.Errorf("Lookup(a.b.1.c) = %v, %v, want true", b, ok)
+	}
+	if s, ok := raw.Lookup("a.b.0").StringOK(); !ok || s != "x" {
+		t.Errorf("Lookup(a.b.0) = %q, %v, want x", s, ok)
+	}
+	for _, path := range []string{"x", "s.x", "a.b.2", "a.b.1.d"} {
+		if bd := raw.Lookup(path); bd.Kind != 0 {
+			t.Errorf("Lookup(%q) = %v, want not found", path, bd)
+		}
+	}
+	if bd := Raw(data[:len(data)-3]).Lookup("x"); bd.Kind != 0 {
+		t.Errorf("Lookup on truncated document = %v, want not found", bd)
+	}
+
+	// Lengths in malformed documents that point past the end of the data or
+	// are negative.
+	for _, doc := range []interface{}{
+		D{{"s", "hello"}},
+		D{{"d", D{{"x", 1}}}},
+		D{{"b", []byte("abc")}},
+		D{{"p", DBPointer{"db.c", NewObjectId()}}},
+	} {
+		for _, n := range []uint32{0x7fffffff, 0xffffffff, 0xfffffff0, 0x100} {
+			p, _ := Encode(nil, doc)
+			wire.PutUint32(p[7:], n)
+			if bd := Raw(p).Lookup("x"); bd.Kind != 0 {
+				t.Errorf("Lookup on malformed document %q = %v, want not found", p, bd)
+			}
+			if _, err := Raw(p).Elements(); err == nil {
+				t.Errorf("Elements() on malformed document %q did not return an error", p)
+			}
+		}
+	}
+
+	doc, ok := raw.Lookup("a").DocumentOK()
+	if !ok {
+		t.Fatalf("DocumentOK() returned false")
+	}
+	if _, ok := raw.Lookup("a.b").DocumentOK(); ok {
+		t.Errorf("DocumentOK() of array returned ok")
+	}
+	if _, ok := doc.Lookup("b").ArrayOK(); !ok {
+		t.Errorf("ArrayOK() returned false")
+	}
+
+	elements, err := raw.Elements()
+	if err != nil {
+		t.Fatalf("Elements() returned error %v", err)
+	}
+	var names []string
+	for _, e := range elements {
+		names = append(names, e.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"s", "i", "l", "a"}) {
+		t.Errorf("Elements() names = %v", names)
+	}
+	if &elements[0].Value.Data[0] != &data[4+1+2] {
+		t.Errorf("Elements() copied the document data")
+	}
+	if _, err := Raw(data[:len(data)-3]).Elements(); err == nil {
+		t.Errorf("Elements() on truncated document did not return an error")
+	}
+
+	if s := raw.String(); s != `{s: "hello", i: 1, l: 2, a: {b: ["x", {c: true}]}}` {
+		t.Errorf("String() = %s", s)
+	}
+
+	var st stRaw
+	data2, _ := Encode(nil, D{{"a", D{{"x", 1}}}, {"b", []interface{}{1}}})
+	if err := Decode(data2, &st); err != nil {
+		t.Fatalf("Decode() returned error %v", err)
+	}
+	if x, ok := st.A.Lookup("x").Int32OK(); !ok || x != 1 {
+		t.Errorf("Decode() a.x = %d, %v, want 1", x, ok)
+	}
+	actual, err := Encode(nil, st)
+	if err != nil || !bytes.Equal(actual, data2) {
+		t.Errorf("Encode(%+v) = %q, %v, want %q", st, actual, err, data2)
+	}
+	data2[4+3+4+1] = 'z' // name of a.x
+	if x, _ := st.A.Lookup("x").Int32OK(); x != 1 {
+		t.Errorf("Decode() did not copy the document data")
+	}
+	for _, m := range []M{{"a": "hello"}, {"a": []interface{}{1}}} {
+		data2, _ = Encode(nil, m)
+		if err := Decode(data2, &st); err == nil {
+			t.Errorf("Decode(%v) to Raw did not return an error", m)
+		}
+	}
+
+	var top Raw
+	if err := Decode(data, &top); err != nil || !bytes.Equal(top, data) {
+		t.Errorf("Decode(&Raw) = %q, %v, want %q", top, err, data)
+	}
+	actual, err = Encode(nil, top)
+	if err != nil || !bytes.Equal(actual, data) {
+		t.Errorf("Encode(Raw) = %q, %v, want %q", actual, err, data)
+	}
+	actual, err = Encode(nil, M{"r": top})
+	expected, _ := Encode(nil, M{"r": D{{"s", "hello"}, {"i", 1}, {"l", int64(2)}, {"a", D{{"b", []interface{}{"x", D{{"c", true}}}}}}}})
+	if err != nil || !bytes.Equal(actual, expected) {
+		t.Errorf("Encode(M{r: Raw}) = %q, %v, want %q", actual, err, expected)
+	}
+}
+
+var extJSONTests = []struct {
+	doc       interface{}
+	canonical string
+	relaxed   string
+}{
+	{D{{"d", 1.0}}, `{"d":{"$numberDouble":"1.0"}}`, `{"d":1.0}`},
+	{D{{"d", -0.5}}, `{"d":{"$numberDouble":"-0.5"}}`, `{"d":-0.5}`},
+	{D{{"d", 1.2345678921232e18}}, `{"d":{"$numberDouble":"1.2345678921232E+18"}}`, `{"d":1.2345678921232E+18}`},
+	{D{{"d", math.Inf(-1)}}, `{"d":{"$numberDouble":"-Infinity"}}`, `{"d":{"$numberDouble":"-Infinity"}}`},
+	{D{{"s", "a\"b\\c\n\x01é"}}, `{"s":"a\"b\\c\n\u0001é"}`, ""},
+	{D{{"o", D{{"a", []interface{}{1, "x"}}}}}, `{"o":{"a":[{"$numberInt":"1"},"x"]}}`, `{"o":{"a":[1,"x"]}}`},
+	{D{{"b", Binary{Subtype: 0x80, Data: []byte("hi")}}}, `{"b":{"$binary":{"base64":"aGk=","subType":"80"}}}`, ""},
+	{D{{"b", Binary{Subtype: binaryOld, Data: []byte("hi")}}}, `{"b":{"$binary":{"base64":"aGk=","subType":"02"}}}`, ""},
+	{D{{"_id", ObjectId("\x57\xe1\x93\xd7\xa9\xcc\x81\xb4\x02\x74\x98\xb5")}}, `{"_id":{"$oid":"57e193d7a9cc81b4027498b5"}}`, ""},
+	{D{{"t", true}, {"f", false}, {"n", BSONData{Kind: kindNull}}}, `{"t":true,"f":false,"n":null}`, ""},
+	{D{{"dt", DateTime(1356351330501)}}, `{"dt":{"$date":{"$numberLong":"1356351330501"}}}`, `{"dt":{"$date":"2012-12-24T12:15:30.501Z"}}`},
+	{D{{"dt", DateTime(0)}}, `{"dt":{"$date":{"$numberLong":"0"}}}`, `{"dt":{"$date":"1970-01-01T00:00:00Z"}}`},
+	{D{{"dt", DateTime(-1)}}, `{"dt":{"$date":{"$numberLong":"-1"}}}`, `{"dt":{"$date":{"$numberLong":"-1"}}}`},
+	{D{{"r", Regexp{Pattern: "a/b", Options: "im"}}}, `{"r":{"$regularExpression":{"pattern":"a/b","options":"im"}}}`, ""},
+	{D{{"c", Code("f()")}}, `{"c":{"$code":"f()"}}`, ""},
+	{D{{"c", CodeWithScope{"f()", map[string]interface{}{"x": 1}}}}, `{"c":{"$code":"f()","$scope":{"x":{"$numberInt":"1"}}}}`, `{"c":{"$code":"f()","$scope":{"x":1}}}`},
+	{D{{"s", Symbol("sym")}}, `{"s":{"$symbol":"sym"}}`, ""},
+	{D{{"i", -7}}, `{"i":{"$numberInt":"-7"}}`, `{"i":-7}`},
+	{D{{"ts", Timestamp(123<<32 | 456)}}, `{"ts":{"$timestamp":{"t":123,"i":456}}}`, ""},
+	{D{{"l", int64(1) << 40}}, `{"l":{"$numberLong":"1099511627776"}}`, `{"l":1099511627776}`},
+	{D{{"dec", Decimal128{0x3040000000000000, 12345}}}, `{"dec":{"$numberDecimal":"12345"}}`, ""},
+	{D{{"min", MinValue}, {"max", MaxValue}}, `{"min":{"$minKey":1},"max":{"$maxKey":1}}`, ""},
+}
+
+func TestExtJSON(t *testing.T) {
+	for _, tt := range extJSONTests {
+		data, err := Encode(nil, tt.doc)
+		if err != nil {
+			t.Errorf("Encode(%v) returned error %v", tt.doc, err)
+			continue
+		}
+		if tt.relaxed == "" {
+			tt.relaxed = tt.canonical
+		}
+		for _, mode := range []struct {
+			canonical bool
+			json      string
+		}{{true, tt.canonical}, {false, tt.relaxed}} {
+			actual, err := MarshalExtJSON(data, mode.canonical)
+			if err != nil || string(actual) != mode.json {
+				t.Errorf("MarshalExtJSON(%v, %v) = %s, %v, want %s", tt.doc, mode.canonical, actual, err, mode.json)
+			}
+		}
+		actual, err := UnmarshalExtJSON([]byte(tt.canonical))
+		if err != nil || !bytes.Equal(actual, data) {
+			t.Errorf("UnmarshalExtJSON(%s) = %q, %v, want %q", tt.canonical, actual, err, data)
+		}
+	}
+}
+
+var unmarshalExtJSONTests = []struct {
+	json string
+	doc  interface{}
+}{
+	{` { "a" : [ 1 , 2.5 , 3000000000 ] } `, D{{"a", []interface{}{1, 2.5, int64(3000000000)}}}},
+	{`{"s":"é😀\/"}`, D{{"s", "é\U0001f600/"}}},
+	{`{"dt":{"$date":"2012-12-24T13:15:30.5+01:00"}}`, D{{"dt", DateTime(1356351330500)}}},
+	{`{"dt":{"$date":"2012-12-24T07:15:30-0500"}}`, D{{"dt", DateTime(1356351330000)}}},
+	{`{"dt":{"$date":1356351330501}}`, D{{"dt", DateTime(1356351330501)}}},
+	{`{"b":{"$binary":"aGk=","$type":"5"}}`, D{{"b", Binary{Subtype: 5, Data: []byte("hi")}}}},
+	{`{"r":{"$regex":"^a","$options":"mi"}}`, D{{"r", Regexp{Pattern: "^a", Options: "im"}}}},
+	{`{"q":{"$regex":{"$regularExpression":{"pattern":"a","options":""}}}}`, D{{"q", D{{"$regex", Regexp{Pattern: "a"}}}}}},
+	{`{"c":{"$scope":{},"$code":"f()"}}`, D{{"c", CodeWithScope{Code: "f()"}}}},
+	{`{"q":{"$type":"string","$gt":1}}`, D{{"q", D{{"$type", "string"}, {"$gt", 1}}}}},
+	{`{"d":{"$numberDouble":"NaN"}}`, D{{"d", math.NaN()}}},
+}
+
+var badExtJSONTests = []string{
+	``,
+	`[]`,
+	`{"$oid":"57e193d7a9cc81b4027498b5"}`,
+	`{"a":1,}`,
+	`{"a":01x}`,
+	`{"a":"\x"}`,
+	`{"a":1} x`,
+	`{"a":{"$oid":"57e193d7a9cc81b4027498b5","x":1}}`,
+	`{"a":{"$oid":"57e1"}}`,
+	`{"a":{"$numberInt":"3000000000"}}`,
+	`{"a":{"$date":"2012-13-24T12:15:30Z"}}`,
+	`{"a":{"$timestamp":{"t":-1,"i":0}}}`,
+	`{"a":{"$minKey":0}}`,
+	`{"a\u0000b":1}`,
+}
+
+func TestUnmarshalExtJSON(t *testing.T) {
+	for _, tt := range unmarshalExtJSONTests {
+		expected, _ := Encode(nil, tt.doc)
+		actual, err := UnmarshalExtJSON([]byte(tt.json))
+		if err != nil || !bytes.Equal(actual, expected) {
+			t.Errorf("UnmarshalExtJSON(%s) = %q, %v, want %q", tt.json, actual, err, expected)
+		}
+	}
+	for _, s := range badExtJSONTests {
+		if actual, err := UnmarshalExtJSON([]byte(s)); err == nil {
+			t.Errorf("UnmarshalExtJSON(%s) = %q, want error", s, actual)
+		}
+	}
+
+	var bd BSONData
+	if err := bd.UnmarshalExtJSON([]byte(`{"$numberLong":"5"}`)); err != nil || bd.Kind != kindInt64 {
+		t.Errorf("UnmarshalExtJSON($numberLong) = %v, %v, want int64", bd, err)
+	}
+	if actual, err := bd.MarshalExtJSON(false); err != nil || string(actual) != "5" {
+		t.Errorf("MarshalExtJSON(%v) = %s, %v, want 5", bd, actual, err)
+	}
+}
+
+var validateErrorTests = []struct {
+	data   string
+	offset int
+	path   string
+}{
+	{"", 0, ""},
+	{"\x05\x00\x00", 0, ""},
+	{"\x06\x00\x00\x00\x00\x00", 4, ""},
+	{"\x05\x00\x00\x00\x01", 4, ""},
+	{"\x05\x00\x00\x00\x00\x00", 5, ""},
+	{"\x08\x00\x00\x00\x0aab\x00", 5, ""},
+	{"\x0a\x00\x00\x00\x10a\x00\x01\x00\x00", 7, "a"},
+	{"\x08\x00\x00\x00\x14a\x00\x00", 4, "a"},
+	{"\x09\x00\x00\x00\x08a\x00\x02\x00", 7, "a"},
+	{"\x09\x00\x00\x00\x0a\xffa\x00\x00", 5, ""},
+	{"\x0e\x00\x00\x00\x02a\x00\x02\x00\x00\x00\xff\x00\x00", 11, "a"},
+	{"\x0e\x00\x00\x00\x02a\x00\x02\x00\x00\x00bc\x00", 12, "a"},
+	{"\x0e\x00\x00\x00\x02a\x00\x00\x00\x00\x00b\x00\x00", 7, "a"},
+	{"\x10\x00\x00\x00\x03a\x00\x08\x00\x00\x00\x14b\x00\x00\x00", 11, "a.b"},
+	{"\x10\x00\x00\x00\x03a\x00\x08\x00\x00\x00\x0ab\x00\x01\x00", 14, "a"},
+	{"\x0f\x00\x00\x00\x05a\x00\x03\x00\x00\x00\x00xy\x00", 7, "a"},
+	{"\x13\x00\x00\x00\x05a\x00\x06\x00\x00\x00\x02\x03\x00\x00\x00xy\x00", 12, "a"},
+	{"\x0d\x00\x00\x00\x0ba\x00x\x00y\xff\x00\x00", 10, "a"},
+	{"\x00\xff\xff\x7f\x00", 0, ""},
+	{"\x0c\x00\x00\x00\x03a\x00\x00\xff\xff\x7f\x00", 7, "a"},
+	{"\x0d\x00\x00\x00\x02a\x00\x00\xff\xff\x7f\x00\x00", 7, "a"},
+	{"\x0d\x00\x00\x00\x05a\x00\x00\xff\xff\x7f\x00\x00", 7, "a"},
+	{"\x0c\x00\x00\x00\x0fa\x00\x00\xff\xff\x7f\x00", 7, "a"},
+	{"\x0c\x00\x00\x00\x03a\x00\xff\xff\xff\x7f\x00", 7, "a"},
+	{"\x0d\x00\x00\x00\x02a\x00\xfc\xff\xff\x7f\x00\x00", 7, "a"},
+	{"\x0d\x00\x00\x00\x05a\x00\xfb\xff\xff\x7f\x00\x00", 7, "a"},
+	{"\x0c\x00\x00\x00\x0fa\x00\xff\xff\xff\x7f\x00", 7, "a"},
+}
+
+func TestValidate(t *testing.T) {
+	for _, bt := range bsonTests {
+		if err := Validate([]byte(bt.data)); err != nil {
+			t.Errorf("Validate(%q) returned error %v", bt.data, err)
+		}
+	}
+	for _, tt := range decimal128Tests {
+		data, _ := hex.DecodeString(tt.data)
+		if err := Validate(data); err != nil {
+			t.Errorf("Validate(%q) returned error %v", data, err)
+		}
+	}
+	for _, tt := range validateErrorTests {
+		err := Validate([]byte(tt.data))
+		e, ok := err.(*ValidationError)
+		if !ok {
+			t.Errorf("Validate(%q) = %v, want ValidationError", tt.data, err)
+		} else if e.Offset != tt.offset || e.Path != tt.path {
+			t.Errorf("Validate(%q) = %v, want offset %d path %q", tt.data, err, tt.offset, tt.path)
+		}
+	}
+
+	var doc interface{} = M{}
+	for i := 1; i < MaxNestingDepth; i++ {
+		doc = []interface{}{doc}
+	}
+	data, _ := Encode(nil, M{"a": doc})
+	if err := Validate(data); err != nil {
+		t.Errorf("Validate(depth %d) returned error %v", MaxNestingDepth, err)
+	}
+	data, _ = Encode(nil, M{"a": []interface{}{doc}})
+	if err := Validate(data); err == nil {
+		t.Errorf("Validate(depth %d) did not return an error", MaxNestingDepth+1)
+	}
+}
+
+var compareTests = []struct {
+	a, b interface{}
+	c    int
+}{
+	{MinValue, nil, -1},
+	{nil, BSONData{}, 0},
+	{nil, 1, -1},
+	{1, int64(1), 0},
+	{1, 1.5, -1},
+	{int64(1)<<62 + 1, float64(int64(1) << 62), 1},
+	{int64(-1) << 62, -1e19, 1},
+	{math.NaN(), math.Inf(-1), -1},
+	{math.NaN(), math.NaN(), 0},
+	{math.Inf(1), int64(1) << 62, 1},
+	{Decimal128{0x3040000000000000, 15}, 15, 0},
+	{Decimal128{0x303e000000000000, 15}, 1.5, 0},
+	{Decimal128{0x303e000000000000, 15}, 2, -1},
+	{Decimal128{0x7c00000000000000, 0}, math.NaN(), 0},
+	{1e300, "a", -1},
+	{"a", Symbol("a"), 0},
+	{"ab", "b", -1},
+	{"z", M{}, -1},
+	{M{"a": 1}, M{"a": 2}, -1},
+	{M{"a": 1}, M{"b": 1}, -1},
+	{M{"a": "x"}, M{"a": 99}, 1},
+	{D{{"a", 1}}, D{{"a", 1}, {"b", 1}}, -1},
+	{M{"z": 1}, []interface{}{}, -1},
+	{[]interface{}{1, 2}, []interface{}{1, 3}, -1},
+	{[]interface{}{1, 2}, []interface{}{1}, 1},
+	{[]interface{}{}, []byte{}, -1},
+	{[]byte{9}, []byte{1, 2}, -1},
+	{[]byte{1}, Binary{Subtype: 4, Data: []byte{0}}, -1},
+	{Binary{}, ObjectId("\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"), -1},
+	{ObjectId("\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01"), ObjectId("\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"), 1},
+	{ObjectId("\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"), false, -1},
+	{false, true, -1},
+	{true, DateTime(0), -1},
+	{DateTime(-1), DateTime(0), -1},
+	{DateTime(1), Timestamp(0), -1},
+	{Timestamp(-1), Timestamp(1), 1},
+	{Timestamp(0), Regexp{Pattern: "a"}, -1},
+	{Regexp{Pattern: "a", Options: "i"}, Regexp{Pattern: "a"}, 1},
+	{Regexp{}, Code(""), -1},
+	{Code("b"), CodeWithScope{Code: "a"}, -1},
+	{CodeWithScope{"a", map[string]interface{}{"x": 1}}, CodeWithScope{"a", map[string]interface{}{"x": 2}}, -1},
+	{CodeWithScope{}, MaxValue, -1},
+}
+
+func TestCompare(t *testing.T) {
+	for _, tt := range compareTests {
+		if c := Compare(tt.a, tt.b); c != tt.c {
+			t.Errorf("Compare(%v, %v) = %d, want %d", tt.a, tt.b, c, tt.c)
+		}
+		if c := Compare(tt.b, tt.a); c != -tt.c {
+			t.Errorf("Compare(%v, %v) = %d, want %d", tt.b, tt.a, c, -tt.c)
+		}
+	}
+	data, _ := Encode(nil, D{{"a", 1.0}, {"b", 2.0}})
+	if c := Compare(D{{"a", 1}, {"b", int64(2)}}, Raw(data)); c != 0 {
+		t.Errorf("Compare(D, Raw) = %d, want 0", c)
+	}
+}
+
+type bySpec struct {
+	docs []M
+	spec D
+}
+
+func (s bySpec) Len() int           { return len(s.docs) }
+func (s bySpec) Less(i, j int) bool { return Less(s.spec, s.docs[i], s.docs[j]) }
+func (s bySpec) Swap(i, j int)      { s.docs[i], s.docs[j] = s.docs[j], s.docs[i] }
+
+func TestLess(t *testing.T) {
+	docs := []M{
+		{"n": 1, "x": M{"y": 2}},
+		{"n": 2, "x": M{"y": 2.5}},
+		{"n": 3},
+		{"n": 4, "x": M{"y": int64(2)}},
+		{"n": 5, "x": M{"y": "s"}},
+		{"n": 6, "x": M{"y": 1}},
+	}
+	sort.Sort(bySpec{docs, D{{"x.y", -1}, {"n", 1}}})
+	var order []interface{}
+	for _, doc := range docs {
+		order = append(order, doc["n"])
+	}
+	expected := []interface{}{5, 2, 1, 4, 6, 3}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("sort order = %v, want %v", order, expected)
+	}
+	if Less(D{{"a.1", 1}}, M{"a": []interface{}{9, 1}}, M{"a": []interface{}{0, 2}}) != true {
+		t.Errorf("Less(a.1) = false, want true")
+	}
+}
+
+func TestEqual(t *testing.T) {
+	a := D{{"x", 1}, {"y", D{{"p", "s"}, {"q", []interface{}{1, 2.0}}}}}
+	b := map[string]interface{}{"y": M{"q": []interface{}{int64(1), 2}, "p": "s"}, "x": 1.0}
+	if !Equal(a, b) {
+		t.Errorf("Equal(%v, %v) = false, want true", a, b)
+	}
+	if EqualOrdered(a, D{{"y", b["y"]}, {"x", 1}}) {
+		t.Errorf("EqualOrdered() of reordered document = true, want false")
+	}
+	if !EqualOrdered(a, D{{"x", int64(1)}, {"y", D{{"p", "s"}, {"q", []interface{}{1, 2}}}}}) {
+		t.Errorf("EqualOrdered() = false, want true")
+	}
+	for _, c := range []interface{}{
+		M{"x": 1},
+		M{"x": 1, "y": M{"p": "s", "q": []interface{}{2, 1}}},
+		M{"x": 1, "y": M{"p": "s", "q": []interface{}{1, 2}}, "z": 0},
+		M{"x": "1", "y": M{"p": "s", "q": []interface{}{1, 2}}},
+	} {
+		if Equal(a, c) {
+			t.Errorf("Equal(%v, %v) = true, want false", a, c)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a := M{"same": 1, "num": 1, "gone": true, "type": 1, "sub": M{"a": 1, "b": []interface{}{1}}, "arr": []interface{}{1, 2}}
+	b := D{
+		{"same", 1.0},
+		{"num", 2},
+		{"type", "1"},
+		{"sub", M{"a": 1, "b": []interface{}{2}, "c": "new"}},
+		{"arr", []interface{}{1, 2}},
+		{"added", "x"},
+	}
+	changes, err := Diff(a, b)
+	if err != nil {
+		t.Fatalf("Diff() returned error %v", err)
+	}
+	actual := make(map[string]ChangeOp)
+	for _, c := range changes {
+		actual[c.Path] = c.Op
+	}
+	expected := map[string]ChangeOp{
+		"num":   ChangeModified,
+		"gone":  ChangeRemoved,
+		"type":  ChangeTypeChanged,
+		"sub.b": ChangeModified,
+		"sub.c": ChangeAdded,
+		"added": ChangeAdded,
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Diff() = %v, want %v", actual, expected)
+	}
+
+	// Applying the update document to a gives b.
+	update := changes.Update()
+	if len(update) != 2 || update[0].Key != "$set" || update[1].Key != "$unset" {
+		t.Fatalf("Update() = %v, want $set and $unset", update)
+	}
+	result := M{}
+	for k, v := range a {
+		result[k] = v
+	}
+	for _, item := range update[0].Value.(D) {
+		var v interface{}
+		item.Value.(BSONData).Decode(&v)
+		if i := strings.Index(item.Key, "."); i >= 0 {
+			result[item.Key[:i]].(M)[item.Key[i+1:]] = v
+		} else {
+			result[item.Key] = v
+		}
+	}
+	for _, item := range update[1].Value.(D) {
+		result[item.Key] = nil, false
+	}
+	if !Equal(result, b) {
+		t.Errorf("applied update = %v, want %v", result, b)
+	}
+
+	if changes, err := Diff(a, a); err != nil || len(changes) != 0 || changes.Update() != nil {
+		t.Errorf("Diff(a, a) = %v, %v, want no changes", changes, err)
+	}
+	if _, err := Diff(a, 1); err == nil {
+		t.Errorf("Diff(a, 1) did not return an error")
+	}
+}
+
+type stFastSlices struct {
+	F   []float64
+	I32 []int32
+	I64 []int64
+	S   []string
+	O   []ObjectId
+	A   [3]int32
+}
+
+func TestFastSlices(t *testing.T) {
+	id := NewObjectId()
+	v := stFastSlices{
+		F:   []float64{1.5, -2},
+		I32: []int32{1, 2, 3},
+		I64: []int64{1 << 40},
+		S:   []string{"a", ""},
+		O:   []ObjectId{id},
+		A:   [3]int32{4, 5, 6},
+	}
+	data, err := Encode(nil, &v)
+	if err != nil {
+		t.Fatalf("Encode() returned error %v", err)
+	}
+	expected, _ := Encode(nil, D{
+		{"F", []interface{}{1.5, -2.0}},
+		{"I32", []interface{}{int32(1), int32(2), int32(3)}},
+		{"I64", []interface{}{int64(1 << 40)}},
+		{"S", []interface{}{"a", ""}},
+		{"O", []interface{}{id}},
+		{"A", []interface{}{int32(4), int32(5), int32(6)}},
+	})
+	if !bytes.Equal(data, expected) {
+		t.Errorf("Encode() = %q, want %q", data, expected)
+	}
+	var v2 stFastSlices
+	if err := Decode(data, &v2); err != nil {
+		t.Fatalf("Decode() returned error %v", err)
+	}
+	if !reflect.DeepEqual(v, v2) {
+		t.Errorf("Decode() = %+v, want %+v", v2, v)
+	}
+
+	// Element kinds other than the slice element kind use the general
+	// decoding.
+	data, _ = Encode(nil, D{
+		{"F", []interface{}{int32(1), int64(2), 3.0}},
+		{"I64", []interface{}{int32(1), 2.0}},
+		{"S", []interface{}{Symbol("x")}},
+	})
+	v2 = stFastSlices{I64: []int64{7, 8, 9}}
+	if err := Decode(data, &v2); err != nil {
+		t.Fatalf("Decode() returned error %v", err)
+	}
+	if !reflect.DeepEqual(v2.F, []float64{1, 2, 3}) ||
+		!reflect.DeepEqual(v2.I64, []int64{1, 2, 9}) ||
+		!reflect.DeepEqual(v2.S, []string{"x"}) {
+		t.Errorf("Decode() = %+v", v2)
+	}
+
+	// Long slices use keys past the precomputed table.
+	s := make([]int32, len(arrayKeys)+2)
+	for i := range s {
+		s[i] = int32(i)
+	}
+	data, err = Encode(nil, M{"s": s})
+	if err != nil {
+		t.Fatalf("Encode(long) returned error %v", err)
+	}
+	var m struct{ S []int32 "s" }
+	if err := Decode(data, &m); err != nil || !reflect.DeepEqual(m.S, s) {
+		t.Errorf("Decode(long) did not round trip, err=%v", err)
+	}
+	if bd := Raw(data).Lookup("s." + strconv.Itoa(len(s)-1)); bd.Kind != kindInt32 {
+		t.Errorf("Lookup(last) = %v, want int32", bd)
+	}
+
+	// Registered element encodings disable the fast paths.
+	enc := NewEncoder()
+	enc.RegisterType(reflect.TypeOf(int32(0)), func(v reflect.Value) (BSONData, os.Error) {
+		return BSONData{kindString, []byte{2, 0, 0, 0, 'x', 0}}, nil
+	})
+	dec := NewDecoder()
+	dec.RegisterKind(reflect.Float64, func(bd BSONData, v reflect.Value) os.Error {
+		v.SetFloat(42)
+		return nil
+	})
+	data, err = enc.Encode(nil, M{"a": []int32{1}, "b": []float64{1}})
+	if err != nil {
+		t.Fatalf("enc.Encode() returned error %v", err)
+	}
+	var r struct {
+		A []string  "a"
+		B []float64 "b"
+	}
+	if err := dec.Decode(data, &r); err != nil {
+		t.Fatalf("dec.Decode() returned error %v", err)
+	}
+	if !reflect.DeepEqual(r.A, []string{"x"}) || !reflect.DeepEqual(r.B, []float64{42}) {
+		t.Errorf("registered element encoding not used, got %+v", r)
+	}
+	if data, _ := Encode(nil, M{"a": []int32{1}}); Raw(data).Lookup("a.0").Kind != kindInt32 {
+		t.Errorf("registration changed the default encoder")
+	}
+}
+
+const benchmarkSliceLen = 10000
+
+func benchmarkEncode(b *testing.B, v interface{}) {
+	b.StopTimer()
+	buf, err := Encode(nil, v)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(buf)))
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		Encode(buf[:0], v)
+	}
+}
+
+func benchmarkDecode(b *testing.B, v, result interface{}) {
+	b.StopTimer()
+	data, err := Encode(nil, v)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(data)))
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		Decode(data, result)
+	}
+}
+
+func float64Slice() []float64 {
+	s := make([]float64, benchmarkSliceLen)
+	for i := range s {
+		s[i] = float64(i)
+	}
+	return s
+}
+
+func int32Slice() []int32 {
+	s := make([]int32, benchmarkSliceLen)
+	for i := range s {
+		s[i] = int32(i)
+	}
+	return s
+}
+
+func interfaceSlice(v interface{}) []interface{} {
+	rv := reflect.ValueOf(v)
+	s := make([]interface{}, rv.Len())
+	for i := range s {
+		s[i] = rv.Index(i).Interface()
+	}
+	return s
+}
+
+func BenchmarkEncodeFloat64Slice(b *testing.B) {
+	benchmarkEncode(b, M{"a": float64Slice()})
+}
+
+func BenchmarkEncodeFloat64SliceGeneral(b *testing.B) {
+	benchmarkEncode(b, M{"a": interfaceSlice(float64Slice())})
+}
+
+func BenchmarkEncodeInt32Slice(b *testing.B) {
+	benchmarkEncode(b, M{"a": int32Slice()})
+}
+
+func BenchmarkEncodeInt32SliceGeneral(b *testing.B) {
+	benchmarkEncode(b, M{"a": interfaceSlice(int32Slice())})
+}
+
+func BenchmarkDecodeFloat64Slice(b *testing.B) {
+	var r struct{ A []float64 "a" }
+	benchmarkDecode(b, M{"a": float64Slice()}, &r)
+}
+
+func BenchmarkDecodeFloat64SliceGeneral(b *testing.B) {
+	var r struct{ A []interface{} "a" }
+	benchmarkDecode(b, M{"a": float64Slice()}, &r)
+}
+
+func BenchmarkDecodeInt32Slice(b *testing.B) {
+	var r struct{ A []int32 "a" }
+	benchmarkDecode(b, M{"a": int32Slice()}, &r)
+}
+
+func BenchmarkDecodeInt32SliceGeneral(b *testing.B) {
+	var r struct{ A []interface{} "a" }
+	benchmarkDecode(b, M{"a": int32Slice()}, &r)
+}
+
+type stPlan struct {
+	N int
+	S string "s/omitempty"
+	P *stPlan
+}
+
+func TestEncoderDecoderPlans(t *testing.T) {
+	enc := NewEncoder()
+	dec := NewDecoder()
+	v := stPlan{N: 1, P: &stPlan{N: 2, S: "x"}}
+	data, err := enc.Encode(nil, &v)
+	if err != nil {
+		t.Fatalf("enc.Encode() returned error %v", err)
+	}
+	var v2 stPlan
+	if err := dec.Decode(data, &v2); err != nil || v2.N != 1 || v2.P == nil || v2.P.N != 2 || v2.P.S != "x" {
+		t.Fatalf("dec.Decode() = %+v, %v", v2, err)
+	}
+
+	// Registrations after use apply to the compiled plans.
+	enc.RegisterKind(reflect.Int, func(v reflect.Value) (BSONData, os.Error) {
+		return BSONData{kindString, []byte{2, 0, 0, 0, 'n', 0}}, nil
+	})
+	dec.RegisterKind(reflect.Int, func(bd BSONData, v reflect.Value) os.Error {
+		v.SetInt(42)
+		return nil
+	})
+	data, err = enc.Encode(nil, &v)
+	if err != nil {
+		t.Fatalf("enc.Encode() returned error %v", err)
+	}
+	if bd := Raw(data).Lookup("P.N"); bd.Kind != kindString {
+		t.Errorf("P.N kind = %d, want string", bd.Kind)
+	}
+	v2 = stPlan{}
+	if err := dec.Decode(data, &v2); err != nil || v2.N != 42 || v2.P == nil || v2.P.N != 42 {
+		t.Errorf("dec.Decode() = %+v, %v, want N = 42", v2, err)
+	}
+
+	// Released buffers are reused.
+	enc.Release(data)
+	data2, err := enc.Encode(nil, &v)
+	if err != nil {
+		t.Fatalf("enc.Encode() returned error %v", err)
+	}
+	if &data2[0] != &data[0] {
+		t.Errorf("enc.Encode() did not reuse released buffer")
+	}
+}
+
+type stBenchmark struct {
+	Id     ObjectId "_id"
+	Name   string
+	Count  int
+	Score  float64
+	Active bool
+	Tags   []string
+	Inner  struct {
+		A int32
+		B string
+	}
+}
+
+func benchmarkValue() *stBenchmark {
+	v := &stBenchmark{Id: NewObjectId(), Name: "benchmark", Count: 42, Score: 1.5, Active: true, Tags: []string{"a", "b"}}
+	v.Inner.A = 7
+	v.Inner.B = "inner"
+	return v
+}
+
+func BenchmarkEncodeStruct(b *testing.B) {
+	v := benchmarkValue()
+	for i := 0; i < b.N; i++ {
+		Encode(nil, v)
+	}
+}
+
+func BenchmarkEncodeStructReleased(b *testing.B) {
+	v := benchmarkValue()
+	enc := NewEncoder()
+	for i := 0; i < b.N; i++ {
+		data, _ := enc.Encode(nil, v)
+		enc.Release(data)
+	}
+}
+
+// BenchmarkEncodeStructUncached is the baseline for BenchmarkEncodeStruct.
+// The encoder discards its compiled plans before every call.
+func BenchmarkEncodeStructUncached(b *testing.B) {
+	v := benchmarkValue()
+	enc := NewEncoder()
+	for i := 0; i < b.N; i++ {
+		enc.resetPlans()
+		enc.Encode(nil, v)
+	}
+}
+
+func BenchmarkEncodeMap(b *testing.B) {
+	var m M
+	data, _ := Encode(nil, benchmarkValue())
+	Decode(data, &m)
+	for i := 0; i < b.N; i++ {
+		Encode(nil, m)
+	}
+}
+
+func BenchmarkDecodeStruct(b *testing.B) {
+	var v stBenchmark
+	data, _ := Encode(nil, benchmarkValue())
+	for i := 0; i < b.N; i++ {
+		Decode(data, &v)
+	}
+}
+
+// BenchmarkDecodeStructUncached is the baseline for BenchmarkDecodeStruct.
+// The decoder discards its compiled plans before every call.
+func BenchmarkDecodeStructUncached(b *testing.B) {
+	var v stBenchmark
+	data, _ := Encode(nil, benchmarkValue())
+	dec := NewDecoder()
+	for i := 0; i < b.N; i++ {
+		dec.resetPlans()
+		dec.Decode(data, &v)
+	}
+}
+
+func BenchmarkDecodeMap(b *testing.B) {
+	data, _ := Encode(nil, benchmarkValue())
+	for i := 0; i < b.N; i++ {
+		var m M
+		Decode(data, &m)
+	}
+}
+
+type stDecodeOptions struct {
+	A int
+	B uint64
+	C float32
+	D bool
+	E [2]int
+	F map[string]int
+	G struct {
+		H int
+	} "g"
+	R int "r/required"
+}
+
+func TestDecodeOptions(t *testing.T) {
+	data, err := Encode(nil, D{
+		{"A", 1.5},
+		{"B", int32(-1)},
+		{"C", 0.1},
+		{"D", 2},
+		{"E", []int{1, 2, 3}},
+		{"F", M{"x": "str"}},
+		{"g", M{"H": "str"}},
+		{"z", 1},
+	})
+	if err != nil {
+		t.Fatalf("Encode() returned error %v", err)
+	}
+
+	var v stDecodeOptions
+	err = Decode(data, &v)
+	if _, ok := err.(*DecodeConvertError); !ok {
+		t.Errorf("Decode() returned %v, want *DecodeConvertError", err)
+	}
+	if v.A != 1 || !v.D || v.E != [2]int{1, 2} {
+		t.Errorf("Decode() = %+v", v)
+	}
+
+	dec := NewDecoderWithOptions(&DecodeOptions{Strict: true})
+	err = dec.Decode(data, &stDecodeOptions{})
+	if e, ok := err.(*DecodeFieldError); !ok || e.Path != "A" {
+		t.Errorf("strict Decode() returned %v, want *DecodeFieldError at A", err)
+	}
+
+	dec = NewDecoderWithOptions(&DecodeOptions{Strict: true, DisallowUnknownFields: true, CollectAllErrors: true})
+	err = dec.Decode(data, &stDecodeOptions{})
+	errs, ok := err.(DecodeErrors)
+	if !ok {
+		t.Fatalf("Decode() returned %v, want DecodeErrors", err)
+	}
+	var paths []string
+	for _, err := range errs {
+		paths = append(paths, err.(*DecodeFieldError).Path)
+	}
+	expected := []string{"A", "B", "C", "D", "E.2", "F.x", "g.H", "z", "r"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("error paths = %v, want %v (%v)", paths, expected, err)
+	}
+	if _, ok := errs[7].(*DecodeFieldError).Error.(*DecodeUnknownFieldError); !ok {
+		t.Errorf("errs[7] = %v, want unknown field error", errs[7])
+	}
+
+	// Exact conversions are not errors in strict mode.
+	data, _ = Encode(nil, D{{"A", 2.0}, {"B", int64(3)}, {"C", 0.5}, {"D", 1}, {"r", 1}})
+	v = stDecodeOptions{}
+	if err := dec.Decode(data, &v); err != nil || v.A != 2 || v.B != 3 || v.C != 0.5 || !v.D {
+		t.Errorf("Decode() = %+v, %v", v, err)
+	}
+}
+
+func TestLegacyKinds(t *testing.T) {
+	id, _ := NewObjectIdHex("0102030405060708090a0b0c")
+	data, err := Encode(nil, D{
+		{"u", Undefined{}},
+		{"p", DBPointer{"c", id}},
+		{"a", []interface{}{Symbol("x"), Undefined{}}},
+		{"n", 1},
+	})
+	if err != nil {
+		t.Fatalf("Encode() returned error %v", err)
+	}
+	expected := "\x38\x00\x00\x00" +
+		"\x06u\x00" +
+		"\x0cp\x00\x02\x00\x00\x00c\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c" +
+		"\x04a\x00\x11\x00\x00\x00\x0e0\x00\x02\x00\x00\x00x\x00\x061\x00\x00" +
+		"\x10n\x00\x01\x00\x00\x00\x00"
+	if string(data) != expected {
+		t.Fatalf("Encode() = %q, want %q", data, expected)
+	}
+	if err := Validate(data); err != nil {
+		t.Errorf("Validate() returned error %v", err)
+	}
+	if bd := Raw(data).Lookup("n"); bd.Kind != kindInt32 {
+		t.Errorf("Lookup(n) = %v, want int32", bd)
+	}
+
+	var m M
+	if err := Decode(data, &m); err != nil {
+		t.Fatalf("Decode() returned error %v", err)
+	}
+	expectedM := M{"u": Undefined{}, "p": DBPointer{"c", id}, "a": []interface{}{Symbol("x"), Undefined{}}, "n": 1}
+	if !reflect.DeepEqual(m, expectedM) {
+		t.Errorf("Decode() = %v, want %v", m, expectedM)
+	}
+	var v struct {
+		U Undefined "u"
+		P DBPointer "p"
+	}
+	if err := Decode(data, &v); err != nil || v.P.Namespace != "c" || v.P.Id != id {
+		t.Errorf("Decode(struct) = %+v, %v", v, err)
+	}
+
+	j, err := MarshalExtJSON(data, true)
+	if err != nil {
+		t.Fatalf("MarshalExtJSON() returned error %v", err)
+	}
+	expectedJ := `{"u":{"$undefined":true},"p":{"$dbPointer":{"$ref":"c","$id":{"$oid":"0102030405060708090a0b0c"}}},"a":[{"$symbol":"x"},{"$undefined":true}],"n":{"$numberInt":"1"}}`
+	if string(j) != expectedJ {
+		t.Errorf("MarshalExtJSON() = %s, want %s", j, expectedJ)
+	}
+	if b, err := UnmarshalExtJSON(j); err != nil || string(b) != expected {
+		t.Errorf("UnmarshalExtJSON() = %q, %v, want %q", b, err, expected)
+	}
+
+	if Compare(BSONData{Kind: kindUndefined}, nil) >= 0 {
+		t.Errorf("Compare(undefined, null) >= 0")
+	}
+
+	dec := NewDecoderWithOptions(&DecodeOptions{ConvertLegacyKinds: true})
+	m = nil
+	if err := dec.Decode(data, &m); err != nil {
+		t.Fatalf("dec.Decode() returned error %v", err)
+	}
+	expectedM = M{"p": map[string]interface{}{"$ref": "c", "$id": id}, "a": []interface{}{"x", nil}, "n": 1}
+	if !reflect.DeepEqual(m, expectedM) {
+		t.Errorf("dec.Decode() = %v, want %v", m, expectedM)
+	}
+	var r struct {
+		U *int  "u"
+		P DBRef "p"
+	}
+	if err := dec.Decode(data, &r); err != nil || r.U != nil || r.P.Collection != "c" || r.P.Id != id {
+		t.Errorf("dec.Decode(struct) = %+v, %v", r, err)
+	}
+}
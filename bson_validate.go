@@ -0,0 +1,211 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package mongo
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"utf8"
+)
+
+// MaxNestingDepth is the maximum depth of nested documents and arrays
+// accepted by Validate.
+const MaxNestingDepth = 100
+
+// ValidationError describes a problem found by Validate.
+type ValidationError struct {
+	// Offset of the invalid data from the start of the document.
+	Offset int
+
+	// Dotted path of the element containing the invalid data. The path is
+	// empty for errors in the top level document structure.
+	Path string
+
+	Msg string
+}
+
+func (e *ValidationError) String() string {
+	s := "bson: invalid document at offset " + strconv.Itoa(e.Offset)
+	if e.Path != "" {
+		s += " (" + e.Path + ")"
+	}
+	return s + ": " + e.Msg
+}
+
+// Validate checks that data is a well formed BSON document. Validate checks
+// the length prefixes, document terminators, element kinds, key and string
+// encodings and the nesting depth. If the document is not valid, then
+// Validate returns a *ValidationError.
+//
+// Decode assumes that its input is valid. Use Validate to check documents
+// from untrusted sources before decoding them.
+func Validate(data []byte) (err os.Error) {
+	defer handleAbort(&err)
+	v := validator{data: data}
+	if end := v.doc(0, len(data), 0); end != len(data) {
+		v.fail(end, "extra data after document")
+	}
+	return nil
+}
+
+type validator struct {
+	data []byte
+	path []string
+}
+
+func (v *validator) fail(offset int, msg string) {
+	abort(&ValidationError{Offset: offset, Path: strings.Join(v.path, "."), Msg: msg})
+}
+
+// int32 returns the little endian 32 bit integer at offset.
+func (v *validator) int32(offset, limit int) int {
+	if 4 > limit-offset {
+		v.fail(offset, "unexpected end of data")
+	}
+	return int(int32(wire.Uint32(v.data[offset:])))
+}
+
+// cstring returns the offset after the null terminated string at offset.
+func (v *validator) cstring(offset, limit int) int {
+	for i := offset; i < limit; i++ {
+		if v.data[i] == 0 {
+			v.utf8(offset, i)
+			return i + 1
+		}
+	}
+	v.fail(offset, "unterminated cstring")
+	panic("unreachable")
+}
+
+func (v *validator) utf8(start, end int) {
+	for i := start; i < end; {
+		if v.data[i] < utf8.RuneSelf {
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRune(v.data[i:end])
+		if r == utf8.RuneError && size == 1 {
+			v.fail(i, "invalid UTF-8")
+		}
+		i += size
+	}
+}
+
+// doc validates the document at offset and returns the offset after the
+// document. The document must end at or before limit.
+func (v *validator) doc(offset, limit, depth int) int {
+	if depth > MaxNestingDepth {
+		v.fail(offset, "maximum nesting depth exceeded")
+	}
+	n := v.int32(offset, limit)
+	if n < 5 || n > limit-offset {
+		v.fail(offset, "invalid document length "+strconv.Itoa(n))
+	}
+	end := offset + n - 1
+	if v.data[end] != 0 {
+		v.fail(end, "document not terminated")
+	}
+	i := offset + 4
+	for i < end {
+		kind := int(v.data[i])
+		if kind == 0 {
+			v.fail(i, "unexpected document terminator")
+		}
+		name := i + 1
+		i = v.cstring(name, end)
+		v.path = append(v.path, string(v.data[name:i-1]))
+		i = v.value(kind, i, end, depth)
+		v.path = v.path[:len(v.path)-1]
+	}
+	if i != end {
+		v.fail(end, "element extends past end of document")
+	}
+	return end + 1
+}
+
+// value validates the value of the given kind at offset and returns the
+// offset after the value.
+func (v *validator) value(kind, offset, limit, depth int) int {
+	fixed := func(n int) int {
+		if n > limit-offset {
+			v.fail(offset, "unexpected end of data")
+		}
+		return offset + n
+	}
+	switch kind {
+	case kindFloat, kindDateTime, kindTimestamp, kindInt64:
+		return fixed(8)
+	case kindInt32:
+		return fixed(4)
+	case kindDecimal128:
+		return fixed(16)
+	case kindObjectId:
+		return fixed(12)
+	case kindNull, kindUndefined, kindMinValue, kindMaxValue:
+		return offset
+	case kindDBPointer:
+		offset = v.string(offset, limit)
+		return fixed(12)
+	case kindBool:
+		end := fixed(1)
+		if v.data[offset] > 1 {
+			v.fail(offset, "invalid boolean")
+		}
+		return end
+	case kindString, kindCode, kindSymbol:
+		return v.string(offset, limit)
+	case kindDocument, kindArray:
+		return v.doc(offset, limit, depth+1)
+	case kindBinary:
+		n := v.int32(offset, limit)
+		if n < 0 || n > limit-offset-5 {
+			v.fail(offset, "invalid binary length "+strconv.Itoa(n))
+		}
+		if v.data[offset+4] == binaryOld && (n < 4 || v.int32(offset+5, limit) != n-4) {
+			v.fail(offset+5, "invalid old binary length")
+		}
+		return offset + 5 + n
+	case kindRegexp:
+		return v.cstring(v.cstring(offset, limit), limit)
+	case kindCodeWithScope:
+		n := v.int32(offset, limit)
+		if n < 14 || n > limit-offset {
+			v.fail(offset, "invalid code with scope length "+strconv.Itoa(n))
+		}
+		end := v.doc(v.string(offset+4, offset+n), offset+n, depth+1)
+		if end != offset+n {
+			v.fail(end, "extra data in code with scope")
+		}
+		return end
+	}
+	v.fail(offset-len(v.path[len(v.path)-1])-2, "illegal kind "+strconv.Itoa(kind))
+	panic("unreachable")
+}
+
+// string validates the length prefixed string at offset and returns the
+// offset after the string.
+func (v *validator) string(offset, limit int) int {
+	n := v.int32(offset, limit)
+	if n < 1 || n > limit-offset-4 {
+		v.fail(offset, "invalid string length "+strconv.Itoa(n))
+	}
+	end := offset + 4 + n - 1
+	if v.data[end] != 0 {
+		v.fail(end, "string not terminated")
+	}
+	v.utf8(offset+4, end)
+	return end + 1
+}
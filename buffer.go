@@ -20,6 +20,16 @@ import (
 
 var wire = binary.LittleEndian
 
+const (
+	// maxFreeBuffers is the maximum number of buffers held for reuse by an
+	// encoder or decoder.
+	maxFreeBuffers = 16
+
+	// maxRetainedBuffer is the capacity of the largest buffer held for
+	// reuse.
+	maxRetainedBuffer = 1 << 22
+)
+
 // buffer wraps a byte slice with convenience methods for writing BSON
 // encodings and MongoDB messages.
 type buffer []byte
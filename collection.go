@@ -58,46 +58,36 @@ func (c Collection) Db() Database {
 	}
 }
 
-func (c Collection) checkError(err os.Error) os.Error {
-	if err != nil {
-		return err
-	}
-	if c.LastErrorCmd == nil {
-		return nil
-	}
-	return c.Db().LastError(c.LastErrorCmd)
-}
-
 // Insert adds document to the collection.
 func (c Collection) Insert(documents ...interface{}) os.Error {
-	return c.checkError(c.Conn.Insert(c.Namespace, documents...))
+	return c.Conn.SafeInsert(c.LastErrorCmd, c.Namespace, documents...)
 }
 
 // Update updates the first document in the collection found by selector with
 // update.
 func (c Collection) Update(selector, update interface{}) os.Error {
-	return c.checkError(c.Conn.Update(c.Namespace, selector, update, nil))
+	return c.Conn.SafeUpdate(c.LastErrorCmd, c.Namespace, selector, update, nil)
 }
 
 // Upsert updates the first document found by selector with update. If no 
 // document is found, then the update is inserted instead.
 func (c Collection) Upsert(selector interface{}, update interface{}) os.Error {
-	return c.checkError(c.Conn.Update(c.Namespace, selector, update, upsertOptions))
+	return c.Conn.SafeUpdate(c.LastErrorCmd, c.Namespace, selector, update, upsertOptions)
 }
 
 // UpdateAll updates all documents matching selector with update.
 func (c Collection) UpdateAll(selector interface{}, update interface{}) os.Error {
-	return c.checkError(c.Conn.Update(c.Namespace, selector, update, updateAllOptions))
+	return c.Conn.SafeUpdate(c.LastErrorCmd, c.Namespace, selector, update, updateAllOptions)
 }
 
 // RemoveFirst removes the first document found by selector.
 func (c Collection) RemoveFirst(selector interface{}) os.Error {
-	return c.checkError(c.Conn.Remove(c.Namespace, selector, removeFirstOptions))
+	return c.Conn.SafeRemove(c.LastErrorCmd, c.Namespace, selector, removeFirstOptions)
 }
 
 // Remove removes all documents found by selector.
 func (c Collection) Remove(selector interface{}) os.Error {
-	return c.checkError(c.Conn.Remove(c.Namespace, selector, nil))
+	return c.Conn.SafeRemove(c.LastErrorCmd, c.Namespace, selector, nil)
 }
 
 // Find returns a query object for the given filter. 
@@ -160,7 +150,9 @@ type IndexOptions struct {
 	Bits int         "bits/c"
 }
 
-// CreateIndex creates an index on keys.
+// CreateIndex creates an index on keys. CreateIndex uses the createIndexes
+// command on servers that support OP_MSG. Older servers create the index
+// from a document inserted in the system.indexes collection.
 // 
 // More information:
 // 
@@ -168,11 +160,10 @@ type IndexOptions struct {
 func (c Collection) CreateIndex(keys D, options *IndexOptions) os.Error {
 	index := struct {
 		Keys      D      "key"
-		Namespace string "ns"
+		Namespace string "ns/c"
 		IndexOptions
 	}{
-		Keys:      keys,
-		Namespace: c.Namespace,
+		Keys: keys,
 	}
 
 	if options != nil {
@@ -183,6 +174,14 @@ func (c Collection) CreateIndex(keys D, options *IndexOptions) os.Error {
 		index.Name = IndexName(keys)
 	}
 
+	if c.Conn.ServerDescription().MaxWireVersion >= minMsgWireVersion {
+		return c.Db().Run(D{
+			{"createIndexes", c.Name()},
+			{"indexes", []interface{}{&index}},
+		}, nil)
+	}
+
+	index.Namespace = c.Namespace
 	if c.LastErrorCmd == nil {
 		c.LastErrorCmd = DefaultLastErrorCmd
 	}
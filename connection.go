@@ -19,8 +19,11 @@ import (
 	"io"
 	"net"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -37,23 +40,73 @@ const (
 	queryFailure         = 1 << 1
 )
 
+// maxMessageSize is the maximum size of a message accepted from the server.
+const maxMessageSize = 48 * 1024 * 1024
+
+const (
+	driverName    = "go-mongo"
+	driverVersion = "devel"
+
+	maxAppNameSize = 128
+
+	// Limits used when the server does not report limits in the handshake.
+	defaultMaxBSONObjectSize   = 16 * 1024 * 1024
+	defaultMaxMessageSizeBytes = 48000000
+	defaultMaxWriteBatchSize   = 1000
+)
+
+// A connection is safe for concurrent use. Requests are written to the socket
+// one at a time under wmu. A reader goroutine reads the replies from the
+// server and delivers each reply to the cursor waiting for it.
 type connection struct {
-	conn          net.Conn
-	addr          string
-	requestId     uint32
-	cursors       map[uint32]*cursor
-	err           os.Error
-	buf           [1024]byte
-	responseLen   int
-	responseCount int
-	cursor        *cursor
-	br            *bufio.Reader
+	conn     net.Conn
+	addr     string
+	encoder  *Encoder
+	decoder  *Decoder
+	validate bool
+
+	appName      string
+	replyTimeout int64
+
+	// Credentials used to authenticate the connection.
+	user         string
+	password     string
+	authDatabase string
+
+	// Set by the handshake.
+	desc  ServerDescription
+	opMsg bool // use OP_MSG instead of the legacy opcodes
+
+	// wmu serializes writes to conn.
+	wmu sync.Mutex
+
+	// mu protects the fields below and the replies field of the cursors.
+	mu        sync.Mutex
+	requestId uint32
+	cursors   map[uint32]*cursor // cursors waiting for a reply, by request id
+	abandoned map[uint32]*cursor // requests abandoned by the caller, by request id
+	err       os.Error
+}
+
+// reply is an OP_REPLY or OP_MSG message from the server.
+type reply struct {
+	requestId uint32
+	flags     uint32
+	cursorId  uint64
+	docs      [][]byte
+
+	// The reply is an OP_MSG message. Docs contains the body of the message.
+	msg bool
+
+	// The server sends another reply in response to this reply.
+	exhaust bool
 }
 
+// A cursor must not be used by more than one goroutine at a time.
 type cursor struct {
 	conn      *connection
 	namespace string
-	requestId uint32
+	requestId uint32 // non-zero if a reply is expected from the server
 	cursorId  uint64
 	limit     int
 	batchSize int
@@ -61,18 +114,109 @@ type cursor struct {
 	docs      [][]byte
 	flags     int
 	err       os.Error
+	dec       *Decoder
+
+	// The cursor returns the response to a command.
+	command bool
+
+	// Replies delivered by the connection reader and not yet handled.
+	replies []*reply
+
+	// ready is signaled when a reply is delivered or the connection fails.
+	ready chan bool
+}
+
+// DialOptions specifies options for the DialWithOptions function.
+type DialOptions struct {
+	// Encoder used to encode documents sent to the server. If nil, then the
+	// encodings described in the documentation for Encode are used.
+	Encoder *Encoder
+
+	// Decoder used to decode documents in Cursor.Next. If nil, then the
+	// conversions described in the documentation for Decode are used.
+	Decoder *Decoder
+
+	// If ValidateDocuments is true, then documents received from the server
+	// are checked with Validate before they are decoded. An invalid document
+	// is a fatal error on the connection.
+	ValidateDocuments bool
+
+	// Application name sent to the server in the client metadata when the
+	// connection is established. The server logs the metadata. The name is
+	// limited to 128 bytes.
+	AppName string
+
+	// If User is not empty, then the connection is authenticated as User
+	// with Password using Database.Login after the handshake. The user is
+	// defined in AuthDatabase or in the admin database if AuthDatabase is
+	// empty.
+	User         string
+	Password     string
+	AuthDatabase string
+
+	// Time in nanoseconds to wait for the reply to a request after the
+	// context of the request is done. If the reply does not arrive in this
+	// time, then the connection fails with ErrReplyTimeout. If zero, then
+	// DefaultReplyTimeout is used.
+	ReplyTimeout int64
 }
 
+// DefaultReplyTimeout is the reply timeout used when DialOptions.ReplyTimeout
+// is zero.
+const DefaultReplyTimeout = 30e9
+
 // Dial connects to server at addr.
+//
+// Dial runs the isMaster command with metadata describing the client and
+// records the server's response in the connection's ServerDescription. The
+// wire protocol versions in the response select the protocol. Operations are
+// sent to MongoDB 3.6 and later servers as commands in OP_MSG messages. On
+// these servers, Insert, Update and Remove wait for the server to acknowledge
+// the write and return write errors as a *MongoError. Operations are sent to
+// older servers using the legacy opcodes.
 func Dial(addr string) (Conn, os.Error) {
+	return DialWithOptions(addr, nil)
+}
+
+// DialWithOptions connects to server at addr using the specified options.
+func DialWithOptions(addr string, options *DialOptions) (Conn, os.Error) {
 	if strings.LastIndex(addr, ":") <= strings.LastIndex(addr, "]") {
 		addr = addr + ":27017"
 	}
-	c := connection{
-		addr:    addr,
-		cursors: make(map[uint32]*cursor),
+	c := &connection{
+		addr:         addr,
+		cursors:      make(map[uint32]*cursor),
+		abandoned:    make(map[uint32]*cursor),
+		encoder:      defaultEncoder,
+		decoder:      defaultDecoder,
+		replyTimeout: DefaultReplyTimeout,
+	}
+	if options != nil {
+		if options.Encoder != nil {
+			c.encoder = options.Encoder
+		}
+		if options.Decoder != nil {
+			c.decoder = options.Decoder
+		}
+		c.validate = options.ValidateDocuments
+		c.appName = options.AppName
+		c.user = options.User
+		c.password = options.Password
+		c.authDatabase = options.AuthDatabase
+		if options.ReplyTimeout != 0 {
+			c.replyTimeout = options.ReplyTimeout
+		}
+	}
+	if c.authDatabase == "" {
+		c.authDatabase = "admin"
 	}
-	return &c, c.connect()
+	if len(c.appName) > maxAppNameSize {
+		return nil, os.NewError("mongo: application name longer than " + strconv.Itoa(maxAppNameSize) + " bytes")
+	}
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
 func (c *connection) connect() os.Error {
@@ -80,59 +224,245 @@ func (c *connection) connect() os.Error {
 	if err != nil {
 		return err
 	}
-	if c.conn != nil {
-		c.conn.Close()
-	}
 	c.conn = conn
-	c.br = bufio.NewReader(conn)
+	go c.reader(bufio.NewReader(conn))
+	if err := c.handshake(); err != nil {
+		c.Close()
+		return err
+	}
+	if c.user != "" {
+		if err := (Database{Conn: c, Name: c.authDatabase}).Login(c.user, c.password); err != nil {
+			c.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// handshake runs the isMaster command with the client metadata and sets the
+// server description from the response.
+func (c *connection) handshake() os.Error {
+	client := D{
+		{"driver", D{{"name", driverName}, {"version", driverVersion}}},
+		{"os", D{{"type", runtime.GOOS}, {"architecture", runtime.GOARCH}}},
+		{"platform", runtime.Version()},
+	}
+	if c.appName != "" {
+		client = append(D{{"application", D{{"name", c.appName}}}}, client...)
+	}
+	var desc ServerDescription
+	if err := (Database{Conn: c, Name: "admin"}).Run(D{{"isMaster", 1}, {"client", client}}, &desc); err != nil {
+		return err
+	}
+	if desc.MaxBSONObjectSize == 0 {
+		desc.MaxBSONObjectSize = defaultMaxBSONObjectSize
+	}
+	if desc.MaxMessageSizeBytes == 0 {
+		desc.MaxMessageSizeBytes = defaultMaxMessageSizeBytes
+	}
+	if desc.MaxWriteBatchSize == 0 {
+		desc.MaxWriteBatchSize = defaultMaxWriteBatchSize
+	}
+	c.desc = desc
+	c.opMsg = desc.MaxWireVersion >= minMsgWireVersion
 	return nil
 }
 
+// ServerDescription returns the description of the server found by the
+// handshake.
+func (c *connection) ServerDescription() ServerDescription {
+	return c.desc
+}
+
+// appendDocs appends the encoding of docs to b until the message reaches the
+// size or batch limits of the server and returns the number of documents
+// appended. At least one document is appended. A document larger than the
+// maximum document size is an error.
+func (c *connection) appendDocs(b *buffer, docs []interface{}) (int, os.Error) {
+	for i, doc := range docs {
+		offset := len(*b)
+		var err os.Error
+		*b, err = c.encoder.Encode(*b, doc)
+		if err != nil {
+			return 0, err
+		}
+		if n := len(*b) - offset; n > c.desc.MaxBSONObjectSize {
+			return 0, os.NewError("mongo: document size " + strconv.Itoa(n) + " exceeds server maximum " + strconv.Itoa(c.desc.MaxBSONObjectSize))
+		}
+		if i > 0 && (len(*b) > c.desc.MaxMessageSizeBytes || i == c.desc.MaxWriteBatchSize) {
+			// Send this document in the next message.
+			*b = (*b)[:offset]
+			return i, nil
+		}
+	}
+	return len(docs), nil
+}
+
 func (c *connection) nextId() uint32 {
+	c.mu.Lock()
 	c.requestId += 1
-	return c.requestId
+	requestId := c.requestId
+	c.mu.Unlock()
+	return requestId
 }
 
-func (c *connection) fatal(err os.Error) os.Error {
-	if c.err == nil {
-		c.Close()
-		c.err = err
+// register sets cursor r to receive the reply to a new request and returns
+// the id of the request.
+func (c *connection) register(r *cursor) (uint32, os.Error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, c.err
 	}
+	c.requestId += 1
+	c.cursors[c.requestId] = r
+	r.requestId = c.requestId
+	return c.requestId, nil
+}
+
+func (c *connection) unregister(requestId uint32) {
+	c.mu.Lock()
+	c.cursors[requestId] = nil, false
+	c.mu.Unlock()
+}
+
+func (c *connection) fatal(err os.Error) os.Error {
+	c.shutdown(err)
 	return err
 }
 
+// shutdown sets the connection error, closes the socket and wakes up the
+// cursors waiting for a reply.
+func (c *connection) shutdown(err os.Error) os.Error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return nil
+	}
+	c.err = err
+	for _, r := range c.cursors {
+		r.signal()
+	}
+	return c.conn.Close()
+}
+
 // Close closes the connection to the server.
-func (c *connection) Close() (err os.Error) {
-	if c.conn != nil {
-		err = c.conn.Close()
-		c.conn = nil
-	}
-	c.cursors = nil
-	c.cursor = nil
-	c.responseCount = 0
-	c.responseLen = 0
-	c.err = os.NewError("mongo: connection closed")
-	return err
+func (c *connection) Close() os.Error {
+	return c.shutdown(os.NewError("mongo: connection closed"))
 }
 
 func (c *connection) Error() os.Error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.err
 }
 
-// send sets the message length and writes the message to the socket.
-func (c *connection) send(msg []byte) os.Error {
-	if c.err != nil {
-		return c.err
+// send sets the message length and writes the message to the socket. The
+// message buffer is released to the encoder.
+func (c *connection) send(ctx Context, msg []byte) os.Error {
+	err := c.write(ctx, msg)
+	c.encoder.Release(msg)
+	return err
+}
+
+// write sets the message lengths and writes the messages to the socket using
+// the deadline of ctx as the write timeout. No other message is written
+// between the messages.
+func (c *connection) write(ctx Context, msgs ...[]byte) os.Error {
+	if err := c.Error(); err != nil {
+		return err
 	}
-	wire.PutUint32(msg[0:4], uint32(len(msg)))
-	_, err := c.conn.Write(msg)
-	if err != nil {
-		return c.fatal(err)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		wire.PutUint32(msg[0:4], uint32(len(msg)))
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		timeout := deadline - time.Nanoseconds()
+		if timeout <= 0 {
+			return ErrDeadlineExceeded
+		}
+		c.conn.SetWriteTimeout(timeout)
+		defer c.conn.SetWriteTimeout(0)
+	}
+	for _, msg := range msgs {
+		if _, err := c.conn.Write(msg); err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				err = ErrDeadlineExceeded
+			}
+			return c.fatal(err)
+		}
 	}
 	return nil
 }
 
-func (c *connection) Update(namespace string, selector, update interface{}, options *UpdateOptions) (err os.Error) {
+// sendSafe sends the write message msg. If lastErrorCmd is not nil, then
+// sendSafe sends lastErrorCmd to the database of namespace directly after
+// the write and returns the error reported by the command. Because no other
+// request on the connection is sent between the two messages, the command
+// reports the result of this write. The message buffer is released to the
+// encoder.
+func (c *connection) sendSafe(ctx Context, msg []byte, namespace string, lastErrorCmd interface{}) os.Error {
+	if lastErrorCmd == nil {
+		return c.send(ctx, msg)
+	}
+	defer c.encoder.Release(msg)
+	dbname, _ := SplitNamespace(namespace)
+	r := &cursor{
+		conn:      c,
+		namespace: dbname + ".$cmd",
+		dec:       c.decoder,
+		ready:     make(chan bool, 1),
+		command:   true,
+		batchSize: -1,
+	}
+	requestId, err := c.register(r)
+	if err != nil {
+		return err
+	}
+	b := buffer(c.encoder.freeBuffer())
+	b.Next(4)                         // placeholder for message length
+	b.WriteUint32(requestId)          // requestId
+	b.WriteUint32(0)                  // responseTo
+	b.WriteUint32(2004)               // opCode
+	b.WriteUint32(0)                  // flags
+	b.WriteCString(r.namespace)       // namespace
+	b.WriteUint32(0)                  // numberToSkip
+	b.WriteUint32(r.numberToReturn()) // numberToReturn
+	b, err = c.encoder.Encode(b, lastErrorCmd)
+	if err == nil {
+		err = c.write(ctx, msg, b)
+	}
+	c.encoder.Release(b)
+	if err != nil {
+		c.unregister(requestId)
+		return err
+	}
+	return lastError(ctx, r)
+}
+
+func (c *connection) Update(namespace string, selector, update interface{}, options *UpdateOptions) os.Error {
+	return c.UpdateContext(Background(), namespace, selector, update, options)
+}
+
+func (c *connection) UpdateContext(ctx Context, namespace string, selector, update interface{}, options *UpdateOptions) os.Error {
+	return c.update(ctx, nil, namespace, selector, update, options)
+}
+
+func (c *connection) SafeUpdate(lastErrorCmd interface{}, namespace string, selector, update interface{}, options *UpdateOptions) os.Error {
+	return c.SafeUpdateContext(Background(), lastErrorCmd, namespace, selector, update, options)
+}
+
+func (c *connection) SafeUpdateContext(ctx Context, lastErrorCmd interface{}, namespace string, selector, update interface{}, options *UpdateOptions) os.Error {
+	return c.update(ctx, lastErrorCmd, namespace, selector, update, options)
+}
+
+func (c *connection) update(ctx Context, lastErrorCmd interface{}, namespace string, selector, update interface{}, options *UpdateOptions) (err os.Error) {
 	if selector == nil {
 		selector = emptyDoc
 	}
@@ -145,8 +475,16 @@ func (c *connection) Update(namespace string, selector, update interface{}, opti
 			flags |= updateMulti
 		}
 	}
+	if c.opMsg {
+		return c.writeMsg(ctx, lastErrorCmd, namespace, "update", "updates", []interface{}{D{
+			{"q", selector},
+			{"u", update},
+			{"upsert", flags&updateUpsert != 0},
+			{"multi", flags&updateMulti != 0},
+		}})
+	}
 
-	b := buffer(c.buf[:0])
+	b := buffer(c.encoder.freeBuffer())
 	b.Next(4)                    // placeholder for message length
 	b.WriteUint32(c.nextId())    // requestId
 	b.WriteUint32(0)             // responseTo
@@ -154,38 +492,77 @@ func (c *connection) Update(namespace string, selector, update interface{}, opti
 	b.WriteUint32(0)             // reserved
 	b.WriteCString(namespace)    // namespace
 	b.WriteUint32(uint32(flags)) // flags
-	b, err = Encode(b, selector)
+	b, err = c.encoder.Encode(b, selector)
 	if err != nil {
 		return err
 	}
-	b, err = Encode(b, update)
+	b, err = c.encoder.Encode(b, update)
 	if err != nil {
 		return err
 	}
-	return c.send(b)
+	return c.sendSafe(ctx, b, namespace, lastErrorCmd)
+}
+
+func (c *connection) Insert(namespace string, documents ...interface{}) os.Error {
+	return c.InsertContext(Background(), namespace, documents...)
+}
+
+func (c *connection) InsertContext(ctx Context, namespace string, documents ...interface{}) os.Error {
+	return c.insert(ctx, nil, namespace, documents)
+}
+
+func (c *connection) SafeInsert(lastErrorCmd interface{}, namespace string, documents ...interface{}) os.Error {
+	return c.SafeInsertContext(Background(), lastErrorCmd, namespace, documents...)
+}
+
+func (c *connection) SafeInsertContext(ctx Context, lastErrorCmd interface{}, namespace string, documents ...interface{}) os.Error {
+	return c.insert(ctx, lastErrorCmd, namespace, documents)
 }
 
-func (c *connection) Insert(namespace string, documents ...interface{}) (err os.Error) {
+func (c *connection) insert(ctx Context, lastErrorCmd interface{}, namespace string, documents []interface{}) os.Error {
 	if len(documents) == 0 {
 		return os.NewError("mongo: insert with no documents")
 	}
-	b := buffer(c.buf[:0])
-	b.Next(4)                 // placeholder for message length
-	b.WriteUint32(c.nextId()) // requestId
-	b.WriteUint32(0)          // responseTo
-	b.WriteUint32(2002)       // opCode
-	b.WriteUint32(0)          // reserved
-	b.WriteCString(namespace) // namespace
-	for _, document := range documents {
-		b, err = Encode(b, document)
+	if c.opMsg {
+		return c.writeMsg(ctx, lastErrorCmd, namespace, "insert", "documents", documents)
+	}
+	for len(documents) > 0 {
+		b := buffer(c.encoder.freeBuffer())
+		b.Next(4)                 // placeholder for message length
+		b.WriteUint32(c.nextId()) // requestId
+		b.WriteUint32(0)          // responseTo
+		b.WriteUint32(2002)       // opCode
+		b.WriteUint32(0)          // reserved
+		b.WriteCString(namespace) // namespace
+		n, err := c.appendDocs(&b, documents)
 		if err != nil {
 			return err
 		}
+		if err := c.sendSafe(ctx, b, namespace, lastErrorCmd); err != nil {
+			return err
+		}
+		documents = documents[n:]
 	}
-	return c.send(b)
+	return nil
 }
 
-func (c *connection) Remove(namespace string, selector interface{}, options *RemoveOptions) (err os.Error) {
+func (c *connection) Remove(namespace string, selector interface{}, options *RemoveOptions) os.Error {
+	return c.RemoveContext(Background(), namespace, selector, options)
+}
+
+func (c *connection) RemoveContext(ctx Context, namespace string, selector interface{}, options *RemoveOptions) os.Error {
+	return c.remove(ctx, nil, namespace, selector, options)
+}
+
+func (c *connection) SafeRemove(lastErrorCmd interface{}, namespace string, selector interface{}, options *RemoveOptions) os.Error {
+	return c.SafeRemoveContext(Background(), lastErrorCmd, namespace, selector, options)
+}
+
+func (c *connection) SafeRemoveContext(ctx Context, lastErrorCmd interface{}, namespace string, selector interface{}, options *RemoveOptions) os.Error {
+	return c.remove(ctx, lastErrorCmd, namespace, selector, options)
+}
+
+func (c *connection) remove(ctx Context, lastErrorCmd interface{}, namespace string, selector interface{}, options *RemoveOptions) (err os.Error) {
 	if selector == nil {
 		selector = emptyDoc
 	}
@@ -195,7 +572,13 @@ func (c *connection) Remove(namespace string, selector interface{}, options *Rem
 			flags |= removeSingle
 		}
 	}
-	b := buffer(c.buf[:0])
+	if c.opMsg {
+		return c.writeMsg(ctx, lastErrorCmd, namespace, "delete", "deletes", []interface{}{D{
+			{"q", selector},
+			{"limit", flags & removeSingle},
+		}})
+	}
+	b := buffer(c.encoder.freeBuffer())
 	b.Next(4)                    // placeholder for message length
 	b.WriteUint32(c.nextId())    // requestId
 	b.WriteUint32(0)             // responseTo
@@ -203,19 +586,26 @@ func (c *connection) Remove(namespace string, selector interface{}, options *Rem
 	b.WriteUint32(0)             // reserved
 	b.WriteCString(namespace)    // namespace
 	b.WriteUint32(uint32(flags)) // flags
-	b, err = Encode(b, selector)
+	b, err = c.encoder.Encode(b, selector)
 	if err != nil {
 		return err
 	}
-	return c.send(b)
+	return c.sendSafe(ctx, b, namespace, lastErrorCmd)
 }
 
 func (c *connection) Find(namespace string, query interface{}, options *FindOptions) (Cursor, os.Error) {
-	r := cursor{
+	return c.FindContext(Background(), namespace, query, options)
+}
+
+func (c *connection) FindContext(ctx Context, namespace string, query interface{}, options *FindOptions) (Cursor, os.Error) {
+	r := &cursor{
 		conn:      c,
 		namespace: namespace,
-		requestId: c.nextId(),
+		dec:       c.decoder,
+		ready:     make(chan bool, 1),
 	}
+	_, collection := SplitNamespace(namespace)
+	r.command = collection == "$cmd"
 
 	if query == nil {
 		query = emptyDoc
@@ -254,37 +644,59 @@ func (c *connection) Find(namespace string, query interface{}, options *FindOpti
 		}
 	}
 
-	b := buffer(c.buf[:0])
-	b.Next(4)                         // placeholder for message length
-	b.WriteUint32(r.requestId)        // requestId
-	b.WriteUint32(0)                  // responseTo
-	b.WriteUint32(2004)               // opCode
-	b.WriteUint32(uint32(r.flags))    // flags
-	b.WriteCString(namespace)         // namespace
-	b.WriteUint32(uint32(skip))       // numberToSkip
-	b.WriteUint32(r.numberToReturn()) // numberToReturn
-	b, err := Encode(b, query)
+	// Register the cursor before sending the query so that the reader can
+	// deliver a reply that arrives before this function returns.
+	requestId, err := c.register(r)
 	if err != nil {
 		return nil, err
 	}
-	if fields != nil {
-		b, err = Encode(b, fields)
-		if err != nil {
-			return nil, err
+
+	var b buffer
+	if c.opMsg {
+		b = c.beginMsg(requestId, 0)
+		err = c.findMsg(&b, r, query, fields, skip)
+	} else {
+		b = buffer(c.encoder.freeBuffer())
+		b.Next(4)                         // placeholder for message length
+		b.WriteUint32(requestId)          // requestId
+		b.WriteUint32(0)                  // responseTo
+		b.WriteUint32(2004)               // opCode
+		b.WriteUint32(uint32(r.flags))    // flags
+		b.WriteCString(namespace)         // namespace
+		b.WriteUint32(uint32(skip))       // numberToSkip
+		b.WriteUint32(r.numberToReturn()) // numberToReturn
+		b, err = c.encoder.Encode(b, query)
+		if err == nil && fields != nil {
+			b, err = c.encoder.Encode(b, fields)
 		}
 	}
-	err = c.send(b)
+	if err == nil {
+		err = c.send(ctx, b)
+	}
 	if err != nil {
+		c.unregister(requestId)
 		return nil, err
 	}
-
-	c.cursors[r.requestId] = &r
-	return &r, nil
+	return r, nil
 }
 
-func (c *connection) getMore(r *cursor) os.Error {
-	requestId := c.nextId()
-	b := buffer(c.buf[:0])
+func (c *connection) getMore(ctx Context, r *cursor) os.Error {
+	requestId, err := c.register(r)
+	if err != nil {
+		return err
+	}
+	if c.opMsg {
+		var flags uint32
+		if r.flags&queryExhaust != 0 {
+			flags |= msgExhaustAllowed
+		}
+		b := c.beginMsg(requestId, flags)
+		if err := c.getMoreMsg(&b, r); err != nil {
+			return err
+		}
+		return c.send(ctx, b)
+	}
+	b := buffer(c.encoder.freeBuffer())
 	b.Next(4)                   // placeholder for message length
 	b.WriteUint32(requestId)    // requestId
 	b.WriteUint32(0)            // responseTo
@@ -293,16 +705,14 @@ func (c *connection) getMore(r *cursor) os.Error {
 	b.WriteCString(r.namespace) // namespace
 	b.WriteUint32(r.numberToReturn())
 	b.WriteUint64(r.cursorId)
-	if err := c.send(b); err != nil {
-		return err
-	}
-	r.requestId = requestId
-	c.cursors[requestId] = r
-	return nil
+	return c.send(ctx, b)
 }
 
-func (c *connection) killCursors(cursorIds ...uint64) os.Error {
-	b := buffer(c.buf[:0])
+func (c *connection) killCursors(namespace string, cursorIds ...uint64) os.Error {
+	if c.opMsg {
+		return c.killCursorsMsg(namespace, cursorIds)
+	}
+	b := buffer(c.encoder.freeBuffer())
 	b.Next(4)                             // placeholder for message length
 	b.WriteUint32(c.nextId())             // requestId
 	b.WriteUint32(0)                      // responseTo
@@ -312,152 +722,104 @@ func (c *connection) killCursors(cursorIds ...uint64) os.Error {
 	for _, cursorId := range cursorIds {
 		b.WriteUint64(cursorId)
 	}
-	return c.send(b)
+	return c.send(Background(), b)
 }
 
-// readDoc reads a single document from the connection.
-func (c *connection) readDoc(alloc bool) ([]byte, os.Error) {
-	if c.responseLen < 4 {
-		return nil, c.fatal(os.NewError("mongo: incomplete document in message"))
-	}
-	b, err := c.br.Peek(4)
-	if err != nil {
-		return nil, c.fatal(err)
-	}
-	n := int(wire.Uint32(b))
-	if c.responseLen < n {
-		return nil, c.fatal(os.NewError("mongo: incomplete document in message"))
-	}
-	var p []byte
-	if n > len(c.buf) || alloc {
-		p = make([]byte, n)
-	} else {
-		p = c.buf[:n]
-	}
-	_, err = io.ReadFull(c.br, p)
-	if err != nil {
-		return nil, c.fatal(err)
-	}
-	c.responseLen -= n
-	c.responseCount -= 1
-	if c.responseCount == 0 {
-		c.cursor = nil
-		if c.responseLen != 0 {
-			return nil, c.fatal(os.NewError("mongo: unexpected data in message."))
+// reader reads replies from the server and delivers the replies to the
+// waiting cursors until an error occurs.
+func (c *connection) reader(br *bufio.Reader) {
+	for {
+		rep, responseTo, err := c.readReply(br)
+		if err != nil {
+			c.fatal(err)
+			return
 		}
-	}
-	return p, nil
-}
-
-// skipDocs skips over unread documents in the current batch.
-func (c *connection) skipDocs() os.Error {
-	for c.responseLen > 0 {
-		n := c.responseLen
-		if n > len(c.buf) {
-			n = len(c.buf)
+		c.mu.Lock()
+		c.abandoned[responseTo] = nil, false
+		r := c.cursors[responseTo]
+		if r != nil {
+			c.cursors[responseTo] = nil, false
+			if !rep.msg && r.flags&queryExhaust != 0 && rep.cursorId != 0 {
+				rep.exhaust = true
+			}
+			if rep.exhaust {
+				// The server sends the next batch as a reply to this reply.
+				c.cursors[rep.requestId] = r
+			}
+			r.replies = append(r.replies, rep)
 		}
-		var err os.Error
-		n, err = c.br.Read(c.buf[0:n])
-		if err != nil {
-			return c.fatal(err)
+		c.mu.Unlock()
+		if r != nil {
+			r.signal()
+			continue
+		}
+		namespace, cursorId := "", rep.cursorId
+		if rep.msg {
+			namespace, cursorId = orphanCursor(rep)
+		}
+		if cursorId != 0 {
+			// The cursor was closed while the request was in flight. Kill
+			// the server cursor from another goroutine so that the reader
+			// does not block on a write.
+			go c.killCursors(namespace, cursorId)
 		}
-		c.responseLen -= n
 	}
-	c.responseLen = 0
-	c.responseCount = 0
-	c.cursor = nil
-	return nil
 }
 
-// receive recieves a single response from the server and delivers it to the appropriate cursor.
-func (c *connection) receive() os.Error {
-
-	if c.err != nil {
-		return c.err
+// readReply reads a reply message from the server and returns the reply and
+// the id of the request that the reply responds to.
+func (c *connection) readReply(br *bufio.Reader) (*reply, uint32, os.Error) {
+	var header [16]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, 0, err
 	}
 
-	// Slurp up documents for current cursor.
-	for c.responseCount > 0 {
-		r := c.cursor
-		p, err := c.readDoc(true)
-		if err != nil {
-			return err
-		}
-		r.docs = append(r.docs, p)
-	}
+	n := int(wire.Uint32(header[0:4]))
+	responseTo := wire.Uint32(header[8:12])
+	opCode := int32(wire.Uint32(header[12:16]))
 
-	// Read response message header.
-	if _, err := io.ReadFull(c.br, c.buf[:36]); err != nil {
-		return c.fatal(err)
+	if opCode != 1 && opCode != 2013 {
+		return nil, 0, os.NewError("mongo: unknown response opcode " + strconv.Itoa(int(opCode)))
 	}
-
-	c.responseLen = int(wire.Uint32(c.buf[0:4]))
-	requestId := wire.Uint32(c.buf[4:8])
-	responseTo := wire.Uint32(c.buf[8:12])
-	opCode := int32(wire.Uint32(c.buf[12:16]))
-	flags := wire.Uint32(c.buf[16:20])
-	cursorId := wire.Uint64(c.buf[20:28])
-	//startingFrom := int32(wire.Uint32(c.buf[28:32]))
-	c.responseCount = int(wire.Uint32(c.buf[32:36]))
-	c.responseLen -= 36
-
-	if opCode != 1 {
-		return c.fatal(os.NewError("mongo: unknown response opcode " + strconv.Itoa(int(opCode))))
+	if n < len(header) || n > maxMessageSize {
+		return nil, 0, os.NewError("mongo: invalid message length " + strconv.Itoa(n))
 	}
 
-	r := c.cursors[responseTo]
-	if r == nil {
-		if cursorId != 0 {
-			if err := c.killCursors(cursorId); err != nil {
-				return err
-			}
-		}
-		if err := c.skipDocs(); err != nil {
-			return err
-		}
-		return c.err
+	p := make([]byte, n-len(header))
+	if _, err := io.ReadFull(br, p); err != nil {
+		return nil, 0, err
 	}
-
-	c.cursors[responseTo] = nil, false
-	r.cursorId = cursorId
-	r.requestId = 0
-	if r.flags&queryExhaust != 0 && cursorId != 0 {
-		r.requestId = requestId
-		c.cursors[requestId] = r
+	if opCode == 2013 {
+		rep, err := c.readMsg(header[:], p)
+		return rep, responseTo, err
 	}
 
-	if flags&cursorNotFound != 0 {
-		r.fatal(os.NewError("mongo: cursor not found"))
-		if c.responseCount != 0 || c.responseLen != 0 {
-			return c.fatal(os.NewError("mongo: unexpected data after cursor not found."))
-		}
+	if len(p) < 20 {
+		return nil, 0, os.NewError("mongo: invalid message length " + strconv.Itoa(n))
 	}
+	rep := &reply{requestId: wire.Uint32(header[4:8])}
+	rep.flags = wire.Uint32(p[0:4])
+	rep.cursorId = wire.Uint64(p[4:12])
+	//startingFrom := int32(wire.Uint32(p[12:16]))
+	count := int(wire.Uint32(p[16:20]))
+	p = p[20:]
 
-	if flags&queryFailure != 0 {
-		if c.responseCount != 1 {
-			return c.fatal(os.NewError("mongo: unexpected number of docs for query failure."))
-		}
-		p, err := c.readDoc(false)
+	if count < 0 || count > len(p)/5 {
+		return nil, 0, os.NewError("mongo: invalid number of documents in message")
+	}
+	rep.docs = make([][]byte, 0, count)
+	for len(p) > 0 {
+		doc, rest, err := c.splitDoc(p)
 		if err != nil {
-			return err
+			return nil, 0, err
 		}
-		var m M
-		err = Decode(p, &m)
-		if err != nil {
-			r.fatal(err)
-		} else if s, ok := m["$err"].(string); ok {
-			r.fatal(os.NewError(s))
-		} else {
-			r.fatal(os.NewError("mongo: query failure"))
-		}
-		return c.err
+		rep.docs = append(rep.docs, doc)
+		p = rest
 	}
-
-	if c.responseCount > 0 {
-		c.cursor = r
+	if len(rep.docs) != count {
+		return nil, 0, os.NewError("mongo: unexpected number of documents in message")
 	}
-
-	return c.err
+	return rep, responseTo, nil
 }
 
 func (r *cursor) numberToReturn() uint32 {
@@ -497,20 +859,145 @@ func (r *cursor) Close() os.Error {
 	if r.err != nil {
 		return nil
 	}
+	c := r.conn
+
+	// Stop the delivery of replies and collect the ids of the server cursors
+	// in the replies that were not handled.
+	c.mu.Lock()
+	for requestId, x := range c.cursors {
+		if x == r {
+			c.cursors[requestId] = nil, false
+		}
+	}
+	replies := r.replies
+	r.replies = nil
+	c.mu.Unlock()
+
+	var cursorIds []uint64
 	if r.cursorId != 0 {
-		r.conn.killCursors(r.cursorId)
+		cursorIds = append(cursorIds, r.cursorId)
 	}
-	if r.conn.cursor == r {
-		r.conn.skipDocs()
+	for _, rep := range replies {
+		if rep.cursorId != 0 && rep.cursorId != r.cursorId {
+			cursorIds = append(cursorIds, rep.cursorId)
+		}
 	}
-	if r.requestId != 0 && r.conn.cursors != nil {
-		r.conn.cursors[r.requestId] = nil, false
+	if len(cursorIds) > 0 {
+		c.killCursors(r.namespace, cursorIds...)
 	}
+
 	r.err = os.NewError("mongo: cursor closed")
 	r.conn = nil
 	return nil
 }
 
+// signal wakes up the cursor if it is waiting for a reply.
+func (r *cursor) signal() {
+	select {
+	case r.ready <- true:
+	default:
+	}
+}
+
+// wait waits for the next reply to the cursor or for ctx to be done.
+func (r *cursor) wait(ctx Context) (*reply, os.Error) {
+	c := r.conn
+	for {
+		c.mu.Lock()
+		if len(r.replies) > 0 {
+			rep := r.replies[0]
+			r.replies[0] = nil
+			r.replies = r.replies[1:]
+			c.mu.Unlock()
+			return rep, nil
+		}
+		err := c.err
+		c.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case <-r.ready:
+		case <-ctx.Done():
+			c.abandon(r)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// abandon records that the caller stopped waiting for the replies to the
+// requests of cursor r. If a reply does not arrive within the reply timeout,
+// then the server is assumed to be hung and the connection is failed so that
+// the connection is not used for more requests.
+func (c *connection) abandon(r *cursor) {
+	var requestIds []uint32
+	c.mu.Lock()
+	for requestId, x := range c.cursors {
+		if x == r {
+			c.abandoned[requestId] = r
+			requestIds = append(requestIds, requestId)
+		}
+	}
+	c.mu.Unlock()
+	if len(requestIds) == 0 {
+		return
+	}
+	go func() {
+		time.Sleep(c.replyTimeout)
+		late := false
+		c.mu.Lock()
+		for _, requestId := range requestIds {
+			if c.abandoned[requestId] != nil {
+				c.abandoned[requestId] = nil, false
+				late = true
+			}
+		}
+		c.mu.Unlock()
+		if late {
+			c.fatal(ErrReplyTimeout)
+		}
+	}()
+}
+
+// handleReply updates the cursor state from a reply.
+func (r *cursor) handleReply(rep *reply) {
+	r.requestId = 0
+	if rep.exhaust {
+		r.requestId = rep.requestId
+	}
+	if rep.msg {
+		r.handleMsgReply(rep)
+		return
+	}
+	r.cursorId = rep.cursorId
+
+	switch {
+	case rep.flags&cursorNotFound != 0:
+		r.fatal(os.NewError("mongo: cursor not found"))
+	case rep.flags&queryFailure != 0:
+		if len(rep.docs) != 1 {
+			r.fatal(os.NewError("mongo: unexpected number of docs for query failure."))
+			return
+		}
+		var m M
+		err := Decode(rep.docs[0], &m)
+		if err != nil {
+			r.fatal(err)
+		} else if s, ok := m["$err"].(string); ok {
+			r.fatal(os.NewError(s))
+		} else {
+			r.fatal(os.NewError("mongo: query failure"))
+		}
+	default:
+		r.docs = rep.docs
+	}
+}
+
+// decoder returns the decoder used by Next.
+func (r *cursor) decoder() *Decoder {
+	return r.dec
+}
+
 func (r *cursor) fatal(err os.Error) os.Error {
 	if r.err == nil {
 		r.Close()
@@ -524,6 +1011,10 @@ func (r *cursor) Error() os.Error {
 }
 
 func (r *cursor) HasNext() bool {
+	return r.HasNextContext(Background())
+}
+
+func (r *cursor) HasNextContext(ctx Context) bool {
 	// If HasNext() dectects an error other than EOF, then HasNext returns true
 	// so that the error is returned to the application on a subsequent call to
 	// Next().
@@ -532,7 +1023,7 @@ func (r *cursor) HasNext() bool {
 		return r.err != EOF
 	}
 
-	if len(r.docs) > 0 || r.conn.cursor == r {
+	if len(r.docs) > 0 {
 		return true
 	}
 
@@ -541,24 +1032,25 @@ func (r *cursor) HasNext() bool {
 			r.fatal(EOF)
 			return false
 		}
-		if err := r.conn.getMore(r); err != nil {
+		if err := r.conn.getMore(ctx, r); err != nil {
 			r.fatal(err)
 			return true
 		}
 	}
 
-	requestId := r.requestId
-	for r.requestId == requestId {
-		if err := r.conn.receive(); err != nil {
-			r.fatal(err)
-			break
-		}
+	rep, err := r.wait(ctx)
+	if err != nil {
+		// Closing the cursor kills the cursor on the server and discards
+		// the reply to the pending request, if any, when it arrives.
+		r.fatal(err)
+		return true
 	}
+	r.handleReply(rep)
 
 	switch {
 	case r.err != nil:
 		return r.err != EOF
-	case r.conn.cursor == r:
+	case len(r.docs) > 0:
 		return true
 	case r.cursorId == 0:
 		r.fatal(EOF)
@@ -570,7 +1062,11 @@ func (r *cursor) HasNext() bool {
 }
 
 func (r *cursor) Next(value interface{}) os.Error {
-	if !r.HasNext() {
+	return r.NextContext(Background(), value)
+}
+
+func (r *cursor) NextContext(ctx Context, value interface{}) os.Error {
+	if !r.HasNextContext(ctx) {
 		return EOF
 	}
 
@@ -578,23 +1074,10 @@ func (r *cursor) Next(value interface{}) os.Error {
 		return r.err
 	}
 
-	var p []byte
-	switch {
-	case len(r.docs) > 0:
-		p = r.docs[0]
-		r.docs[0] = nil
-		r.docs = r.docs[1:]
-	case r.conn.cursor == r:
-		var err os.Error
-		p, err = r.conn.readDoc(false)
-		if err != nil {
-			return r.fatal(err)
-		}
-	default:
-		panic("unexpected state")
-	}
-
-	err := Decode(p, value)
+	p := r.docs[0]
+	r.docs[0] = nil
+	r.docs = r.docs[1:]
+	err := r.dec.Decode(p, value)
 
 	r.count += 1
 	if r.limit > 0 && r.count >= r.limit {
@@ -0,0 +1,457 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package mongo
+
+import (
+	"hash/crc32"
+	"os"
+	"strconv"
+)
+
+// Servers with a maxWireVersion of at least minMsgWireVersion (MongoDB 3.6)
+// support OP_MSG. When the server supports OP_MSG, the connection sends all
+// operations as commands in OP_MSG messages:
+//
+//  Find        find command or the command in the query for <db>.$cmd
+//  getMore     getMore command
+//  Insert      insert command with the documents in a document sequence
+//  Update      update command with the update in a document sequence
+//  Remove      delete command with the selector in a document sequence
+//  killCursors killCursors command with the moreToCome flag
+//
+// Writes are acknowledged. Write errors are returned as a *MongoError from
+// Insert, Update and Remove. The getLastError command of the Safe methods is
+// not sent; its w, j, wtimeout and fsync options are sent as the writeConcern
+// of the write command.
+
+const (
+	minMsgWireVersion = 6
+
+	msgChecksumPresent = 1 << 0
+	msgMoreToCome      = 1 << 1
+	msgExhaustAllowed  = 1 << 16
+
+	// Flags that must be understood by the receiver of a message.
+	msgRequiredFlags = 0xffff
+
+	msgSectionBody     = 0
+	msgSectionSequence = 1
+
+	errorCodeCursorNotFound = 43
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// queryModifiers maps legacy query modifiers to find command fields.
+var queryModifiers = map[string]string{
+	"$orderby":     "sort",
+	"$hint":        "hint",
+	"$comment":     "comment",
+	"$max":         "max",
+	"$min":         "min",
+	"$maxScan":     "maxScan",
+	"$maxTimeMS":   "maxTimeMS",
+	"$returnKey":   "returnKey",
+	"$showDiskLoc": "showRecordId",
+	"$snapshot":    "snapshot",
+}
+
+// beginMsg returns a buffer containing the header of an OP_MSG message and
+// the kind of the body section.
+func (c *connection) beginMsg(requestId uint32, flags uint32) buffer {
+	b := buffer(c.encoder.freeBuffer())
+	b.Next(4)                   // placeholder for message length
+	b.WriteUint32(requestId)    // requestId
+	b.WriteUint32(0)            // responseTo
+	b.WriteUint32(2013)         // opCode
+	b.WriteUint32(flags)        // flagBits
+	b.WriteByte(msgSectionBody) // section kind
+	return b
+}
+
+// writeCommand writes the command document with the $db element and the
+// $readPreference element if slaveOk is true.
+func (c *connection) writeCommand(b *buffer, cmd interface{}, db string, slaveOk bool) (err os.Error) {
+	offset := len(*b)
+	*b, err = c.encoder.Encode(*b, cmd)
+	if err != nil {
+		return err
+	}
+	*b = (*b)[:len(*b)-1] // remove document terminator
+	b.WriteByte(kindString)
+	b.WriteCString("$db")
+	b.WriteUint32(uint32(len(db) + 1))
+	b.WriteCString(db)
+	if slaveOk {
+		b.WriteByte(kindDocument)
+		b.WriteCString("$readPreference")
+		*b, err = c.encoder.Encode(*b, D{{"mode", "secondaryPreferred"}})
+		if err != nil {
+			return err
+		}
+	}
+	b.WriteByte(0)
+	wire.PutUint32((*b)[offset:], uint32(len(*b)-offset))
+	return nil
+}
+
+// readMsg parses the OP_MSG message p with the given header and returns a
+// reply with the body of the message in docs.
+func (c *connection) readMsg(header, p []byte) (*reply, os.Error) {
+	rep := &reply{requestId: wire.Uint32(header[4:8]), msg: true}
+	if len(p) < 4 {
+		return nil, os.NewError("mongo: invalid message length")
+	}
+	rep.flags = wire.Uint32(p)
+	if rep.flags&msgRequiredFlags&^(msgChecksumPresent|msgMoreToCome) != 0 {
+		return nil, os.NewError("mongo: unknown required message flags " + strconv.Itoa(int(rep.flags)))
+	}
+	rep.exhaust = rep.flags&msgMoreToCome != 0
+	if rep.flags&msgChecksumPresent != 0 {
+		if len(p) < 8 {
+			return nil, os.NewError("mongo: invalid message length")
+		}
+		sum := crc32.Update(crc32.Checksum(header, castagnoliTable), castagnoliTable, p[:len(p)-4])
+		if sum != wire.Uint32(p[len(p)-4:]) {
+			return nil, os.NewError("mongo: message checksum mismatch")
+		}
+		p = p[:len(p)-4]
+	}
+	p = p[4:]
+	for len(p) > 0 {
+		kind := p[0]
+		p = p[1:]
+		switch kind {
+		case msgSectionBody:
+			if len(rep.docs) != 0 {
+				return nil, os.NewError("mongo: multiple body sections in message")
+			}
+			doc, rest, err := c.splitDoc(p)
+			if err != nil {
+				return nil, err
+			}
+			rep.docs = append(rep.docs, doc)
+			p = rest
+		case msgSectionSequence:
+			// The commands sent by the connection do not return document
+			// sequences. Skip the section after checking the length.
+			if len(p) < 4 {
+				return nil, os.NewError("mongo: incomplete section in message")
+			}
+			n := int(wire.Uint32(p))
+			if n < 4 || n > len(p) {
+				return nil, os.NewError("mongo: incomplete section in message")
+			}
+			p = p[n:]
+		default:
+			return nil, os.NewError("mongo: unknown message section kind " + strconv.Itoa(int(kind)))
+		}
+	}
+	if len(rep.docs) != 1 {
+		return nil, os.NewError("mongo: message without body")
+	}
+	return rep, nil
+}
+
+// findMsg writes the find command for cursor r to b.
+func (c *connection) findMsg(b *buffer, r *cursor, query, fields interface{}, skip int) os.Error {
+	slaveOk := r.flags&querySlaveOk != 0
+	db, collection := SplitNamespace(r.namespace)
+	if r.command {
+		return c.writeCommand(b, query, db, slaveOk)
+	}
+
+	p, err := c.encoder.Encode(nil, query)
+	if err != nil {
+		return err
+	}
+	defer c.encoder.Release(p)
+	elements, err := Raw(p).Elements()
+	if err != nil {
+		return err
+	}
+
+	cmd := D{{"find", collection}}
+	explain := false
+	if len(elements) > 0 && (elements[0].Name == "$query" || elements[0].Name == "query") {
+		for _, e := range elements {
+			switch e.Name {
+			case "$query", "query":
+				cmd.Append("filter", e.Value)
+			case "$explain":
+				explain = e.Value.Kind != kindBool || e.Value.Data[0] != 0
+			default:
+				if name, ok := queryModifiers[e.Name]; ok {
+					cmd.Append(name, e.Value)
+				} else {
+					return os.NewError("mongo: unsupported query modifier " + e.Name)
+				}
+			}
+		}
+	} else {
+		cmd.Append("filter", BSONData{kindDocument, p})
+	}
+	if fields != nil {
+		cmd.Append("projection", fields)
+	}
+	if skip > 0 {
+		cmd.Append("skip", skip)
+	}
+	if r.limit > 0 {
+		cmd.Append("limit", r.limit)
+	}
+	if r.batchSize != 0 {
+		cmd.Append("batchSize", abs(r.batchSize))
+	}
+	if r.batchSize < 0 {
+		cmd.Append("singleBatch", true)
+	}
+	if r.flags&queryTailable != 0 {
+		cmd.Append("tailable", true)
+	}
+	if r.flags&queryAwaitData != 0 {
+		cmd.Append("awaitData", true)
+	}
+	if r.flags&queryNoCursorTimeout != 0 {
+		cmd.Append("noCursorTimeout", true)
+	}
+	if r.flags&queryPartialResults != 0 {
+		cmd.Append("allowPartialResults", true)
+	}
+	if explain {
+		// The explain output is returned as a single document.
+		r.command = true
+		cmd = D{{"explain", cmd}}
+	}
+	return c.writeCommand(b, cmd, db, slaveOk)
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// getMoreMsg writes the getMore command for cursor r to b.
+func (c *connection) getMoreMsg(b *buffer, r *cursor) os.Error {
+	db, collection := SplitNamespace(r.namespace)
+	cmd := D{{"getMore", int64(r.cursorId)}, {"collection", collection}}
+	if r.batchSize != 0 {
+		cmd.Append("batchSize", abs(r.batchSize))
+	}
+	return c.writeCommand(b, cmd, db, false)
+}
+
+// killCursorsMsg sends the killCursors command. The server does not reply to
+// the command.
+func (c *connection) killCursorsMsg(namespace string, cursorIds []uint64) os.Error {
+	db, collection := SplitNamespace(namespace)
+	ids := make([]int64, len(cursorIds))
+	for i, cursorId := range cursorIds {
+		ids[i] = int64(cursorId)
+	}
+	b := c.beginMsg(c.nextId(), msgMoreToCome)
+	if err := c.writeCommand(&b, D{{"killCursors", collection}, {"cursors", ids}}, db, false); err != nil {
+		return err
+	}
+	return c.send(Background(), b)
+}
+
+// writeConcernFields are the fields of a getLastError command copied to the
+// write concern of a write command.
+var writeConcernFields = []string{"w", "j", "wtimeout", "fsync"}
+
+// writeConcern returns the write concern for the options in the getLastError
+// command lastErrorCmd. The write concern is empty if lastErrorCmd is nil or
+// does not have options.
+func (c *connection) writeConcern(lastErrorCmd interface{}) (D, os.Error) {
+	if lastErrorCmd == nil {
+		return nil, nil
+	}
+	p, err := c.encoder.Encode(nil, lastErrorCmd)
+	if err != nil {
+		return nil, err
+	}
+	var wc D
+	for _, name := range writeConcernFields {
+		if v := Raw(p).Lookup(name); v.Kind != 0 {
+			wc.Append(name, v)
+		}
+	}
+	return wc, nil
+}
+
+// writeMsg runs the insert, update or delete command with docs in a document
+// sequence. Docs are split into batches that fit the limits of the server.
+// The batches are sent in order until a batch fails. The write concern options
+// in lastErrorCmd are sent with the command.
+func (c *connection) writeMsg(ctx Context, lastErrorCmd interface{}, namespace, command, identifier string, docs []interface{}) os.Error {
+	db, collection := SplitNamespace(namespace)
+	cmd := D{{command, collection}}
+	wc, err := c.writeConcern(lastErrorCmd)
+	if err != nil {
+		return err
+	}
+	if len(wc) > 0 {
+		cmd.Append("writeConcern", wc)
+	}
+	for len(docs) > 0 {
+		n, err := c.writeBatch(ctx, cmd, db, identifier, docs)
+		if err != nil {
+			return err
+		}
+		docs = docs[n:]
+	}
+	return nil
+}
+
+// writeBatch runs the command with a batch from docs and returns the number of
+// documents in the batch.
+func (c *connection) writeBatch(ctx Context, cmd D, db, identifier string, docs []interface{}) (int, os.Error) {
+	r := &cursor{conn: c, ready: make(chan bool, 1)}
+	requestId, err := c.register(r)
+	if err != nil {
+		return 0, err
+	}
+	defer c.unregister(requestId)
+
+	b := c.beginMsg(requestId, 0)
+	if err := c.writeCommand(&b, cmd, db, false); err != nil {
+		return 0, err
+	}
+	b.WriteByte(msgSectionSequence)
+	offset := len(b)
+	b.Next(4) // placeholder for section length
+	b.WriteCString(identifier)
+	n, err := c.appendDocs(&b, docs)
+	if err != nil {
+		return 0, err
+	}
+	wire.PutUint32(b[offset:], uint32(len(b)-offset))
+	if err := c.send(ctx, b); err != nil {
+		return 0, err
+	}
+
+	rep, err := r.wait(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var res writeResponse
+	if err := Decode(rep.docs[0], &res); err != nil {
+		return 0, err
+	}
+	return n, res.error()
+}
+
+// commandError is the error information in a command response.
+type commandError struct {
+	Errmsg string "errmsg"
+	Code   int    "code"
+}
+
+type writeResponse struct {
+	Ok                bool           "ok"
+	N                 int            "n"
+	Errmsg            string         "errmsg"
+	Code              int            "code"
+	WriteErrors       []commandError "writeErrors"
+	WriteConcernError *commandError  "writeConcernError"
+}
+
+func (res *writeResponse) error() os.Error {
+	switch {
+	case !res.Ok:
+		return &MongoError{Err: res.Errmsg, N: res.N, Code: res.Code}
+	case len(res.WriteErrors) > 0:
+		return &MongoError{Err: res.WriteErrors[0].Errmsg, N: res.N, Code: res.WriteErrors[0].Code}
+	case res.WriteConcernError != nil:
+		return &MongoError{Err: res.WriteConcernError.Errmsg, N: res.N, Code: res.WriteConcernError.Code}
+	}
+	return nil
+}
+
+type cursorResponse struct {
+	Ok     bool   "ok"
+	Errmsg string "errmsg"
+	Code   int    "code"
+	Cursor struct {
+		Id         int64  "id"
+		Ns         string "ns"
+		FirstBatch []Raw  "firstBatch"
+		NextBatch  []Raw  "nextBatch"
+	} "cursor"
+}
+
+// orphanCursor returns the namespace and id of the server cursor in a reply
+// to a find or getMore command. The id is zero if the reply does not have a
+// cursor or the reply is malformed.
+func orphanCursor(rep *reply) (string, uint64) {
+	id, ok := Raw(rep.docs[0]).Lookup("cursor.id").Int64OK()
+	if !ok {
+		return "", 0
+	}
+	ns, _ := Raw(rep.docs[0]).Lookup("cursor.ns").StringOK()
+	return ns, uint64(id)
+}
+
+// handleMsgReply updates the cursor state from an OP_MSG reply.
+func (r *cursor) handleMsgReply(rep *reply) {
+	if r.command {
+		r.cursorId = 0
+		r.docs = rep.docs
+		return
+	}
+	var res cursorResponse
+	if err := Decode(rep.docs[0], &res); err != nil {
+		r.fatal(err)
+		return
+	}
+	r.cursorId = uint64(res.Cursor.Id)
+	switch {
+	case res.Ok:
+		batch := res.Cursor.FirstBatch
+		if batch == nil {
+			batch = res.Cursor.NextBatch
+		}
+		r.docs = make([][]byte, len(batch))
+		for i, doc := range batch {
+			r.docs[i] = doc
+		}
+	case res.Code == errorCodeCursorNotFound:
+		r.fatal(os.NewError("mongo: cursor not found"))
+	case res.Errmsg != "":
+		r.fatal(os.NewError(res.Errmsg))
+	default:
+		r.fatal(os.NewError("mongo: query failure"))
+	}
+}
+
+// splitDoc returns the document at the start of p and the remaining data.
+func (c *connection) splitDoc(p []byte) ([]byte, []byte, os.Error) {
+	if len(p) < 4 {
+		return nil, nil, os.NewError("mongo: incomplete document in message")
+	}
+	n := int(wire.Uint32(p))
+	if n < 5 || n > len(p) {
+		return nil, nil, os.NewError("mongo: incomplete document in message")
+	}
+	if c.validate {
+		if err := Validate(p[:n]); err != nil {
+			return nil, nil, err
+		}
+	}
+	return p[:n], p[n:], nil
+}
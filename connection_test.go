@@ -15,8 +15,17 @@
 package mongo
 
 import (
-	"testing"
+	"bufio"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
 	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
 )
 
 func dialAndDrop(t *testing.T, dbname, collectionName string) Collection {
@@ -305,3 +314,1192 @@ func TestCursorCloseAfterConnectionClose(t *testing.T) {
 	r.Close()
 	r.Next(&m)
 }
+
+// fakeServer implements the parts of the wire protocol used by the
+// connection tests that do not require a database server. Replies are delayed
+// by varying amounts so that the replies to concurrent requests arrive out of
+// order. The server uses OP_MSG if maxWireVersion is at least
+// minMsgWireVersion.
+type fakeServer struct {
+	ln             net.Listener
+	maxWireVersion int
+	query          func(namespace string, query M) ([]M, os.Error)
+
+	mu        sync.Mutex
+	limits    M           // limits reported by isMaster
+	client    interface{} // client metadata from isMaster
+	requestId uint32
+	cursorId  uint64
+	cursors   map[uint64][]M
+	inserts   int // number of insert messages
+	inserted  []M
+	lastErrs  int       // number of getLastError commands
+	block     chan bool // if not nil, replies wait for the channel to close
+	concerns  []M       // write concerns of the write commands
+	killed    []uint64
+	commands  [][]string // element names of the commands
+}
+
+func newFakeServer(t *testing.T, query func(namespace string, query M) ([]M, os.Error)) *fakeServer {
+	return newFakeServerVersion(t, 0, query)
+}
+
+func newFakeServerVersion(t *testing.T, maxWireVersion int, query func(namespace string, query M) ([]M, os.Error)) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen", err)
+	}
+	s := &fakeServer{ln: ln, maxWireVersion: maxWireVersion, query: query, cursors: make(map[uint64][]M)}
+	go s.serve()
+	return s
+}
+
+func (s *fakeServer) dial(t *testing.T) Conn {
+	c, err := Dial(s.ln.Addr().String())
+	if err != nil {
+		t.Fatal("dial", err)
+	}
+	return c
+}
+
+func (s *fakeServer) Close() {
+	s.ln.Close()
+}
+
+func (s *fakeServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func fakeCString(p []byte) (string, []byte) {
+	i := 0
+	for p[i] != 0 {
+		i++
+	}
+	return string(p[:i]), p[i+1:]
+}
+
+func fakeDoc(p []byte) (M, []byte) {
+	n := int(wire.Uint32(p))
+	var m M
+	Decode(p[:n], &m)
+	return m, p[n:]
+}
+
+func (s *fakeServer) nextId() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requestId += 1
+	return s.requestId
+}
+
+func fakeReply(responseTo, flags uint32, cursorId uint64, docs []M) []byte {
+	var b buffer
+	b.Next(4)                        // placeholder for message length
+	b.WriteUint32(0)                 // requestId
+	b.WriteUint32(responseTo)        // responseTo
+	b.WriteUint32(1)                 // opCode
+	b.WriteUint32(flags)             // flags
+	b.WriteUint64(cursorId)          // cursorId
+	b.WriteUint32(0)                 // startingFrom
+	b.WriteUint32(uint32(len(docs))) // numberReturned
+	for _, doc := range docs {
+		b, _ = Encode(b, doc)
+	}
+	wire.PutUint32(b[0:4], uint32(len(b)))
+	return b
+}
+
+// fakeMsg returns an OP_MSG message with the given body and a checksum.
+func fakeMsg(requestId, responseTo, flags uint32, body interface{}) []byte {
+	var b buffer
+	b.Next(4)                                 // placeholder for message length
+	b.WriteUint32(requestId)                  // requestId
+	b.WriteUint32(responseTo)                 // responseTo
+	b.WriteUint32(2013)                       // opCode
+	b.WriteUint32(flags | msgChecksumPresent) // flagBits
+	b.WriteByte(msgSectionBody)               // section kind
+	b, _ = Encode(b, body)                    // body
+	wire.PutUint32(b[0:4], uint32(len(b)+4))  // message length
+	b.WriteUint32(crc32.Checksum(b, castagnoliTable))
+	return b
+}
+
+// nextBatch returns the next batch of docs. The remaining documents are
+// saved for getMore.
+func (s *fakeServer) nextBatch(cursorId uint64, docs []M, batchSize int, singleBatch bool) ([]M, uint64) {
+	if batchSize == 0 || batchSize > len(docs) {
+		batchSize = len(docs)
+	}
+	if singleBatch || batchSize == len(docs) {
+		return docs, 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cursorId == 0 {
+		s.cursorId += 1
+		cursorId = s.cursorId
+	}
+	s.cursors[cursorId] = docs[batchSize:]
+	return docs[:batchSize], cursorId
+}
+
+// takeCursor returns the documents for cursorId and removes the cursor.
+func (s *fakeServer) takeCursor(cursorId uint64) ([]M, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	docs, ok := s.cursors[cursorId]
+	s.cursors[cursorId] = nil, false
+	return docs, ok
+}
+
+func (s *fakeServer) isMaster(query M) M {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.client = query["client"]
+	result := M{"ismaster": true, "maxWireVersion": s.maxWireVersion, "ok": 1}
+	for k, v := range s.limits {
+		result[k] = v
+	}
+	return result
+}
+
+func (s *fakeServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	var wmu sync.Mutex
+	var lastError M // error from the last write on the connection
+	br := bufio.NewReader(conn)
+	for {
+		var header [16]byte
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			return
+		}
+		p := make([]byte, int(wire.Uint32(header[0:4]))-len(header))
+		if _, err := io.ReadFull(br, p); err != nil {
+			return
+		}
+		requestId := wire.Uint32(header[4:8])
+		var msgs [][]byte
+		switch wire.Uint32(header[12:16]) {
+		case 2002: // insert
+			_, p = fakeCString(p[4:])
+			lastError = nil
+			s.mu.Lock()
+			s.inserts += 1
+			for len(p) > 0 {
+				var m M
+				m, p = fakeDoc(p)
+				if m["fail"] != nil {
+					lastError = M{"err": "E11000 duplicate key", "code": 11000}
+					break
+				}
+				s.inserted = append(s.inserted, m)
+			}
+			s.mu.Unlock()
+		case 2004: // query
+			var namespace string
+			namespace, p = fakeCString(p[4:])
+			numberToReturn := int(int32(wire.Uint32(p[4:8])))
+			query, _ := fakeDoc(p[8:])
+			if _, ok := query["isMaster"]; ok {
+				msgs = append(msgs, fakeReply(requestId, 0, 0, []M{s.isMaster(query)}))
+				break
+			}
+			if _, ok := query["getLastError"]; ok {
+				s.mu.Lock()
+				s.lastErrs += 1
+				s.mu.Unlock()
+				result := M{"ok": 1, "n": 0}
+				for k, v := range lastError {
+					result[k] = v
+				}
+				lastError = nil
+				msgs = append(msgs, fakeReply(requestId, 0, 0, []M{result}))
+				break
+			}
+			docs, err := s.query(namespace, query)
+			if err != nil {
+				msgs = append(msgs, fakeReply(requestId, queryFailure, 0, []M{{"$err": err.String()}}))
+				break
+			}
+			docs, cursorId := s.nextBatch(0, docs, abs(numberToReturn), numberToReturn < 0)
+			msgs = append(msgs, fakeReply(requestId, 0, cursorId, docs))
+		case 2005: // getMore
+			_, p = fakeCString(p[4:])
+			numberToReturn := int(int32(wire.Uint32(p[0:4])))
+			cursorId := wire.Uint64(p[4:12])
+			if docs, ok := s.takeCursor(cursorId); ok {
+				docs, cursorId = s.nextBatch(cursorId, docs, abs(numberToReturn), numberToReturn < 0)
+				msgs = append(msgs, fakeReply(requestId, 0, cursorId, docs))
+			} else {
+				msgs = append(msgs, fakeReply(requestId, cursorNotFound, 0, nil))
+			}
+		case 2007: // killCursors
+			n := int(wire.Uint32(p[4:8]))
+			for i := 0; i < n; i++ {
+				s.killCursor(wire.Uint64(p[8+8*i:]))
+			}
+		case 2013: // msg
+			msgs = s.serveMsg(requestId, p)
+		}
+		if msgs != nil {
+			s.mu.Lock()
+			block := s.block
+			s.mu.Unlock()
+			go func() {
+				if block != nil {
+					<-block
+				}
+				time.Sleep(int64(requestId%5) * 1e5)
+				wmu.Lock()
+				for _, msg := range msgs {
+					conn.Write(msg)
+				}
+				wmu.Unlock()
+			}()
+		}
+	}
+}
+
+func (s *fakeServer) killCursor(cursorId uint64) {
+	s.mu.Lock()
+	s.cursors[cursorId] = nil, false
+	s.killed = append(s.killed, cursorId)
+	s.mu.Unlock()
+}
+
+// serveMsg runs the command in an OP_MSG message and returns the replies.
+func (s *fakeServer) serveMsg(requestId uint32, p []byte) [][]byte {
+	flags := wire.Uint32(p[0:4])
+	p = p[4:]
+	sequences := make(map[string][]M)
+	var body M
+	var raw Raw
+	var names []string
+	for len(p) > 0 {
+		kind := p[0]
+		p = p[1:]
+		if kind == msgSectionBody {
+			raw = Raw(p[:wire.Uint32(p)])
+			elements, _ := raw.Elements()
+			for _, e := range elements {
+				names = append(names, e.Name)
+			}
+			body, p = fakeDoc(p)
+			continue
+		}
+		n := int(wire.Uint32(p))
+		identifier, q := fakeCString(p[4:n])
+		for len(q) > 0 {
+			var m M
+			m, q = fakeDoc(q)
+			sequences[identifier] = append(sequences[identifier], m)
+		}
+		p = p[n:]
+	}
+	s.mu.Lock()
+	s.commands = append(s.commands, names)
+	switch names[0] {
+	case "insert", "update", "delete":
+		wc, _ := body["writeConcern"].(map[string]interface{})
+		s.concerns = append(s.concerns, M(wc))
+	}
+	s.mu.Unlock()
+
+	db := body["$db"].(string)
+	var result M
+	var more []M
+	switch names[0] {
+	case "isMaster":
+		result = s.isMaster(body)
+	case "find":
+		var filter M
+		raw.Lookup("filter").Decode(&filter)
+		batchSize, _ := body["batchSize"].(int)
+		singleBatch, _ := body["singleBatch"].(bool)
+		ns := db + "." + body["find"].(string)
+		docs, err := s.query(ns, filter)
+		if err != nil {
+			result = M{"ok": 0, "errmsg": err.String(), "code": 2}
+			break
+		}
+		docs, cursorId := s.nextBatch(0, docs, batchSize, singleBatch)
+		result = M{"cursor": M{"id": int64(cursorId), "ns": ns, "firstBatch": docs}, "ok": 1}
+	case "getMore":
+		batchSize, _ := body["batchSize"].(int)
+		cursorId := uint64(body["getMore"].(int64))
+		ns := db + "." + body["collection"].(string)
+		docs, ok := s.takeCursor(cursorId)
+		if !ok {
+			result = M{"ok": 0, "errmsg": "cursor not found", "code": errorCodeCursorNotFound}
+			break
+		}
+		docs, cursorId = s.nextBatch(cursorId, docs, batchSize, false)
+		result = M{"cursor": M{"id": int64(cursorId), "ns": ns, "nextBatch": docs}, "ok": 1}
+		if flags&msgExhaustAllowed != 0 {
+			// Send the remaining batches without waiting for requests.
+			var replies [][]byte
+			responseTo := requestId
+			for cursorId != 0 {
+				id := s.nextId()
+				replies = append(replies, fakeMsg(id, responseTo, msgMoreToCome, result))
+				responseTo = id
+				docs, _ = s.takeCursor(cursorId)
+				docs, cursorId = s.nextBatch(cursorId, docs, batchSize, false)
+				result = M{"cursor": M{"id": int64(cursorId), "ns": ns, "nextBatch": docs}, "ok": 1}
+			}
+			return append(replies, fakeMsg(s.nextId(), responseTo, 0, result))
+		}
+	case "killCursors":
+		for _, id := range body["cursors"].([]interface{}) {
+			s.killCursor(uint64(id.(int64)))
+		}
+	case "insert":
+		s.mu.Lock()
+		s.inserts += 1
+		s.mu.Unlock()
+		for _, doc := range sequences["documents"] {
+			if doc["fail"] != nil {
+				more = append(more, M{"index": 0, "code": 11000, "errmsg": "duplicate key"})
+				continue
+			}
+			s.mu.Lock()
+			s.inserted = append(s.inserted, doc)
+			s.mu.Unlock()
+		}
+		result = M{"n": len(sequences["documents"]) - len(more), "ok": 1}
+		if more != nil {
+			result["writeErrors"] = more
+		}
+	case "update", "delete":
+		n := len(sequences["updates"]) + len(sequences["deletes"])
+		result = M{"n": n, "ok": 1}
+	default:
+		docs, err := s.query(db+".$cmd", body)
+		if err != nil {
+			result = M{"ok": 0, "errmsg": err.String()}
+		} else {
+			result = docs[0]
+		}
+	}
+	if flags&msgMoreToCome != 0 {
+		return nil
+	}
+	return [][]byte{fakeMsg(s.nextId(), requestId, 0, result)}
+}
+
+// sequenceQuery returns documents {q: <query q>, i: 0}, ... {q: <query q>, i:
+// <query n> - 1}. The query fails if the query q is negative.
+func sequenceQuery(namespace string, query M) ([]M, os.Error) {
+	q, _ := query["q"].(int)
+	n, _ := query["n"].(int)
+	if q < 0 {
+		return nil, os.NewError("query failed")
+	}
+	docs := make([]M, n)
+	for i := range docs {
+		docs[i] = M{"q": q, "i": i}
+	}
+	return docs, nil
+}
+
+func TestConcurrentFind(t *testing.T) {
+	testConcurrentFind(t, 0)
+}
+
+func TestMsgConcurrentFind(t *testing.T) {
+	testConcurrentFind(t, minMsgWireVersion)
+}
+
+func testConcurrentFind(t *testing.T, maxWireVersion int) {
+	s := newFakeServerVersion(t, maxWireVersion, sequenceQuery)
+	defer s.Close()
+	c := s.dial(t)
+	defer c.Close()
+
+	const n = 20
+	errs := make(chan os.Error, n)
+	for q := 0; q < n; q++ {
+		go func(q int) {
+			if q%5 == 4 {
+				r, err := c.Find("db.c", M{"q": -q}, nil)
+				if err == nil {
+					err = r.Next(&M{})
+					r.Close()
+				}
+				if err == nil || err.String() != "query failed" {
+					errs <- os.NewError("expected query failure, got " + fmt.Sprint(err))
+					return
+				}
+				errs <- nil
+				return
+			}
+			r, err := c.Find("db.c", M{"q": q, "n": 25}, &FindOptions{BatchSize: 3})
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer r.Close()
+			i := 0
+			for r.HasNext() {
+				var m struct {
+					Q int "q"
+					I int "i"
+				}
+				if err := r.Next(&m); err != nil {
+					errs <- err
+					return
+				}
+				if m.Q != q || m.I != i {
+					errs <- os.NewError(fmt.Sprintf("query %d: got %+v, want i=%d", q, m, i))
+					return
+				}
+				i++
+			}
+			if i != 25 {
+				errs <- os.NewError(fmt.Sprintf("query %d: got %d documents, want 25", q, i))
+				return
+			}
+			errs <- r.Error()
+		}(q)
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil && err != EOF {
+			t.Error(err)
+		}
+	}
+}
+
+func TestConcurrentInsert(t *testing.T) {
+	testConcurrentInsert(t, 0)
+}
+
+func TestMsgConcurrentInsert(t *testing.T) {
+	testConcurrentInsert(t, minMsgWireVersion)
+}
+
+func testConcurrentInsert(t *testing.T, maxWireVersion int) {
+	s := newFakeServerVersion(t, maxWireVersion, sequenceQuery)
+	defer s.Close()
+	c := s.dial(t)
+	defer c.Close()
+
+	const n = 20
+	done := make(chan os.Error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			done <- c.Insert("db.c", M{"x": i}, M{"x": i + n})
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		if err := <-done; err != nil {
+			t.Fatal("insert", err)
+		}
+	}
+
+	// The server handles the messages in order. The reply to the query
+	// follows the handling of the inserts.
+	r, err := c.Find("db.c", M{"n": 1}, nil)
+	if err != nil {
+		t.Fatal("find", err)
+	}
+	r.Next(&M{})
+	r.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[int]bool)
+	for _, m := range s.inserted {
+		seen[m["x"].(int)] = true
+	}
+	if len(s.inserted) != 2*n || len(seen) != 2*n {
+		t.Errorf("inserted %d documents with %d distinct values, want %d", len(s.inserted), len(seen), 2*n)
+	}
+}
+
+func TestCloseConnectionWithWaitingCursors(t *testing.T) {
+	block := make(chan bool)
+	s := newFakeServer(t, func(namespace string, query M) ([]M, os.Error) {
+		<-block
+		return nil, nil
+	})
+	defer s.Close()
+	defer close(block)
+	c := s.dial(t)
+
+	const n = 5
+	errs := make(chan os.Error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			r, err := c.Find("db.c", nil, nil)
+			if err != nil {
+				errs <- err
+				return
+			}
+			r.HasNext()
+			errs <- r.Error()
+		}()
+	}
+	time.Sleep(1e7)
+	c.Close()
+	for i := 0; i < n; i++ {
+		if err := <-errs; err == nil || err == EOF {
+			t.Errorf("expected error, got %v", err)
+		}
+	}
+	if _, err := c.Find("db.c", nil, nil); err == nil {
+		t.Error("expected error from find on closed connection")
+	}
+}
+
+func TestCursorCloseKillsServerCursor(t *testing.T) {
+	testCursorCloseKillsServerCursor(t, 0)
+}
+
+func TestMsgCursorCloseKillsServerCursor(t *testing.T) {
+	testCursorCloseKillsServerCursor(t, minMsgWireVersion)
+}
+
+func testCursorCloseKillsServerCursor(t *testing.T, maxWireVersion int) {
+	s := newFakeServerVersion(t, maxWireVersion, sequenceQuery)
+	defer s.Close()
+	c := s.dial(t)
+	defer c.Close()
+
+	r, err := c.Find("db.c", M{"n": 10}, &FindOptions{BatchSize: 2})
+	if err != nil {
+		t.Fatal("find", err)
+	}
+	if err := r.Next(&M{}); err != nil {
+		t.Fatal("next", err)
+	}
+	r.Close()
+
+	// Wait for the server to handle the kill cursors message.
+	r, err = c.Find("db.c", M{"n": 1}, nil)
+	if err != nil {
+		t.Fatal("find", err)
+	}
+	r.Next(&M{})
+	r.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.killed) != 1 || len(s.cursors) != 0 {
+		t.Errorf("killed %v, open cursors %d, want one killed and none open", s.killed, len(s.cursors))
+	}
+}
+
+// waitKilled waits for the server to kill n cursors.
+func (s *fakeServer) waitKilled(n int) []uint64 {
+	for i := 0; i < 100; i++ {
+		s.mu.Lock()
+		killed := s.killed
+		s.mu.Unlock()
+		if len(killed) >= n {
+			return killed
+		}
+		time.Sleep(1e7)
+	}
+	return nil
+}
+
+func TestFindContextDeadline(t *testing.T) {
+	block := make(chan bool)
+	s := newFakeServer(t, func(namespace string, query M) ([]M, os.Error) {
+		if query["block"] != nil {
+			<-block
+		}
+		return sequenceQuery(namespace, query)
+	})
+	defer s.Close()
+	c := s.dial(t)
+	defer c.Close()
+
+	ctx, cancel := WithTimeout(Background(), 2e7)
+	defer cancel()
+	r, err := c.FindContext(ctx, "db.c", M{"block": true, "n": 10}, &FindOptions{BatchSize: 2})
+	if err != nil {
+		t.Fatal("find", err)
+	}
+	if !r.HasNextContext(ctx) {
+		t.Fatal("HasNextContext returned false, want true for error")
+	}
+	if err := r.NextContext(ctx, &M{}); err != ErrDeadlineExceeded {
+		t.Fatalf("NextContext returned %v, want %v", err, ErrDeadlineExceeded)
+	}
+	r.Close()
+
+	// The reply to the abandoned query arrives after the deadline. The
+	// connection discards the reply and kills the cursor.
+	close(block)
+	if killed := s.waitKilled(1); len(killed) != 1 {
+		t.Errorf("killed %v, want one cursor", killed)
+	}
+
+	// The connection is still usable.
+	r, err = c.Find("db.c", M{"n": 3}, nil)
+	if err != nil {
+		t.Fatal("find", err)
+	}
+	defer r.Close()
+	n := 0
+	for r.HasNext() {
+		if err := r.Next(&M{}); err != nil {
+			t.Fatal("next", err)
+		}
+		n++
+	}
+	if n != 3 || r.Error() != EOF {
+		t.Errorf("got %d documents and error %v, want 3 and EOF", n, r.Error())
+	}
+	if c.Error() != nil {
+		t.Errorf("connection error %v", c.Error())
+	}
+}
+
+func TestReplyTimeout(t *testing.T) {
+	testReplyTimeout(t, 0)
+}
+
+func TestMsgReplyTimeout(t *testing.T) {
+	testReplyTimeout(t, minMsgWireVersion)
+}
+
+func testReplyTimeout(t *testing.T, maxWireVersion int) {
+	s := newFakeServerVersion(t, maxWireVersion, sequenceQuery)
+	defer s.Close()
+	c, err := DialWithOptions(s.ln.Addr().String(), &DialOptions{ReplyTimeout: 1e8})
+	if err != nil {
+		t.Fatal("dial", err)
+	}
+	defer c.Close()
+
+	find := func() os.Error {
+		ctx, cancel := WithTimeout(Background(), 2e7)
+		defer cancel()
+		r, err := c.FindContext(ctx, "db.c", M{"n": 1}, nil)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return r.NextContext(ctx, &M{})
+	}
+
+	// The reply arrives after the deadline, but within the reply timeout.
+	block := make(chan bool)
+	s.mu.Lock()
+	s.block = block
+	s.mu.Unlock()
+	if err := find(); err != ErrDeadlineExceeded {
+		t.Fatalf("find returned %v, want %v", err, ErrDeadlineExceeded)
+	}
+	s.mu.Lock()
+	s.block = nil
+	s.mu.Unlock()
+	close(block)
+	time.Sleep(2e8)
+	if err := c.Error(); err != nil {
+		t.Fatalf("connection error %v after late reply", err)
+	}
+
+	// The server does not reply.
+	block = make(chan bool)
+	defer close(block)
+	s.mu.Lock()
+	s.block = block
+	s.mu.Unlock()
+	if err := find(); err != ErrDeadlineExceeded {
+		t.Fatalf("find returned %v, want %v", err, ErrDeadlineExceeded)
+	}
+	for i := 0; i < 100 && c.Error() == nil; i++ {
+		time.Sleep(1e7)
+	}
+	if err := c.Error(); err != ErrReplyTimeout {
+		t.Errorf("connection error %v, want %v", err, ErrReplyTimeout)
+	}
+}
+
+func TestCursorCancel(t *testing.T) {
+	s := newFakeServer(t, sequenceQuery)
+	defer s.Close()
+	c := s.dial(t)
+	defer c.Close()
+
+	ctx, cancel := WithCancel(Background())
+	r, err := c.FindContext(ctx, "db.c", M{"n": 10}, &FindOptions{BatchSize: 2})
+	if err != nil {
+		t.Fatal("find", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := r.NextContext(ctx, &M{}); err != nil {
+			t.Fatal("next", err)
+		}
+	}
+	cancel()
+	if err := r.NextContext(ctx, &M{}); err != ErrCanceled {
+		t.Fatalf("NextContext returned %v, want %v", err, ErrCanceled)
+	}
+	if r.Error() != ErrCanceled {
+		t.Errorf("cursor error %v, want %v", r.Error(), ErrCanceled)
+	}
+	if killed := s.waitKilled(1); len(killed) != 1 {
+		t.Errorf("killed %v, want one cursor", killed)
+	}
+	if c.Error() != nil {
+		t.Errorf("connection error %v", c.Error())
+	}
+}
+
+func TestMsgFind(t *testing.T) {
+	s := newFakeServerVersion(t, minMsgWireVersion, sequenceQuery)
+	defer s.Close()
+	c := s.dial(t)
+	defer c.Close()
+
+	q := Collection{Conn: c, Namespace: "db.c"}.Find(M{"q": 1, "n": 5}).Sort(D{{"i", -1}}).BatchSize(2).Skip(1)
+	r, err := q.Cursor()
+	if err != nil {
+		t.Fatal("find", err)
+	}
+	n := 0
+	for r.HasNext() {
+		if err := r.Next(&M{}); err != nil {
+			t.Fatal("next", err)
+		}
+		n++
+	}
+	r.Close()
+	if n != 5 {
+		t.Errorf("got %d documents, want 5", n)
+	}
+
+	s.mu.Lock()
+	names := s.commands[0]
+	s.mu.Unlock()
+	if fmt.Sprint(names) != "[find filter sort skip batchSize $db]" {
+		t.Errorf("find command has elements %v", names)
+	}
+
+	var result struct {
+		Pong bool "pong"
+	}
+	s.query = func(namespace string, query M) ([]M, os.Error) {
+		if namespace != "db.$cmd" || query["ping"] != 1 {
+			return nil, os.NewError("unexpected command")
+		}
+		return []M{{"ok": 1, "pong": true}}, nil
+	}
+	if err := (Database{Conn: c, Name: "db"}).Run(D{{"ping", 1}}, &result); err != nil || !result.Pong {
+		t.Errorf("run returned %v, %v", result, err)
+	}
+}
+
+func TestConcurrentSafeInsert(t *testing.T) {
+	testConcurrentSafeInsert(t, 0)
+}
+
+func TestMsgConcurrentSafeInsert(t *testing.T) {
+	testConcurrentSafeInsert(t, minMsgWireVersion)
+}
+
+func testConcurrentSafeInsert(t *testing.T, maxWireVersion int) {
+	s := newFakeServerVersion(t, maxWireVersion, sequenceQuery)
+	defer s.Close()
+	c := s.dial(t)
+	defer c.Close()
+
+	const n = 40
+	errs := make(chan os.Error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			doc := M{"x": i}
+			fail := i%3 == 0
+			if fail {
+				doc["fail"] = true
+			}
+			for j := 0; j < 5; j++ {
+				err := c.SafeInsert(DefaultLastErrorCmd, "db.c", doc)
+				if e, ok := err.(*MongoError); fail && (!ok || e.Code != 11000) || !fail && err != nil {
+					errs <- os.NewError(fmt.Sprintf("insert %d returned %v, want fail=%v", i, err, fail))
+					return
+				}
+			}
+			errs <- nil
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestMsgWriteError(t *testing.T) {
+	s := newFakeServerVersion(t, minMsgWireVersion, sequenceQuery)
+	defer s.Close()
+	c := s.dial(t)
+	defer c.Close()
+
+	if err := c.Update("db.c", M{"x": 1}, M{"$set": M{"y": 1}}, &UpdateOptions{Upsert: true}); err != nil {
+		t.Error("update", err)
+	}
+	if err := c.Remove("db.c", M{"x": 1}, nil); err != nil {
+		t.Error("remove", err)
+	}
+	err := c.Insert("db.c", M{"x": 1}, M{"fail": true})
+	if e, ok := err.(*MongoError); !ok || e.Code != 11000 || e.N != 1 {
+		t.Errorf("insert returned %#v, want duplicate key error", err)
+	}
+	if c.Error() != nil {
+		t.Errorf("connection error %v", c.Error())
+	}
+}
+
+func TestCreateIndex(t *testing.T) {
+	testCreateIndex(t, 0)
+}
+
+func TestMsgCreateIndex(t *testing.T) {
+	testCreateIndex(t, minMsgWireVersion)
+}
+
+func testCreateIndex(t *testing.T, maxWireVersion int) {
+	var indexes []interface{}
+	s := newFakeServerVersion(t, maxWireVersion, func(namespace string, query M) ([]M, os.Error) {
+		if namespace != "db.$cmd" || query["createIndexes"] != "c" {
+			return nil, os.NewError("unexpected command")
+		}
+		indexes, _ = query["indexes"].([]interface{})
+		return []M{{"ok": 1}}, nil
+	})
+	defer s.Close()
+	c := s.dial(t)
+	defer c.Close()
+
+	err := Collection{Conn: c, Namespace: "db.c"}.CreateIndex(D{{"x", 1}}, &IndexOptions{Unique: true})
+	if err != nil {
+		t.Fatal("create index", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var index M
+	if maxWireVersion >= minMsgWireVersion {
+		if len(indexes) != 1 || s.inserts != 0 || s.lastErrs != 0 {
+			t.Fatalf("indexes=%v, inserts=%d, getLastError=%d", indexes, s.inserts, s.lastErrs)
+		}
+		m, _ := indexes[0].(map[string]interface{})
+		index = M(m)
+		if index["ns"] != nil {
+			t.Errorf("createIndexes index has ns %v", index["ns"])
+		}
+	} else {
+		if len(s.inserted) != 1 || s.lastErrs != 1 {
+			t.Fatalf("inserted=%v, getLastError=%d", s.inserted, s.lastErrs)
+		}
+		index = s.inserted[0]
+		if index["ns"] != "db.c" {
+			t.Errorf("index ns = %v, want db.c", index["ns"])
+		}
+	}
+	if index["name"] != "x_1" || index["unique"] != true {
+		t.Errorf("index = %v", index)
+	}
+}
+
+func TestSafeInsertContextDeadline(t *testing.T) {
+	testSafeInsertContextDeadline(t, 0)
+}
+
+func TestMsgSafeInsertContextDeadline(t *testing.T) {
+	testSafeInsertContextDeadline(t, minMsgWireVersion)
+}
+
+func testSafeInsertContextDeadline(t *testing.T, maxWireVersion int) {
+	s := newFakeServerVersion(t, maxWireVersion, sequenceQuery)
+	defer s.Close()
+	c := s.dial(t)
+	defer c.Close()
+
+	block := make(chan bool)
+	s.mu.Lock()
+	s.block = block
+	s.mu.Unlock()
+
+	ctx, cancel := WithTimeout(Background(), 2e7)
+	defer cancel()
+	if err := c.SafeInsertContext(ctx, DefaultLastErrorCmd, "db.c", M{"x": 1}); err != ErrDeadlineExceeded {
+		t.Fatalf("SafeInsertContext returned %v, want %v", err, ErrDeadlineExceeded)
+	}
+
+	// The late reply is discarded and the connection is still usable.
+	s.mu.Lock()
+	s.block = nil
+	s.mu.Unlock()
+	close(block)
+	if err := c.SafeInsert(DefaultLastErrorCmd, "db.c", M{"fail": true}); err == nil {
+		t.Error("insert did not return write error")
+	}
+	if c.Error() != nil {
+		t.Errorf("connection error %v", c.Error())
+	}
+}
+
+func TestMsgWriteConcern(t *testing.T) {
+	s := newFakeServerVersion(t, minMsgWireVersion, sequenceQuery)
+	defer s.Close()
+	c := s.dial(t)
+	defer c.Close()
+
+	for _, tt := range []struct {
+		cmd      interface{}
+		expected string
+	}{
+		{D{{"getLastError", 1}, {"w", 2}, {"j", true}, {"wtimeout", 100}}, "map[j:true w:2 wtimeout:100]"},
+		{M{"getLastError": 1, "w": "majority", "fsync": true}, "map[fsync:true w:majority]"},
+		{DefaultLastErrorCmd, "map[]"},
+		{nil, "map[]"},
+	} {
+		s.mu.Lock()
+		s.concerns = nil
+		s.mu.Unlock()
+		if err := c.SafeInsert(tt.cmd, "db.c", M{"x": 1}); err != nil {
+			t.Errorf("insert with %v returned %v", tt.cmd, err)
+		}
+		if err := c.SafeUpdate(tt.cmd, "db.c", M{"x": 1}, M{"x": 2}, nil); err != nil {
+			t.Errorf("update with %v returned %v", tt.cmd, err)
+		}
+		if err := c.SafeRemove(tt.cmd, "db.c", M{"x": 1}, nil); err != nil {
+			t.Errorf("remove with %v returned %v", tt.cmd, err)
+		}
+		s.mu.Lock()
+		concerns := s.concerns
+		s.mu.Unlock()
+		if len(concerns) != 3 {
+			t.Errorf("server received %d write commands, want 3", len(concerns))
+		}
+		for _, wc := range concerns {
+			if fmt.Sprint(map[string]interface{}(wc)) != tt.expected {
+				t.Errorf("write concern for %v is %v, want %s", tt.cmd, wc, tt.expected)
+			}
+		}
+	}
+}
+
+func TestMsgSafeInsert(t *testing.T) {
+	s := newFakeServerVersion(t, minMsgWireVersion, sequenceQuery)
+	defer s.Close()
+	c := s.dial(t)
+	defer c.Close()
+
+	coll := Collection{Conn: c, Namespace: "db.c", LastErrorCmd: DefaultLastErrorCmd}
+	if err := coll.Insert(M{"x": 1}); err != nil {
+		t.Error("insert", err)
+	}
+	if err := coll.Insert(M{"fail": true}); err == nil {
+		t.Error("insert did not return write error")
+	}
+	s.mu.Lock()
+	n := s.lastErrs
+	s.mu.Unlock()
+	if n != 0 {
+		t.Errorf("server received %d getLastError commands, want 0", n)
+	}
+}
+
+func TestOrphanCursor(t *testing.T) {
+	doc, _ := Encode(nil, D{{"cursor", D{{"id", int64(5)}, {"ns", "db.c"}}}, {"ok", 1}})
+	if ns, id := orphanCursor(&reply{docs: [][]byte{doc}}); ns != "db.c" || id != 5 {
+		t.Errorf("orphanCursor returned %q, %d, want db.c, 5", ns, id)
+	}
+
+	// Corrupt each byte of the reply. The cursor is not found or found
+	// without a panic.
+	for i := 4; i < len(doc); i++ {
+		for _, v := range []byte{0x00, 0x01, 0x7f, 0xff} {
+			p := make([]byte, len(doc))
+			copy(p, doc)
+			p[i] = v
+			orphanCursor(&reply{docs: [][]byte{p}})
+		}
+	}
+}
+
+func TestMsgExhaust(t *testing.T) {
+	s := newFakeServerVersion(t, minMsgWireVersion, sequenceQuery)
+	defer s.Close()
+	c := s.dial(t)
+	defer c.Close()
+
+	r, err := c.Find("db.c", M{"n": 9}, &FindOptions{BatchSize: 2, Exhaust: true})
+	if err != nil {
+		t.Fatal("find", err)
+	}
+	defer r.Close()
+	i := 0
+	for r.HasNext() {
+		var m M
+		if err := r.Next(&m); err != nil {
+			t.Fatal("next", err)
+		}
+		if m["i"] != i {
+			t.Fatalf("got %v, want i=%d", m, i)
+		}
+		i++
+	}
+	if i != 9 {
+		t.Errorf("got %d documents, want 9", i)
+	}
+
+	s.mu.Lock()
+	n := len(s.commands)
+	s.mu.Unlock()
+	if n != 2 {
+		t.Errorf("server received %d commands, want find and getMore", n)
+	}
+}
+
+func TestReadMsg(t *testing.T) {
+	msg := fakeMsg(1, 2, 0, M{"ok": 1})
+	c := &connection{}
+	rep, err := c.readMsg(msg[:16], msg[16:])
+	if err != nil {
+		t.Fatal("readMsg", err)
+	}
+	if !rep.msg || len(rep.docs) != 1 || rep.requestId != 1 {
+		t.Errorf("readMsg returned %+v", rep)
+	}
+
+	msg[len(msg)-5] ^= 1
+	if _, err := c.readMsg(msg[:16], msg[16:]); err == nil {
+		t.Error("readMsg did not detect bad checksum")
+	}
+
+	msg = fakeMsg(1, 2, 1<<3, M{"ok": 1})
+	if _, err := c.readMsg(msg[:16], msg[16:]); err == nil {
+		t.Error("readMsg did not reject unknown required flag")
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	s := newFakeServerVersion(t, minMsgWireVersion, sequenceQuery)
+	defer s.Close()
+	s.mu.Lock()
+	s.limits = M{"maxBsonObjectSize": 1000, "setName": "rs"}
+	s.mu.Unlock()
+	c, err := DialWithOptions(s.ln.Addr().String(), &DialOptions{AppName: "test-app"})
+	if err != nil {
+		t.Fatal("dial", err)
+	}
+	defer c.Close()
+
+	desc := c.ServerDescription()
+	if !desc.IsMaster || desc.SetName != "rs" || desc.MaxWireVersion != minMsgWireVersion ||
+		desc.MaxBSONObjectSize != 1000 ||
+		desc.MaxMessageSizeBytes != defaultMaxMessageSizeBytes ||
+		desc.MaxWriteBatchSize != defaultMaxWriteBatchSize {
+		t.Errorf("unexpected description %+v", desc)
+	}
+
+	s.mu.Lock()
+	client := s.client
+	s.mu.Unlock()
+	for path, want := range map[string]string{
+		"application.name": "test-app",
+		"driver.name":      driverName,
+		"os.type":          runtime.GOOS,
+	} {
+		if v := lookupPath(client, path); v != want {
+			t.Errorf("client metadata %s = %v, want %s", path, v, want)
+		}
+	}
+
+	if _, err := DialWithOptions(s.ln.Addr().String(), &DialOptions{AppName: strings.Repeat("x", 129)}); err == nil {
+		t.Error("dial accepted long application name")
+	}
+}
+
+func TestInsertLimits(t *testing.T) {
+	testInsertLimits(t, 0)
+}
+
+func TestMsgInsertLimits(t *testing.T) {
+	testInsertLimits(t, minMsgWireVersion)
+}
+
+func testInsertLimits(t *testing.T, maxWireVersion int) {
+	s := newFakeServerVersion(t, maxWireVersion, sequenceQuery)
+	defer s.Close()
+	s.mu.Lock()
+	s.limits = M{"maxBsonObjectSize": 200, "maxMessageSizeBytes": 400, "maxWriteBatchSize": 3}
+	s.mu.Unlock()
+	c := s.dial(t)
+	defer c.Close()
+
+	// Small documents are split by batch size. Larger documents are split by
+	// message size.
+	small := make([]interface{}, 10)
+	for i := range small {
+		small[i] = M{"x": i}
+	}
+	large := make([]interface{}, 5)
+	for i := range large {
+		large[i] = M{"x": i, "s": strings.Repeat("x", 130)}
+	}
+	tooLarge := M{"s": strings.Repeat("x", 200)}
+
+	for _, tt := range []struct {
+		docs    []interface{}
+		inserts int
+		ok      bool
+	}{
+		{small, 4, true},
+		{large, 3, true},
+		{[]interface{}{tooLarge}, 0, false},
+	} {
+		s.mu.Lock()
+		s.inserts = 0
+		s.inserted = nil
+		s.mu.Unlock()
+
+		err := c.Insert("db.c", tt.docs...)
+		if (err == nil) != tt.ok {
+			t.Errorf("insert %d documents returned %v", len(tt.docs), err)
+			continue
+		}
+
+		// Wait for the server to handle the legacy inserts.
+		r, _ := c.Find("db.c", M{"n": 1}, nil)
+		r.Next(&M{})
+		r.Close()
+
+		s.mu.Lock()
+		inserts, inserted := s.inserts, len(s.inserted)
+		s.mu.Unlock()
+		if inserts != tt.inserts || (tt.ok && inserted != len(tt.docs)) {
+			t.Errorf("insert %d documents: server received %d messages with %d documents, want %d messages", len(tt.docs), inserts, inserted, tt.inserts)
+		}
+	}
+
+	// The error in the first batch stops the insert.
+	s.mu.Lock()
+	s.inserts = 0
+	s.mu.Unlock()
+	docs := append([]interface{}{M{"x": 0}, M{"fail": true}}, small...)
+	err := c.SafeInsert(DefaultLastErrorCmd, "db.c", docs...)
+	if e, ok := err.(*MongoError); !ok || e.Code != 11000 {
+		t.Errorf("insert with failing first batch returned %v", err)
+	}
+	s.mu.Lock()
+	inserts := s.inserts
+	s.mu.Unlock()
+	if inserts != 1 {
+		t.Errorf("insert with failing first batch sent %d messages, want 1", inserts)
+	}
+}
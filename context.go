@@ -0,0 +1,147 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package mongo
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrCanceled is returned by an operation when the operation's context
+	// is canceled.
+	ErrCanceled = os.NewError("mongo: operation canceled")
+
+	// ErrDeadlineExceeded is returned by an operation when the deadline of
+	// the operation's context expires.
+	ErrDeadlineExceeded = os.NewError("mongo: deadline exceeded")
+
+	// ErrReplyTimeout is the permanent error on a connection when the server
+	// does not reply to a request abandoned by a Context method within the
+	// reply timeout of the connection.
+	ErrReplyTimeout = os.NewError("mongo: no reply from server")
+)
+
+// A Context carries a deadline and a cancellation signal to the Context
+// methods of Conn and Cursor. Contexts are safe for use by multiple
+// goroutines.
+type Context interface {
+	// Deadline returns the time in nanoseconds since the epoch when the
+	// context expires. Ok is false if the context does not have a deadline.
+	Deadline() (deadline int64, ok bool)
+
+	// Done returns a channel that is closed when the context is canceled or
+	// the deadline expires. Done returns nil if the context cannot be
+	// canceled.
+	Done() <-chan bool
+
+	// Err returns nil until Done is closed. After Done is closed, Err returns
+	// ErrCanceled or ErrDeadlineExceeded.
+	Err() os.Error
+}
+
+// CancelFunc cancels a context. Calls after the first call have no effect.
+type CancelFunc func()
+
+type backgroundContext int
+
+func (backgroundContext) Deadline() (int64, bool) { return 0, false }
+func (backgroundContext) Done() <-chan bool       { return nil }
+func (backgroundContext) Err() os.Error           { return nil }
+
+// Background returns a context that is never canceled and has no deadline.
+// The methods of Conn and Cursor without a context use this context.
+func Background() Context {
+	return backgroundContext(0)
+}
+
+type cancelContext struct {
+	deadline    int64
+	hasDeadline bool
+	done        chan bool
+
+	mu    sync.Mutex
+	err   os.Error
+	timer *time.Timer
+}
+
+func (c *cancelContext) Deadline() (int64, bool) { return c.deadline, c.hasDeadline }
+func (c *cancelContext) Done() <-chan bool       { return c.done }
+
+func (c *cancelContext) Err() os.Error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *cancelContext) cancel(err os.Error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+}
+
+func newCancelContext(parent Context) *cancelContext {
+	c := &cancelContext{done: make(chan bool)}
+	c.deadline, c.hasDeadline = parent.Deadline()
+	if done := parent.Done(); done != nil {
+		go func() {
+			select {
+			case <-done:
+				c.cancel(parent.Err())
+			case <-c.done:
+			}
+		}()
+	}
+	return c
+}
+
+// WithCancel returns a copy of parent that is canceled when the returned
+// cancel function is called or when parent is canceled.
+func WithCancel(parent Context) (Context, CancelFunc) {
+	c := newCancelContext(parent)
+	return c, func() { c.cancel(ErrCanceled) }
+}
+
+// WithDeadline returns a copy of parent that expires at deadline, specified
+// in nanoseconds since the epoch. The deadline of the returned context is the
+// earlier of deadline and the deadline of parent.
+func WithDeadline(parent Context, deadline int64) (Context, CancelFunc) {
+	c := newCancelContext(parent)
+	if c.hasDeadline && c.deadline <= deadline {
+		return c, func() { c.cancel(ErrCanceled) }
+	}
+	c.deadline, c.hasDeadline = deadline, true
+	if timeout := deadline - time.Nanoseconds(); timeout <= 0 {
+		c.cancel(ErrDeadlineExceeded)
+	} else {
+		c.mu.Lock()
+		c.timer = time.AfterFunc(timeout, func() { c.cancel(ErrDeadlineExceeded) })
+		c.mu.Unlock()
+	}
+	return c, func() { c.cancel(ErrCanceled) }
+}
+
+// WithTimeout returns WithDeadline(parent, time.Nanoseconds()+timeout).
+func WithTimeout(parent Context, timeout int64) (Context, CancelFunc) {
+	return WithDeadline(parent, time.Nanoseconds()+timeout)
+}
@@ -0,0 +1,67 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package mongo
+
+import (
+	"testing"
+	"time"
+)
+
+func isDone(ctx Context) bool {
+	select {
+	case <-ctx.Done():
+		return true
+	case <-time.After(1e9):
+	}
+	return false
+}
+
+func TestContext(t *testing.T) {
+	if ctx := Background(); ctx.Done() != nil || ctx.Err() != nil {
+		t.Error("background context can be canceled")
+	}
+
+	parent, cancelParent := WithCancel(Background())
+	child, cancelChild := WithTimeout(parent, 1e11)
+	defer cancelChild()
+	if child.Err() != nil {
+		t.Fatal("child done before cancel")
+	}
+	cancelParent()
+	if !isDone(child) || child.Err() != ErrCanceled {
+		t.Errorf("child of canceled parent: err %v, want %v", child.Err(), ErrCanceled)
+	}
+
+	ctx, cancel := WithTimeout(Background(), 1e7)
+	defer cancel()
+	if !isDone(ctx) || ctx.Err() != ErrDeadlineExceeded {
+		t.Errorf("timeout: err %v, want %v", ctx.Err(), ErrDeadlineExceeded)
+	}
+
+	parent, cancelParent = WithTimeout(Background(), 1e9)
+	defer cancelParent()
+	parentDeadline, _ := parent.Deadline()
+	child, cancelChild = WithDeadline(parent, parentDeadline+1e9)
+	defer cancelChild()
+	if deadline, ok := child.Deadline(); !ok || deadline != parentDeadline {
+		t.Errorf("child deadline %d, want parent deadline %d", deadline, parentDeadline)
+	}
+
+	ctx, cancel = WithDeadline(Background(), time.Nanoseconds()-1)
+	defer cancel()
+	if ctx.Err() != ErrDeadlineExceeded {
+		t.Errorf("past deadline: err %v, want %v", ctx.Err(), ErrDeadlineExceeded)
+	}
+}
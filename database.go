@@ -122,6 +122,11 @@ func (db Database) Run(cmd interface{}, result interface{}) os.Error {
 // LastError returns the last error for the database using cmd. If cmd is nil,
 // then the command {"getLasetError": 1} is used to get the error.
 //
+// The command reports the error for the last write on the connection. When
+// other goroutines write on the connection, the last write may not be the
+// write made by the caller. Use the Conn SafeInsert, SafeUpdate and
+// SafeRemove methods to check the error of a write on a shared connection.
+//
 // More information:
 //
 //  http://www.mongodb.org/display/DOCS/Last+Error+Commands
@@ -133,12 +138,18 @@ func (db Database) LastError(cmd interface{}) os.Error {
 	if err != nil {
 		return err
 	}
+	return lastError(Background(), cursor)
+}
+
+// lastError returns the error in the response to a getLastError command
+// read from cursor. The cursor is closed.
+func lastError(ctx Context, cursor Cursor) os.Error {
 	defer cursor.Close()
 	var r struct {
 		CommandResponse
 		MongoError
 	}
-	if err := cursor.Next(&r); err != nil {
+	if err := cursor.NextContext(ctx, &r); err != nil {
 		return err
 	}
 	if err := r.CommandResponse.Error(); err != nil {
@@ -78,24 +78,23 @@ type SafeConn struct {
 	Cmd interface{}
 }
 
-func (c SafeConn) checkError(namespace string, err os.Error) os.Error {
-	if err != nil {
-		return err
+func (c SafeConn) cmd() interface{} {
+	if c.Cmd == nil {
+		return DefaultLastErrorCmd
 	}
-	dbname, _ := SplitNamespace(namespace)
-	return Database{Conn: c.Conn, Name: dbname}.LastError(c.Cmd)
+	return c.Cmd
 }
 
 func (c SafeConn) Update(namespace string, selector, update interface{}, options *UpdateOptions) os.Error {
-	return c.checkError(namespace, c.Conn.Update(namespace, selector, update, options))
+	return c.Conn.SafeUpdate(c.cmd(), namespace, selector, update, options)
 }
 
 func (c SafeConn) Insert(namespace string, documents ...interface{}) os.Error {
-	return c.checkError(namespace, c.Conn.Insert(namespace, documents...))
+	return c.Conn.SafeInsert(c.cmd(), namespace, documents...)
 }
 
 func (c SafeConn) Remove(namespace string, selector interface{}, options *RemoveOptions) os.Error {
-	return c.checkError(namespace, c.Conn.Remove(namespace, selector, options))
+	return c.Conn.SafeRemove(c.cmd(), namespace, selector, options)
 }
 
 // Count is deprected. Use Collection{Conn: conn, Namespace:namespace}.Find(query).Count() instead.
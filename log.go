@@ -51,7 +51,26 @@ func (c loggingConn) Close() os.Error {
 }
 
 func (c loggingConn) Update(namespace string, selector, update interface{}, options *UpdateOptions) os.Error {
-	err := c.Conn.Update(namespace, selector, update, options)
+	return c.UpdateContext(Background(), namespace, selector, update, options)
+}
+
+func (c loggingConn) UpdateContext(ctx Context, namespace string, selector, update interface{}, options *UpdateOptions) os.Error {
+	err := c.Conn.UpdateContext(ctx, namespace, selector, update, options)
+	c.logUpdate(namespace, selector, update, options, err)
+	return err
+}
+
+func (c loggingConn) SafeUpdate(lastErrorCmd interface{}, namespace string, selector, update interface{}, options *UpdateOptions) os.Error {
+	return c.SafeUpdateContext(Background(), lastErrorCmd, namespace, selector, update, options)
+}
+
+func (c loggingConn) SafeUpdateContext(ctx Context, lastErrorCmd interface{}, namespace string, selector, update interface{}, options *UpdateOptions) os.Error {
+	err := c.Conn.SafeUpdateContext(ctx, lastErrorCmd, namespace, selector, update, options)
+	c.logUpdate(namespace, selector, update, options, err)
+	return err
+}
+
+func (c loggingConn) logUpdate(namespace string, selector, update interface{}, options *UpdateOptions, err os.Error) {
 	var buf bytes.Buffer
 	if options != nil {
 		if options.Upsert {
@@ -62,17 +81,49 @@ func (c loggingConn) Update(namespace string, selector, update interface{}, opti
 		}
 	}
 	log.Printf("%d.Update(%+v, %+v, %+v%s) (%v)", c.id, namespace, selector, update, buf.String(), err)
-	return err
 }
 
 func (c loggingConn) Insert(namespace string, documents ...interface{}) os.Error {
-	err := c.Conn.Insert(namespace, documents...)
+	return c.InsertContext(Background(), namespace, documents...)
+}
+
+func (c loggingConn) InsertContext(ctx Context, namespace string, documents ...interface{}) os.Error {
+	err := c.Conn.InsertContext(ctx, namespace, documents...)
+	log.Printf("%d.Insert(%s, %+v) (%v)", c.id, namespace, documents, err)
+	return err
+}
+
+func (c loggingConn) SafeInsert(lastErrorCmd interface{}, namespace string, documents ...interface{}) os.Error {
+	return c.SafeInsertContext(Background(), lastErrorCmd, namespace, documents...)
+}
+
+func (c loggingConn) SafeInsertContext(ctx Context, lastErrorCmd interface{}, namespace string, documents ...interface{}) os.Error {
+	err := c.Conn.SafeInsertContext(ctx, lastErrorCmd, namespace, documents...)
 	log.Printf("%d.Insert(%s, %+v) (%v)", c.id, namespace, documents, err)
 	return err
 }
 
 func (c loggingConn) Remove(namespace string, selector interface{}, options *RemoveOptions) os.Error {
-	err := c.Conn.Remove(namespace, selector, options)
+	return c.RemoveContext(Background(), namespace, selector, options)
+}
+
+func (c loggingConn) RemoveContext(ctx Context, namespace string, selector interface{}, options *RemoveOptions) os.Error {
+	err := c.Conn.RemoveContext(ctx, namespace, selector, options)
+	c.logRemove(namespace, selector, options, err)
+	return err
+}
+
+func (c loggingConn) SafeRemove(lastErrorCmd interface{}, namespace string, selector interface{}, options *RemoveOptions) os.Error {
+	return c.SafeRemoveContext(Background(), lastErrorCmd, namespace, selector, options)
+}
+
+func (c loggingConn) SafeRemoveContext(ctx Context, lastErrorCmd interface{}, namespace string, selector interface{}, options *RemoveOptions) os.Error {
+	err := c.Conn.SafeRemoveContext(ctx, lastErrorCmd, namespace, selector, options)
+	c.logRemove(namespace, selector, options, err)
+	return err
+}
+
+func (c loggingConn) logRemove(namespace string, selector interface{}, options *RemoveOptions, err os.Error) {
 	var buf bytes.Buffer
 	if options != nil {
 		if options.Single {
@@ -80,11 +131,14 @@ func (c loggingConn) Remove(namespace string, selector interface{}, options *Rem
 		}
 	}
 	log.Printf("%d.Remove(%s, %+v%s) (%v)", c.id, namespace, selector, buf.String(), err)
-	return err
 }
 
 func (c loggingConn) Find(namespace string, query interface{}, options *FindOptions) (Cursor, os.Error) {
-	r, err := c.Conn.Find(namespace, query, options)
+	return c.FindContext(Background(), namespace, query, options)
+}
+
+func (c loggingConn) FindContext(ctx Context, namespace string, query interface{}, options *FindOptions) (Cursor, os.Error) {
+	r, err := c.Conn.FindContext(ctx, namespace, query, options)
 	var id int
 	if r != nil {
 		id = newLogId()
@@ -133,6 +187,12 @@ type logCursor struct {
 	id int
 }
 
+// decoderCursor is implemented by cursors that decode with a configured
+// decoder.
+type decoderCursor interface {
+	decoder() *Decoder
+}
+
 func (r logCursor) Close() os.Error {
 	err := r.Cursor.Close()
 	log.Printf("%d.Close() (%v)", r.id, err)
@@ -140,13 +200,19 @@ func (r logCursor) Close() os.Error {
 }
 
 func (r logCursor) Next(value interface{}) os.Error {
-	var bd BSONData
-	err := r.Cursor.Next(&bd)
-	var m M
+	return r.NextContext(Background(), value)
+}
+
+func (r logCursor) NextContext(ctx Context, value interface{}) os.Error {
+	var raw Raw
+	err := r.Cursor.NextContext(ctx, &raw)
 	if err == nil {
-		err = Decode(bd.Data, value)
-		bd.Decode(&m)
+		dec := defaultDecoder
+		if dr, ok := r.Cursor.(decoderCursor); ok {
+			dec = dr.decoder()
+		}
+		err = dec.Decode(raw, value)
 	}
-	log.Printf("%d.Next() (%v, %v)", r.id, m, err)
+	log.Printf("%d.Next() (%v, %v)", r.id, raw, err)
 	return err
 }
@@ -90,6 +90,40 @@ type FindOptions struct {
 	BatchSize int
 }
 
+// ServerDescription describes the server at the other end of a connection.
+// The description is the response to the isMaster command run by Dial.
+// Fields not reported by the server are set to the default for old servers.
+type ServerDescription struct {
+	// True if the server is a replica set primary or a standalone server.
+	IsMaster bool "ismaster"
+
+	// True if the server is a replica set secondary.
+	Secondary bool "secondary"
+
+	// True if the server is read only.
+	ReadOnly bool "readOnly"
+
+	// The name of the replica set, the hosts in the set and the current
+	// primary.
+	SetName string   "setName"
+	Hosts   []string "hosts"
+	Primary string   "primary"
+
+	// "isdbgrid" if the server is a mongos.
+	Msg string "msg"
+
+	// The range of wire protocol versions supported by the server. The wire
+	// version increases with the server release; version 6 is MongoDB 3.6.
+	MinWireVersion int "minWireVersion"
+	MaxWireVersion int "maxWireVersion"
+
+	// The maximum size of a document, the maximum size of a message and the
+	// maximum number of documents in a write batch.
+	MaxBSONObjectSize   int "maxBsonObjectSize"
+	MaxMessageSizeBytes int "maxMessageSizeBytes"
+	MaxWriteBatchSize   int "maxWriteBatchSize"
+}
+
 // A Conn represents a connection to a MongoDB server. 
 //
 // When the application is done using the connection, the application must call
@@ -100,6 +134,22 @@ type FindOptions struct {
 // and collection. A namespace string has the format "<database>.<collection>"
 // where <database> is the name of the database and <collection> is the name of
 // the collection. 
+//
+// The connections returned by Dial and DialWithOptions can be used by multiple
+// goroutines concurrently. Requests from different goroutines are sent over
+// the one socket and the replies are routed to the cursors waiting for them.
+// A Cursor must not be used by more than one goroutine at a time.
+//
+// The Context methods stop waiting for the server when the context is
+// canceled or the deadline expires and return ErrCanceled or
+// ErrDeadlineExceeded. A cursor with a canceled operation is closed and the
+// cursor on the server is killed; the connection remains usable. If the
+// server does not reply to the abandoned request within the reply timeout set
+// in DialOptions, then the server is assumed to be hung and ErrReplyTimeout is
+// a permanent error on the connection. The deadline of the context is also
+// used as the timeout for writing a request to the socket. Because a
+// partially written request cannot be recovered, a write timeout is a
+// permanent error on the connection.
 type Conn interface {
 	// Close releases the resources used by this connection.
 	Close() os.Error
@@ -110,7 +160,9 @@ type Conn interface {
 	// Update document specified by selector with update.
 	Update(namespace string, selector, update interface{}, options *UpdateOptions) os.Error
 
-	// Insert documents.
+	// Insert documents. Insert splits the documents across several messages
+	// when the documents exceed the message size or batch size limits of the
+	// server. A document larger than the maximum document size is an error.
 	Insert(namespace string, documents ...interface{}) os.Error
 
 	// Remove documents specified by selector.
@@ -118,6 +170,58 @@ type Conn interface {
 
 	// Find documents specified by selector. The returned cursor must be closed.
 	Find(namespace string, query interface{}, options *FindOptions) (Cursor, os.Error)
+
+	// UpdateContext is like Update, but uses the deadline and cancellation
+	// of ctx.
+	UpdateContext(ctx Context, namespace string, selector, update interface{}, options *UpdateOptions) os.Error
+
+	// InsertContext is like Insert, but uses the deadline and cancellation
+	// of ctx.
+	InsertContext(ctx Context, namespace string, documents ...interface{}) os.Error
+
+	// RemoveContext is like Remove, but uses the deadline and cancellation
+	// of ctx.
+	RemoveContext(ctx Context, namespace string, selector interface{}, options *RemoveOptions) os.Error
+
+	// FindContext is like Find, but uses the deadline and cancellation of
+	// ctx to send the query. Use the Context methods of the returned cursor
+	// to receive the results with a deadline or cancellation.
+	FindContext(ctx Context, namespace string, query interface{}, options *FindOptions) (Cursor, os.Error)
+
+	// SafeUpdate is like Update, but also sends lastErrorCmd to the database
+	// and returns the error reported by the command. No other request on
+	// the connection is sent between the update and the command. If
+	// lastErrorCmd is nil, then the error is not checked. On servers that
+	// support OP_MSG, the write is acknowledged in the reply to the write
+	// command. The w, j, wtimeout and fsync options in lastErrorCmd are
+	// sent as the write concern of the command instead of running
+	// lastErrorCmd.
+	SafeUpdate(lastErrorCmd interface{}, namespace string, selector, update interface{}, options *UpdateOptions) os.Error
+
+	// SafeInsert is like Insert, but checks the error as SafeUpdate does.
+	// When the documents are split across several messages, the error is
+	// checked after each message and the remaining documents are not sent
+	// after an error.
+	SafeInsert(lastErrorCmd interface{}, namespace string, documents ...interface{}) os.Error
+
+	// SafeRemove is like Remove, but checks the error as SafeUpdate does.
+	SafeRemove(lastErrorCmd interface{}, namespace string, selector interface{}, options *RemoveOptions) os.Error
+
+	// SafeUpdateContext is like SafeUpdate, but uses the deadline and
+	// cancellation of ctx to send the update and wait for the error.
+	SafeUpdateContext(ctx Context, lastErrorCmd interface{}, namespace string, selector, update interface{}, options *UpdateOptions) os.Error
+
+	// SafeInsertContext is like SafeInsert, but uses the deadline and
+	// cancellation of ctx.
+	SafeInsertContext(ctx Context, lastErrorCmd interface{}, namespace string, documents ...interface{}) os.Error
+
+	// SafeRemoveContext is like SafeRemove, but uses the deadline and
+	// cancellation of ctx.
+	SafeRemoveContext(ctx Context, lastErrorCmd interface{}, namespace string, selector interface{}, options *RemoveOptions) os.Error
+
+	// ServerDescription returns the description of the server found when
+	// the connection was established.
+	ServerDescription() ServerDescription
 }
 
 // Cursor iterates over the results from a Find operation.
@@ -159,4 +263,12 @@ type Cursor interface {
 	// Next fetches the next document from the cursor. Value must be a map or
 	// a non-nil pointer to struct or map.
 	Next(value interface{}) os.Error
+
+	// HasNextContext is like HasNext, but uses the deadline and cancellation
+	// of ctx.
+	HasNextContext(ctx Context) bool
+
+	// NextContext is like Next, but uses the deadline and cancellation of
+	// ctx.
+	NextContext(ctx Context, value interface{}) os.Error
 }
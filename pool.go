@@ -58,6 +58,14 @@ func NewDialPool(addr string, maxIdle int) *Pool {
 	return NewPool(func() (Conn, os.Error) { return Dial(addr) }, maxIdle)
 }
 
+// NewDialPoolWithOptions returns a new connection pool. The pool uses
+// mongo.DialWithOptions to create new connections and maintains a maximum of
+// maxIdle connections. Use the User and Password options to authenticate
+// every connection created by the pool.
+func NewDialPoolWithOptions(addr string, options *DialOptions, maxIdle int) *Pool {
+	return NewPool(func() (Conn, os.Error) { return DialWithOptions(addr, options) }, maxIdle)
+}
+
 // NewPool returns a new connection pool. The pool uses newFn to create
 // connections as needed and maintains a maximum of maxIdle idle connections.
 func NewPool(newFn func() (Conn, os.Error), maxIdle int) *Pool {
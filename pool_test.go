@@ -36,6 +36,37 @@ func (c *fakeConn) Remove(namespace string, selector interface{}, options *Remov
 func (c *fakeConn) Find(namespace string, query interface{}, options *FindOptions) (Cursor, os.Error) {
 	return nil, nil
 }
+func (c *fakeConn) UpdateContext(ctx Context, namespace string, selector, update interface{}, options *UpdateOptions) os.Error {
+	return nil
+}
+func (c *fakeConn) InsertContext(ctx Context, namespace string, documents ...interface{}) os.Error {
+	return nil
+}
+func (c *fakeConn) RemoveContext(ctx Context, namespace string, selector interface{}, options *RemoveOptions) os.Error {
+	return nil
+}
+func (c *fakeConn) FindContext(ctx Context, namespace string, query interface{}, options *FindOptions) (Cursor, os.Error) {
+	return nil, nil
+}
+func (c *fakeConn) SafeUpdate(lastErrorCmd interface{}, namespace string, selector, update interface{}, options *UpdateOptions) os.Error {
+	return nil
+}
+func (c *fakeConn) SafeInsert(lastErrorCmd interface{}, namespace string, documents ...interface{}) os.Error {
+	return nil
+}
+func (c *fakeConn) SafeRemove(lastErrorCmd interface{}, namespace string, selector interface{}, options *RemoveOptions) os.Error {
+	return nil
+}
+func (c *fakeConn) SafeUpdateContext(ctx Context, lastErrorCmd interface{}, namespace string, selector, update interface{}, options *UpdateOptions) os.Error {
+	return nil
+}
+func (c *fakeConn) SafeInsertContext(ctx Context, lastErrorCmd interface{}, namespace string, documents ...interface{}) os.Error {
+	return nil
+}
+func (c *fakeConn) SafeRemoveContext(ctx Context, lastErrorCmd interface{}, namespace string, selector interface{}, options *RemoveOptions) os.Error {
+	return nil
+}
+func (c *fakeConn) ServerDescription() ServerDescription { return ServerDescription{} }
 
 func TestPool(t *testing.T) {
 	var count int
@@ -0,0 +1,148 @@
+// Copyright 2011 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+
+package mongo
+
+import (
+	"bytes"
+	"exp/norm"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"utf8"
+)
+
+// saslPrep prepares a password using the SASLprep profile of stringprep
+// (RFC 4013). Non-ASCII spaces are mapped to space, characters commonly
+// mapped to nothing are removed and the result is normalized to Unicode
+// normalization form KC. Prohibited characters and strings that violate the
+// bidirectional text rules are rejected. Unassigned code points are allowed
+// as in stringprep queries.
+func saslPrep(s string) (string, os.Error) {
+	ascii := true
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf || s[i] < ' ' || s[i] == 0x7f {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return s, nil
+	}
+
+	var b bytes.Buffer
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			return "", os.NewError("mongo: invalid UTF-8 in password")
+		}
+		i += size
+		switch {
+		case inTable(saslNonASCIISpace, r):
+			r = ' '
+		case inTable(saslMapToNothing, r):
+			continue
+		}
+		b.WriteRune(r)
+	}
+	s = norm.NFKC.String(b.String())
+
+	var randAL, l bool
+	first, last := -1, -1
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+		if inTable(saslProhibited, r) || r&0xfffe == 0xfffe {
+			return "", os.NewError("mongo: prohibited character U+" + strings.ToUpper(strconv.Itob64(int64(r), 16)) + " in password")
+		}
+		if inTable(saslRandAL, r) {
+			randAL = true
+			if first < 0 {
+				first = r
+			}
+			last = r
+		} else {
+			if unicode.IsLetter(r) {
+				l = true
+			}
+			if first < 0 {
+				first = 0
+			}
+			last = 0
+		}
+	}
+
+	// A string with right to left characters must not contain left to right
+	// characters and must start and end with a right to left character. Letters
+	// that are not right to left are treated as left to right.
+	if randAL && (l || first == 0 || last == 0) {
+		return "", os.NewError("mongo: invalid bidirectional text in password")
+	}
+	return s, nil
+}
+
+// inTable returns true if r is in one of the sorted, inclusive ranges in
+// table.
+func inTable(table [][2]int, r int) bool {
+	i, j := 0, len(table)
+	for i < j {
+		h := i + (j-i)/2
+		switch {
+		case r < table[h][0]:
+			j = h
+		case r > table[h][1]:
+			i = h + 1
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// RFC 3454 table C.1.2.
+var saslNonASCIISpace = [][2]int{
+	{0x00a0, 0x00a0}, {0x1680, 0x1680}, {0x2000, 0x200b}, {0x202f, 0x202f},
+	{0x205f, 0x205f}, {0x3000, 0x3000},
+}
+
+// RFC 3454 table B.1.
+var saslMapToNothing = [][2]int{
+	{0x00ad, 0x00ad}, {0x034f, 0x034f}, {0x1806, 0x1806}, {0x180b, 0x180d},
+	{0x200b, 0x200d}, {0x2060, 0x2060}, {0xfe00, 0xfe0f}, {0xfeff, 0xfeff},
+}
+
+// RFC 3454 tables C.2.1, C.2.2, C.3, C.4 (except the code points ending in
+// FFFE and FFFF), C.5, C.6, C.7, C.8 and C.9.
+var saslProhibited = [][2]int{
+	{0x0000, 0x001f}, {0x007f, 0x009f}, {0x0340, 0x0341}, {0x06dd, 0x06dd},
+	{0x070f, 0x070f}, {0x180e, 0x180e}, {0x200c, 0x200f}, {0x2028, 0x202e},
+	{0x2060, 0x2063}, {0x206a, 0x206f}, {0x2ff0, 0x2ffb}, {0xd800, 0xf8ff},
+	{0xfdd0, 0xfdef}, {0xfeff, 0xfeff}, {0xfff9, 0xfffd}, {0x1d173, 0x1d17a},
+	{0xe0001, 0xe0001}, {0xe0020, 0xe007f}, {0xf0000, 0xffffd},
+	{0x100000, 0x10fffd},
+}
+
+// RFC 3454 table D.1, characters with bidirectional property R or AL.
+var saslRandAL = [][2]int{
+	{0x05be, 0x05be}, {0x05c0, 0x05c0}, {0x05c3, 0x05c3}, {0x05d0, 0x05ea},
+	{0x05f0, 0x05f4}, {0x061b, 0x061b}, {0x061f, 0x061f}, {0x0621, 0x063a},
+	{0x0640, 0x064a}, {0x066d, 0x066f}, {0x0671, 0x06d5}, {0x06dd, 0x06dd},
+	{0x06e5, 0x06e6}, {0x06fa, 0x06fe}, {0x0700, 0x070d}, {0x0710, 0x0710},
+	{0x0712, 0x072c}, {0x0780, 0x07a5}, {0x07b1, 0x07b1}, {0x200f, 0x200f},
+	{0xfb1d, 0xfb1d}, {0xfb1f, 0xfb28}, {0xfb2a, 0xfb36}, {0xfb38, 0xfb3c},
+	{0xfb3e, 0xfb3e}, {0xfb40, 0xfb41}, {0xfb43, 0xfb44}, {0xfb46, 0xfbb1},
+	{0xfbd3, 0xfd3d}, {0xfd50, 0xfd8f}, {0xfd92, 0xfdc7}, {0xfdf0, 0xfdfc},
+	{0xfe70, 0xfe74}, {0xfe76, 0xfefc},
+}